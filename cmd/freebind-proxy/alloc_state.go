@@ -0,0 +1,103 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding"
+	"errors"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// allocStateSaveInterval is how often allocator state is saved, so crash loses only few positions
+const allocStateSaveInterval = time.Minute
+
+type allocState interface {
+	encoding.TextMarshaler
+	encoding.TextUnmarshaler
+}
+
+// loadAllocState restores allocator state from file, missing or mismatching state is not fatal
+func loadAllocState(logger *zap.Logger, alloc allocState, path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logger.Warn("Failed to read allocator state", zap.String("file", path), zap.Error(err))
+		}
+
+		return
+	}
+
+	if err := alloc.UnmarshalText(data); err != nil {
+		logger.Warn("Ignoring allocator state", zap.String("file", path), zap.Error(err))
+
+		return
+	}
+
+	logger.Info("Resumed allocator state", zap.String("file", path))
+}
+
+// saveAllocState atomically writes allocator state to file
+func saveAllocState(alloc allocState, path string) error {
+	data, err := alloc.MarshalText()
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(append(data, '\n')); err != nil {
+		_ = tmpFile.Close()
+
+		return err
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// startAllocStateSaver periodically saves allocator state, returned func stops saver and saves final state
+func startAllocStateSaver(logger *zap.Logger, alloc allocState, path string) func() {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+
+		ticker := time.NewTicker(allocStateSaveInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				if err := saveAllocState(alloc, path); err != nil {
+					logger.Warn("Failed to save allocator state", zap.String("file", path), zap.Error(err))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stopCh)
+		<-doneCh
+
+		if err := saveAllocState(alloc, path); err != nil {
+			logger.Error("Failed to save allocator state", zap.String("file", path), zap.Error(err))
+
+			return
+		}
+
+		logger.Info("Saved allocator state", zap.String("file", path))
+	}
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package main
+
+import (
+	"github.com/codercms/freebind-proxy/utils"
+	"go.uber.org/zap"
+	"time"
+)
+
+// startAllocUsageLogger periodically logs number of addresses allocated from each subnet,
+// returned func stops logger and logs final usage
+func startAllocUsageLogger(logger *zap.Logger, alloc *utils.WeightedAllocator, interval time.Duration) func() {
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+
+	go func() {
+		defer close(doneCh)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-ticker.C:
+				logAllocUsage(logger, alloc)
+			}
+		}
+	}()
+
+	return func() {
+		close(stopCh)
+		<-doneCh
+
+		logAllocUsage(logger, alloc)
+	}
+}
+
+func logAllocUsage(logger *zap.Logger, alloc *utils.WeightedAllocator) {
+	usage := alloc.Usage()
+
+	var total uint64
+	for _, u := range usage {
+		total += u.Allocated
+	}
+
+	for _, u := range usage {
+		var share float64
+		if total > 0 {
+			share = float64(u.Allocated) / float64(total)
+		}
+
+		logger.Info("Subnet usage",
+			zap.String("subnet", u.Prefix.String()),
+			zap.Uint64("allocated", u.Allocated),
+			zap.Float64("share", share),
+		)
+	}
+}
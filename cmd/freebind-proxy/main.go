@@ -5,10 +5,16 @@ package main
 import (
 	"context"
 	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"flag"
+	"fmt"
 	"github.com/codercms/freebind-proxy/proxy"
+	"github.com/codercms/freebind-proxy/route"
+	"github.com/codercms/freebind-proxy/utils"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"log"
@@ -16,49 +22,249 @@ import (
 	"net/http"
 	"net/netip"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
-var localNet string
+var localNets []utils.WeightedPrefix
 var localIface string
 var addSubnetRoute bool
+var delSubnetRoute bool
+var routeTable uint
+var freebindMode string
+
+var preflightMode string
 
 var listenAddr string
+var socksListenAddr string
+var socksUdpIdleTimeout time.Duration
+
+var metricsListenAddr string
+
+var adminListenAddr string
+var adminToken string
+
+var tlsCertFile string
+var tlsKeyFile string
+var tlsSelfSigned bool
+var tlsClientCA string
 
 var authUser string
 var authPass string
+var authFile string
+var authFileCheckInterval time.Duration
+
+var clientACL proxy.ClientACL
+
+var ssrfProtection bool
+var ssrfAllow utils.IPSet
+
+var rulesFile string
+var rulesFileCheckInterval time.Duration
+
+var dnsUpstreams []proxy.DNSUpstream
+var dnsHosts = make(map[string][]netip.Addr)
+var dnsFreebind bool
+var dnsCacheSize int
 
 var randSeed string
+var randMode string
+
+var allocMode string
+var allocStateFile string
+var allocUsageLogInterval time.Duration
+
+var excludeAddrs utils.IPSet
+var excludeFile string
+var excludeReserved bool
+
+var sessionTtl time.Duration
+var sessionMax int
+
+var dialAttempts int
+var dialBudget time.Duration
+var dialAttemptTimeout time.Duration
+var dialRetryOn string
+
+var sockMark uint
+var sockBindDevice string
+var sockKeepAlive time.Duration
+var sockUserTimeout time.Duration
+var sockTos int
 
 var logLevel string
 
+var accessLogPath string
+var accessLogFormat string
+var accessLogMaxSize int64
+var accessLogMaxBackups int
+
 func init() {
-	flag.StringVar(&localNet, "net", "", "Network subnet, e.g. 10.0.0.1/24")
-	flag.StringVar(&localIface, "iface", "eth0", "Local interface to bind to")
-	flag.BoolVar(&addSubnetRoute, "add-route", false, "Add route to network subnet")
+	flag.Func("net", "Network subnet with optional weight, e.g. 10.0.0.1/24 or 2001:db8::/48=3\n"+
+		"Can be repeated or comma separated, subnet is chosen proportionally to its weight (default 1)", func(s string) error {
+		for _, entry := range strings.Split(s, ",") {
+			prefix, err := utils.ParseWeightedPrefix(entry)
+			if err != nil {
+				return err
+			}
+
+			localNets = append(localNets, prefix)
+		}
+
+		return nil
+	})
+	flag.StringVar(&localIface, "iface", "eth0", "Local interface of the added subnet route")
+	flag.BoolVar(&addSubnetRoute, "add-route", false, "Add local (AnyIP) route to network subnet, existing route is kept as is")
+	flag.BoolVar(&delSubnetRoute, "del-route", false, "Delete added route to network subnet on shutdown")
+	flag.UintVar(&routeTable, "route-table", 0, "Routing table of the added route\nDefault: local table")
+	flag.StringVar(&freebindMode, "freebind-mode", "freebind", "Socket option used to bind non-local source IPs (freebind, transparent)\n"+
+		"freebind - IP_FREEBIND/IPV6_FREEBIND\n"+
+		"transparent - IP_TRANSPARENT/IPV6_TRANSPARENT for TPROXY setups, requires CAP_NET_ADMIN")
+
+	flag.StringVar(&preflightMode, "preflight", "warn", "Startup self-test of freebind for the subnets (fail, warn, off)\n"+
+		"fail - refuse to start when self-test fails\n"+
+		"warn - log failed checks and start anyway")
 
 	flag.StringVar(&listenAddr, "addr", ":8080", "Listen address")
+	flag.StringVar(&socksListenAddr, "socks-addr", "", "SOCKS5 listen address, e.g. :1080 (disabled by default)")
+	flag.DurationVar(&socksUdpIdleTimeout, "socks-udp-idle-timeout", 2*time.Minute, "Idle timeout of SOCKS5 UDP associations")
+	flag.StringVar(&metricsListenAddr, "metrics-addr", "", "Prometheus metrics listen address, e.g. 127.0.0.1:9100, metrics are served at /metrics (disabled by default)")
+	flag.StringVar(&adminListenAddr, "admin-addr", "", "Admin API listen address, e.g. 127.0.0.1:9200, API lists and terminates active connections (disabled by default)\n"+
+		"GET /connections, DELETE /connections/<id>, DELETE /connections?user=<user> or ?source_ip=<ip>")
+	flag.StringVar(&adminToken, "admin-token", "", "Bearer token of the admin API requests (required by -admin-addr)")
+
+	flag.Func("client-allow", "Clients which may use the proxy, comma separated addresses, prefixes or ranges, can be repeated\n"+
+		"Default: any client", ipSetFlag(&clientACL.Allow))
+	flag.Func("client-deny", "Clients which must not use the proxy, comma separated addresses, prefixes or ranges, can be repeated", ipSetFlag(&clientACL.Deny))
+	flag.Func("client-identity", "Implicit proxy user of clients from the prefix, they are authenticated without credentials\n"+
+		"e.g. 10.1.0.0/16=ci, can be repeated", func(s string) error {
+		identity, err := proxy.ParseClientIdentity(s)
+		if err != nil {
+			return err
+		}
+
+		clientACL.Identities = append(clientACL.Identities, identity)
+
+		return nil
+	})
+
+	flag.BoolVar(&ssrfProtection, "ssrf-protection", true, "Deny destinations resolving to loopback, private, link-local (incl. cloud metadata),\n"+
+		"multicast, reserved or network subnet addresses, destination host is resolved once and checked addresses are dialed")
+	flag.Func("ssrf-allow", "Destinations allowed despite SSRF protection, comma separated addresses, prefixes or ranges, can be repeated\n"+
+		"e.g. 10.20.0.0/16", ipSetFlag(&ssrfAllow))
+
+	flag.StringVar(&rulesFile, "rules-file", "", "Destination rules file, one rule per line:\n"+
+		"allow <patterns> - destinations which may be requested, e.g. allow *.example.com, 192.0.2.0/24\n"+
+		"deny <patterns> - destinations which must not be requested, e.g. deny admin.example.com:443\n"+
+		"connect-ports <ports> - ports which may be tunnelled (CONNECT, SOCKS5), e.g. connect-ports 443, 8000-8999")
+	flag.DurationVar(&rulesFileCheckInterval, "rules-file-check-interval", 10*time.Second, "How often rules file is checked for changes\n0 disables checks (SIGHUP still reloads)")
+
+	flag.Func("dns", "Upstream DNS server of the destination hosts, can be repeated, e.g. 1.1.1.1, tcp://1.1.1.1,\n"+
+		"tls://1.1.1.1#cloudflare-dns.com (DNS-over-TLS), https://dns.google/dns-query (DNS-over-HTTPS)\n"+
+		"Default: system resolver", func(s string) error {
+		upstream, err := proxy.ParseDNSUpstream(s)
+		if err != nil {
+			return err
+		}
+
+		dnsUpstreams = append(dnsUpstreams, upstream)
+
+		return nil
+	})
+	flag.Func("dns-host", "Static address of the destination host, e.g. db.internal=10.0.0.5,fd00::5, can be repeated", func(s string) error {
+		name, addrsStr, ok := strings.Cut(s, "=")
+		if !ok || len(name) == 0 {
+			return fmt.Errorf("static host %q must be in format <host>=<addresses>", s)
+		}
+
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, addrStr := range strings.Split(addrsStr, ",") {
+			addr, err := netip.ParseAddr(strings.TrimSpace(addrStr))
+			if err != nil {
+				return err
+			}
+
+			dnsHosts[name] = append(dnsHosts[name], addr)
+		}
+
+		return nil
+	})
+	flag.BoolVar(&dnsFreebind, "dns-freebind", false, "Send DNS queries from the network subnet addresses (requires -dns)")
+	flag.IntVar(&dnsCacheSize, "dns-cache-size", 4096, "Max number of cached DNS answers of the -dns resolver\n0 disables cache")
+
+	flag.StringVar(&tlsCertFile, "tls-cert", "", "TLS certificate file (PEM) of the HTTP proxy listener, enables HTTPS proxy\n"+
+		"Certificate is reloaded when the file changes")
+	flag.StringVar(&tlsKeyFile, "tls-key", "", "TLS private key file (PEM) of the HTTP proxy listener")
+	flag.BoolVar(&tlsSelfSigned, "tls-self-signed", false, "Serve HTTP proxy listener over TLS with self-signed certificate generated at startup")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA bundle file (PEM) of the client certificates, enables mutual TLS authentication\n"+
+		"Certificate common name (or the first DNS/email SAN) is the proxy user name, clients without certificate may still use credentials")
 
 	flag.StringVar(&authUser, "auth-user", "", "Authentication user (HTTP basic)")
 	flag.StringVar(&authPass, "auth-pass", "", "Authentication password (HTTP basic)")
+	flag.StringVar(&authFile, "auth-file", "", "Credentials file, one <user>:<bcrypt or argon2id hash>[:<attr>=<value>,...] per line\n"+
+		"Attributes set user policy: prefixes, allow, deny (space separated), max_conns, bandwidth (bytes per second)\n"+
+		"File is reloaded on SIGHUP and when it changes")
+	flag.DurationVar(&authFileCheckInterval, "auth-file-check-interval", 10*time.Second, "How often credentials file is checked for changes\n0 disables checks (SIGHUP still reloads)")
 
 	flag.StringVar(&logLevel, "log-level", "info", "Log level (debug, info, warn, error, fatal)")
 
+	flag.StringVar(&accessLogPath, "access-log", "", "Access log of the HTTP requests and CONNECT tunnels (disabled by default)\n"+
+		"<file> - write to the file, it's reopened on SIGHUP\n"+
+		"stdout, stderr - write to the standard stream\n"+
+		"log - write to the operational log at info level")
+	flag.StringVar(&accessLogFormat, "access-log-format", "json", "Access log format (json, combined)\n"+
+		"json - JSON object per line\n"+
+		"combined - Apache combined log like line with source IP, bytes in and durations appended")
+	flag.Int64Var(&accessLogMaxSize, "access-log-max-size", 100, "Size of the access log file in megabytes after which it's rotated\n0 disables rotation")
+	flag.IntVar(&accessLogMaxBackups, "access-log-max-backups", 5, "Number of rotated access log files to keep")
+
+	flag.DurationVar(&sessionTtl, "session-ttl", 10*time.Minute, "Sticky session TTL, session is passed in the username as <user>-session-<id>\n0 disables sticky sessions")
+	flag.IntVar(&sessionMax, "session-max", proxy.DefaultMaxStickySessions, "Max number of sticky sessions, the oldest session is dropped when limit is reached")
+
+	flag.IntVar(&dialAttempts, "dial-attempts", 1, "Max number of dial attempts, each attempt is made from another source IP\n1 disables retries")
+	flag.DurationVar(&dialBudget, "dial-budget", 30*time.Second, "Total time limit of all dial attempts\n0 disables limit")
+	flag.DurationVar(&dialAttemptTimeout, "dial-attempt-timeout", 10*time.Second, "Time limit of the single dial attempt\n0 disables limit")
+	flag.StringVar(&dialRetryOn, "dial-retry-on", "addr-not-avail,refused,reset,timeout", "Comma separated classes of dial errors which are retried\n"+
+		"(addr-not-avail, refused, reset, timeout, unreachable, other)")
+
+	flag.UintVar(&sockMark, "fwmark", 0, "Firewall mark (SO_MARK) of the outgoing sockets for policy routing\n0 disables marking")
+	flag.StringVar(&sockBindDevice, "bind-device", "", "Bind outgoing sockets to the network interface (SO_BINDTODEVICE), e.g. eth1")
+	flag.DurationVar(&sockKeepAlive, "tcp-keepalive", 0, "TCP keep-alive idle time and probes interval of the outgoing connections\n"+
+		"0 keeps Go default (15s), negative value disables keep-alive")
+	flag.DurationVar(&sockUserTimeout, "tcp-user-timeout", 0, "Max time sent data may stay unacknowledged before outgoing connection is closed (TCP_USER_TIMEOUT)\n0 keeps system default")
+	flag.IntVar(&sockTos, "tos", 0, "IPv4 TOS / IPv6 traffic class of the outgoing packets, e.g. 0x10\n0 keeps system default")
+
 	flag.StringVar(&randSeed, "rand-seed", "", "Random seed for IP address generator (32 bytes)\nDefault: sha256(currentTime)")
+	flag.StringVar(&randMode, "rand-mode", "", "Random IP generator mode (sharded, locked, crypto)\n"+
+		"Default: locked when -rand-seed is set, sharded otherwise\n"+
+		"sharded - per CPU ChaCha8 generators, scales under parallel load, not reproducible even with -rand-seed\n"+
+		"locked - single ChaCha8 generator guarded by mutex, reproducible sequence for the same seed\n"+
+		"crypto - crypto/rand backed generator, seed is ignored")
+
+	flag.StringVar(&allocMode, "alloc-mode", "random", "Source IP allocation mode (random, permutation)\n"+
+		"random - pick uniformly random address from subnet on every request\n"+
+		"permutation - walk the whole subnet in pseudo-random order, every address is used once before any repeats")
+	flag.DurationVar(&allocUsageLogInterval, "alloc-usage-log-interval", 5*time.Minute, "How often per subnet usage is logged when multiple subnets are used\n0 disables usage logging")
+	flag.StringVar(&allocStateFile, "alloc-state-file", "", "File to persist permutation allocator position to, so restart resumes where it stopped\n"+
+		"Requires -rand-seed to be set")
+
+	flag.Func("exclude", "Addresses which must never be used as source IP, comma separated addresses, prefixes or ranges\n"+
+		"e.g. 10.0.0.1,10.0.0.128/25,10.0.0.10-10.0.0.20, can be repeated", ipSetFlag(&excludeAddrs))
+	flag.StringVar(&excludeFile, "exclude-file", "", "File with addresses which must never be used as source IP, one address, prefix or range per line")
+	flag.BoolVar(&excludeReserved, "exclude-reserved", true, "Exclude IPv4 network/broadcast and IPv6 Subnet-Router anycast addresses of the subnet")
 }
 
 func main() {
 	flag.Parse()
 
-	ipNet, err := netip.ParsePrefix(strings.TrimSpace(localNet))
-	if err != nil {
-		log.Fatal("Failed to parse subnet", err)
+	if len(localNets) == 0 {
+		log.Fatal("Subnet is not specified, see -net")
 	}
 
+	var err error
 	var options []proxy.Option
 	var logger *zap.Logger
 
@@ -85,65 +291,385 @@ func main() {
 		}
 	}
 
-	logger.Info("Using subnet", zap.String("subnet", ipNet.String()))
+	fbMode, err := proxy.ParseFreebindMode(freebindMode)
+	if err != nil {
+		logger.Fatal("Failed to parse freebind mode", zap.Error(err))
+	}
+
+	for _, ipNet := range localNets {
+		logger.Info("Using subnet", zap.String("subnet", ipNet.Prefix.String()), zap.Uint("weight", ipNet.Weight))
+	}
 
 	if addSubnetRoute {
-		cmd := exec.Command("ip", "route", "add", "local", ipNet.String(), "dev", localIface)
-
-		logger.Info("Adding ip subnet route", zap.String("cmd", cmd.String()))
-
-		if err := cmd.Run(); err != nil {
-			var exitErr *exec.ExitError
-			if errors.As(err, &exitErr) && exitErr.ExitCode() != 0 {
-				output, err := cmd.Output()
-				var outputStr string
-				if err == nil {
-					outputStr = string(output)
-				}
-
-				logger.Fatal("Failed to add route to network subnet",
-					zap.Int("exitCode", exitErr.ExitCode()),
-					zap.String("output", outputStr),
-				)
+		deleteRoutes, err := addSubnetRoutes(logger)
+		if err != nil {
+			logger.Fatal("Failed to add route to network subnet", zap.Error(err))
+		}
+
+		// Fatal log exits without running deferred functions, so routes are also deleted by the fatal hook
+		deleteRoutes = sync.OnceFunc(deleteRoutes)
+		logger = logger.WithOptions(zap.WithFatalHook(cleanupOnFatal(deleteRoutes)))
+
+		defer deleteRoutes()
+	}
+
+	switch preflightMode {
+	case "fail", "warn":
+		prefixes := make([]netip.Prefix, len(localNets))
+		for i, ipNet := range localNets {
+			prefixes[i] = ipNet.Prefix
+		}
+
+		if err := proxy.Preflight(context.Background(), prefixes, proxy.PreflightConfig{FreebindMode: fbMode}); err != nil {
+			var errs []error
+			if joinErr, ok := err.(interface{ Unwrap() []error }); ok {
+				errs = joinErr.Unwrap()
 			} else {
-				logger.Fatal("Failed to run add route cmd", zap.Error(err))
+				errs = []error{err}
+			}
+
+			for _, err := range errs {
+				logger.Warn("Preflight check failed", zap.Error(err))
+			}
+
+			if preflightMode == "fail" {
+				logger.Fatal("Freebind does not work for the subnet, see failed checks above or run with -preflight warn")
 			}
+		} else {
+			logger.Info("Preflight checks passed")
 		}
+	case "off":
+	default:
+		logger.Fatal("Unknown preflight mode", zap.String("mode", preflightMode))
 	}
 
-	var randReader *rand.Rand
-	{
-		var seed [32]byte
+	var seed [32]byte
+	if len(randSeed) > 0 {
+		copy(seed[:], randSeed)
+	} else {
+		t := time.Now().UnixNano()
+		timeBytes := make([]byte, 8)
+		binary.LittleEndian.PutUint64(timeBytes, uint64(t))
+
+		// Hash the time-derived bytes to ensure a 32-byte seed.
+		seed = sha256.Sum256(timeBytes)
+	}
+
+	if len(randMode) == 0 {
+		// Only single generator produces the same sequence for the same seed
+		randMode = "sharded"
 		if len(randSeed) > 0 {
-			copy(seed[:], randSeed)
-		} else {
-			t := time.Now().UnixNano()
-			timeBytes := make([]byte, 8)
-			binary.LittleEndian.PutUint64(timeBytes, uint64(t))
+			randMode = "locked"
+		}
+	} else if randMode == "sharded" && len(randSeed) > 0 {
+		logger.Fatal("Sharded random IP generator is not reproducible, use -rand-mode=locked with -rand-seed")
+	}
 
-			// Hash the time-derived bytes to ensure a 32-byte seed.
-			seed = sha256.Sum256(timeBytes)
+	var randReader *rand.Rand
+	{
+		var randSrc rand.Source
+		switch randMode {
+		case "sharded":
+			randSrc = utils.NewShardedSource(seed)
+		case "locked":
+			randSrc = utils.NewLockedSource(seed)
+		case "crypto":
+			randSrc = utils.NewCryptoSource()
+		default:
+			logger.Fatal("Unknown random IP generator mode", zap.String("mode", randMode))
 		}
 
-		randSrc := rand.NewChaCha8(seed)
 		randReader = rand.New(randSrc)
 	}
 
-	dialerFactory := proxy.MakeRandIpDialerFactory(randReader, ipNet)
+	if len(excludeFile) > 0 {
+		excluded, err := readExcludeFile(excludeFile)
+		if err != nil {
+			logger.Fatal("Failed to read excluded addresses", zap.String("file", excludeFile), zap.Error(err))
+		}
+
+		excludeAddrs.Union(excluded)
+	}
+
+	if excludeReserved {
+		for _, ipNet := range localNets {
+			excludeAddrs.Union(utils.ReservedAddrs(ipNet.Prefix))
+		}
+	}
+
+	if !excludeAddrs.IsEmpty() {
+		logger.Info("Excluding addresses", zap.Stringer("excluded", &excludeAddrs))
+	}
+
+	if allocMode != "random" && allocMode != "permutation" {
+		logger.Fatal("Unknown source IP allocation mode", zap.String("mode", allocMode))
+	}
+
+	allocs := make([]utils.AddrAllocator, len(localNets))
+	for i, ipNet := range localNets {
+		allocs[i], err = makeSubnetAllocator(ipNet.Prefix, seed, randReader)
+		if err != nil {
+			logger.Fatal("No addresses left in subnet after exclusions",
+				zap.String("subnet", ipNet.Prefix.String()),
+				zap.Error(err),
+			)
+		}
+	}
+
+	var metrics *proxy.Metrics
+	if len(metricsListenAddr) > 0 {
+		metrics = proxy.MakeMetrics()
+
+		options = append(options, proxy.WithMetrics(metrics), proxy.WithMetricsListenAddr(metricsListenAddr))
+	}
+
+	alloc := allocs[0]
+	// Weighted allocator also restricts source prefixes of the user policies
+	if len(localNets) > 1 || len(authFile) > 0 {
+		weightedAlloc, err := utils.NewWeightedAllocator(randReader, localNets, allocs)
+		if err != nil {
+			logger.Fatal("Failed to create weighted allocator", zap.Error(err))
+		}
+
+		if allocUsageLogInterval > 0 && len(localNets) > 1 {
+			stopUsageLogger := startAllocUsageLogger(logger, weightedAlloc, allocUsageLogInterval)
+			defer stopUsageLogger()
+		}
+
+		if metrics != nil {
+			metrics.SetPrefixUsageFunc(weightedAlloc.Usage)
+		}
+
+		alloc = weightedAlloc
+	}
+
+	if allocMode == "permutation" && len(allocStateFile) > 0 {
+		if len(randSeed) == 0 {
+			logger.Warn("Permutation allocator state can't be resumed without -rand-seed")
+		}
+
+		state := alloc.(allocState)
+
+		loadAllocState(logger, state, allocStateFile)
+
+		stopSaver := startAllocStateSaver(logger, state, allocStateFile)
+		defer stopSaver()
+	}
+
+	allocFactory := proxy.MakeAllocIpDialerFactory(alloc)
+	allocFactory.SetFreebindMode(fbMode)
+
+	var dialerFactory proxy.RequestDialerFactoryIface = allocFactory
+
+	if sessionTtl > 0 {
+		logger.Info("Using sticky sessions", zap.Duration("ttl", sessionTtl), zap.Int("max", sessionMax))
+
+		stickyFactory := proxy.MakeStickyDialerFactory(dialerFactory, sessionTtl)
+		stickyFactory.SetMaxSessions(sessionMax)
+
+		dialerFactory = stickyFactory
+	}
 
 	if len(listenAddr) > 0 {
 		options = append(options, proxy.WithListenAddr(listenAddr))
 	}
 
-	if len(authUser) > 0 && len(authPass) > 0 {
+	if len(adminListenAddr) > 0 {
+		if len(adminToken) == 0 {
+			logger.Fatal("-admin-addr requires -admin-token")
+		}
+
+		options = append(options, proxy.WithAdminListenAddr(adminListenAddr), proxy.WithAdminToken(adminToken))
+	}
+
+	if !clientACL.Allow.IsEmpty() || !clientACL.Deny.IsEmpty() || len(clientACL.Identities) > 0 {
+		logger.Info("Using client ACL",
+			zap.Stringer("allow", &clientACL.Allow),
+			zap.Stringer("deny", &clientACL.Deny),
+			zap.Int("identities", len(clientACL.Identities)),
+		)
+
+		options = append(options, proxy.WithClientACL(&clientACL))
+	}
+
+	if ssrfProtection {
+		guard := &proxy.DestinationGuard{
+			Deny:  proxy.DefaultDeniedDestinations(),
+			Allow: ssrfAllow,
+		}
+
+		// Proxy must not connect to its own AnyIP subnets
+		for _, ipNet := range localNets {
+			guard.Deny = append(guard.Deny, proxy.DeniedDestination{
+				Range:  utils.IPRangeFromPrefix(ipNet.Prefix),
+				Reason: "proxy subnet",
+			})
+		}
+
+		logger.Info("Using SSRF protection", zap.Stringer("allow", &ssrfAllow))
+
+		options = append(options, proxy.WithDestinationGuard(guard))
+	} else {
+		logger.Warn("SSRF protection is disabled, clients may connect to local and private addresses")
+	}
+
+	if len(dnsUpstreams) > 0 || len(dnsHosts) > 0 {
+		if dnsFreebind && len(dnsUpstreams) == 0 {
+			logger.Fatal("-dns-freebind requires -dns upstreams")
+		}
+
+		resolver := proxy.MakeDNSResolver(dnsUpstreams...)
+		resolver.Hosts = dnsHosts
+		resolver.CacheSize = dnsCacheSize
+
+		if dnsFreebind {
+			resolver.Dialer = dialerFactory
+		}
+
+		upstreams := make([]string, len(dnsUpstreams))
+		for i, upstream := range dnsUpstreams {
+			upstreams[i] = upstream.String()
+		}
+
+		logger.Info("Using DNS resolver",
+			zap.Strings("upstreams", upstreams),
+			zap.Int("staticHosts", len(dnsHosts)),
+			zap.Bool("freebind", dnsFreebind),
+		)
+
+		options = append(options, proxy.WithResolver(resolver))
+	}
+
+	if len(tlsCertFile) > 0 || len(tlsKeyFile) > 0 || tlsSelfSigned {
+		options = append(options, proxy.WithTLSConfig(makeTLSConfig(logger)))
+	}
+
+	if len(tlsClientCA) > 0 {
+		caPem, err := os.ReadFile(tlsClientCA)
+		if err != nil {
+			logger.Fatal("Failed to read client CA bundle", zap.Error(err))
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPem) {
+			logger.Fatal("No certificates found in client CA bundle", zap.String("file", tlsClientCA))
+		}
+
+		logger.Info("Using client certificate authentication", zap.String("ca", tlsClientCA))
+
+		options = append(options, proxy.WithClientCertAuth(clientCAs, proxy.CertCommonNameIdentity))
+	}
+
+	sockOpts := proxy.SocketOptions{
+		Mark:         uint32(sockMark),
+		BindToDevice: sockBindDevice,
+		KeepAlive:    sockKeepAlive,
+		UserTimeout:  sockUserTimeout,
+		TOS:          sockTos,
+	}
+	if sockOpts != (proxy.SocketOptions{}) {
+		options = append(options, proxy.WithSocketOptions(sockOpts))
+	}
+
+	{
+		retryable, err := proxy.ParseDialErrorClasses(dialRetryOn)
+		if err != nil {
+			logger.Fatal("Failed to parse retryable dial errors", zap.Error(err))
+		}
+
+		if dialAttempts > 1 {
+			logger.Info("Using dial retries",
+				zap.Int("attempts", dialAttempts),
+				zap.Strings("retryOn", strings.Split(dialRetryOn, ",")),
+			)
+		}
+
+		options = append(options, proxy.WithDialRetryPolicy(proxy.DialRetryPolicy{
+			Attempts:       dialAttempts,
+			Budget:         dialBudget,
+			AttemptTimeout: dialAttemptTimeout,
+			Retryable:      retryable,
+		}))
+	}
+
+	if len(socksListenAddr) > 0 {
+		options = append(options, proxy.WithSocksListenAddr(socksListenAddr))
+		options = append(options, proxy.WithSocksUdpIdleTimeout(socksUdpIdleTimeout))
+	}
+
+	var credsFile *proxy.CredentialsFile
+
+	if len(authFile) > 0 {
+		if len(authUser) > 0 || len(authPass) > 0 {
+			logger.Fatal("-auth-file can't be used with -auth-user and -auth-pass")
+		}
+
+		credsFile, err = proxy.LoadCredentialsFile(authFile)
+		if err != nil {
+			logger.Fatal("Failed to load credentials file", zap.Error(err))
+		}
+
+		logger.Info("Using basic authentication with credentials file", zap.String("file", authFile))
+
+		options = append(options, proxy.WithAuthFunc(credsFile.Check), proxy.WithPolicyFunc(credsFile.Policy))
+	} else if len(authUser) > 0 && len(authPass) > 0 {
 		logger.Info("Using basic authentication")
 
 		options = append(options, proxy.WithAuthFunc(func(usr, passwd string) bool {
-			return usr == authUser && passwd == authPass
+			userOk := subtle.ConstantTimeCompare([]byte(usr), []byte(authUser))
+			passOk := subtle.ConstantTimeCompare([]byte(passwd), []byte(authPass))
+
+			return userOk&passOk == 1
 		}))
 	}
 
-	server := proxy.MakeServer(dialerFactory, options...)
+	var destRulesFile *proxy.DestinationRulesFile
+
+	if len(rulesFile) > 0 {
+		destRulesFile, err = proxy.LoadDestinationRulesFile(rulesFile)
+		if err != nil {
+			logger.Fatal("Failed to load rules file", zap.Error(err))
+		}
+
+		logger.Info("Using destination rules file", zap.String("file", rulesFile))
+
+		options = append(options, proxy.WithDestinationCheckFunc(destRulesFile.Check))
+	}
+
+	var accessLogFile *utils.RotatingFile
+
+	if len(accessLogPath) > 0 {
+		format, err := proxy.ParseAccessLogFormat(accessLogFormat)
+		if err != nil {
+			logger.Fatal("Failed to parse access log format", zap.Error(err))
+		}
+
+		var accessLog proxy.AccessLogFunc
+		switch accessLogPath {
+		case "log":
+			accessLog = proxy.ZapAccessLog(logger)
+		case "stdout":
+			accessLog = proxy.MakeAccessLog(os.Stdout, format).Log
+		case "stderr":
+			accessLog = proxy.MakeAccessLog(os.Stderr, format).Log
+		default:
+			accessLogFile, err = utils.OpenRotatingFile(accessLogPath, accessLogMaxSize<<20, accessLogMaxBackups)
+			if err != nil {
+				logger.Fatal("Failed to open access log file", zap.Error(err))
+			}
+			defer accessLogFile.Close()
+
+			accessLog = proxy.MakeAccessLog(accessLogFile, format).Log
+		}
+
+		logger.Info("Using access log", zap.String("output", accessLogPath), zap.String("format", string(format)))
+
+		options = append(options, proxy.WithAccessLog(accessLog))
+	}
+
+	options = append(options, proxy.WithRequestDialerFactory(dialerFactory))
+
+	server := proxy.MakeServer(nil, options...)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -165,6 +691,18 @@ func main() {
 		}
 	}()
 
+	if credsFile != nil {
+		startFileReloader(ctx, logger, "credentials", credsFile, authFileCheckInterval)
+	}
+
+	if destRulesFile != nil {
+		startFileReloader(ctx, logger, "rules", destRulesFile, rulesFileCheckInterval)
+	}
+
+	if accessLogFile != nil {
+		startFileReopener(ctx, logger, "access log", accessLogFile)
+	}
+
 	if err := server.Run(ctx); err != nil {
 		if !errors.Is(err, http.ErrServerClosed) {
 			logger.Fatal("Failed to start/stop server", zap.Error(err))
@@ -173,3 +711,138 @@ func main() {
 
 	logger.Info("Server stopped")
 }
+
+// addSubnetRoutes adds local routes of the subnets, returned function deletes added routes when -del-route is set.
+// Routes added before the failed one are deleted on error
+func addSubnetRoutes(logger *zap.Logger) (func(), error) {
+	var added []*route.LocalRoute
+
+	deleteRoutes := func() {
+		for _, r := range added {
+			if err := route.DeleteLocalRoute(r); err != nil {
+				logger.Error("Failed to delete route to network subnet", zap.Stringer("route", r), zap.Error(err))
+
+				continue
+			}
+
+			logger.Info("Deleted ip subnet route", zap.Stringer("route", r))
+		}
+	}
+
+	for _, ipNet := range localNets {
+		r := &route.LocalRoute{
+			Prefix: ipNet.Prefix,
+			Iface:  localIface,
+			Table:  uint32(routeTable),
+		}
+
+		logger.Info("Adding ip subnet route", zap.Stringer("route", r))
+
+		ok, err := route.AddLocalRoute(r)
+		if err != nil {
+			deleteRoutes()
+
+			return nil, fmt.Errorf("%s: %w", r, err)
+		}
+
+		if !ok {
+			logger.Info("Ip subnet route already exists", zap.Stringer("route", r))
+			continue
+		}
+
+		if delSubnetRoute {
+			added = append(added, r)
+		}
+	}
+
+	return deleteRoutes, nil
+}
+
+// cleanupOnFatal runs cleanup before the process exits on fatal log entry
+type cleanupOnFatal func()
+
+func (f cleanupOnFatal) OnWrite(_ *zapcore.CheckedEntry, _ []zapcore.Field) {
+	f()
+	os.Exit(1)
+}
+
+// makeSubnetAllocator makes allocator of the configured mode which never provides excluded addresses
+func makeSubnetAllocator(ipNet netip.Prefix, seed [32]byte, randReader *rand.Rand) (utils.AddrAllocator, error) {
+	if allocMode == "permutation" {
+		return utils.NewPermutationAllocatorExcluding(seed, ipNet, &excludeAddrs)
+	}
+
+	if excludeAddrs.IsEmpty() {
+		return utils.NewRandomAllocator(randReader, ipNet), nil
+	}
+
+	allowed := &utils.IPSet{}
+	allowed.AddPrefix(ipNet)
+	allowed.Difference(&excludeAddrs)
+
+	return utils.NewRandomSetAllocator(randReader, allowed)
+}
+
+func readExcludeFile(path string) (*utils.IPSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return utils.ReadIPSet(f)
+}
+
+func makeTLSConfig(logger *zap.Logger) *tls.Config {
+	if tlsSelfSigned {
+		if len(tlsCertFile) > 0 || len(tlsKeyFile) > 0 {
+			logger.Fatal("-tls-self-signed can't be used with -tls-cert and -tls-key")
+		}
+
+		hosts := []string{"localhost", "127.0.0.1", "::1"}
+		if hostname, err := os.Hostname(); err == nil {
+			hosts = append(hosts, hostname)
+		}
+
+		cert, err := proxy.GenerateSelfSignedCertificate(hosts...)
+		if err != nil {
+			logger.Fatal("Failed to generate self-signed TLS certificate", zap.Error(err))
+		}
+
+		logger.Info("Using self-signed TLS certificate",
+			zap.Strings("hosts", hosts),
+			zap.String("sha256", proxy.CertificateFingerprint(&cert)),
+		)
+
+		return &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	if len(tlsCertFile) == 0 || len(tlsKeyFile) == 0 {
+		logger.Fatal("Both -tls-cert and -tls-key must be specified")
+	}
+
+	cert, err := proxy.LoadFileCertificate(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		logger.Fatal("Failed to load TLS certificate", zap.Error(err))
+	}
+
+	logger.Info("Using TLS certificate", zap.String("cert", tlsCertFile))
+
+	return &tls.Config{GetCertificate: cert.GetCertificate}
+}
+
+// ipSetFlag parses comma separated addresses, prefixes or ranges into the set
+func ipSetFlag(set *utils.IPSet) func(s string) error {
+	return func(s string) error {
+		for _, entry := range strings.Split(s, ",") {
+			ipRange, err := utils.ParseIPRange(entry)
+			if err != nil {
+				return err
+			}
+
+			set.AddRange(ipRange)
+		}
+
+		return nil
+	}
+}
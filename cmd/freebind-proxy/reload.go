@@ -0,0 +1,75 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"github.com/codercms/freebind-proxy/utils"
+	"go.uber.org/zap"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// reloadableFile is the config file which can be reloaded without restart
+type reloadableFile interface {
+	Reload() error
+	WatchChanges(ctx context.Context, interval time.Duration, logger *zap.Logger)
+}
+
+// startFileReloader reloads file on SIGHUP and when it changes
+func startFileReloader(ctx context.Context, logger *zap.Logger, name string, file reloadableFile, checkInterval time.Duration) {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hupCh)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupCh:
+			}
+
+			if err := file.Reload(); err != nil {
+				logger.Error("Failed to reload "+name+" file", zap.Error(err))
+
+				continue
+			}
+
+			logger.Info("Reloaded " + name + " file on SIGHUP")
+		}
+	}()
+
+	if checkInterval > 0 {
+		go file.WatchChanges(ctx, checkInterval, logger)
+	}
+}
+
+// startFileReopener reopens output file on SIGHUP, so it can be rotated by external tools like logrotate
+func startFileReopener(ctx context.Context, logger *zap.Logger, name string, file *utils.RotatingFile) {
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(hupCh)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hupCh:
+			}
+
+			if err := file.Reopen(); err != nil {
+				logger.Error("Failed to reopen "+name+" file", zap.Error(err))
+
+				continue
+			}
+
+			logger.Info("Reopened " + name + " file on SIGHUP")
+		}
+	}()
+}
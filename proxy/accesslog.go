@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// AccessRecord is the access log record of the plain HTTP request or CONNECT tunnel,
+// tunnel record is made when the tunnel is closed
+type AccessRecord struct {
+	Time      time.Time
+	Client    string
+	User      string
+	Method    string
+	Target    string
+	Proto     string
+	UserAgent string
+	// SourceIP is the source IP of the destination connection, empty when destination wasn't connected
+	SourceIP string
+	Status   int
+	// BytesIn is number of bytes sent from the client to the destination (request body of the plain HTTP request)
+	BytesIn int64
+	// BytesOut is number of bytes sent from the destination to the client (response body of the plain HTTP request)
+	BytesOut int64
+	// DialTime is zero when pooled destination connection was reused
+	DialTime time.Duration
+	Duration time.Duration
+}
+
+// AccessLogFunc is called with every access record, it must be safe for concurrent use
+type AccessLogFunc func(rec *AccessRecord)
+
+// AccessLogFormat is the line format of the [AccessLog]
+type AccessLogFormat string
+
+const (
+	// AccessLogJSON writes JSON object per line
+	AccessLogJSON AccessLogFormat = "json"
+	// AccessLogCombined writes Apache combined log like line followed by key=value fields
+	AccessLogCombined AccessLogFormat = "combined"
+)
+
+// ParseAccessLogFormat parses access log format name
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch format := AccessLogFormat(s); format {
+	case AccessLogJSON, AccessLogCombined:
+		return format, nil
+	default:
+		return "", fmt.Errorf("unknown access log format %q", s)
+	}
+}
+
+// AccessLog writes access records to the writer, one record per line
+type AccessLog struct {
+	format AccessLogFormat
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// MakeAccessLog makes access log of the format, e.g. with [utils.RotatingFile] writer
+func MakeAccessLog(w io.Writer, format AccessLogFormat) *AccessLog {
+	return &AccessLog{w: w, format: format}
+}
+
+// accessRecordJSON is the JSON line of the access record, durations are in seconds
+type accessRecordJSON struct {
+	Time      string  `json:"time"`
+	Client    string  `json:"client"`
+	User      string  `json:"user,omitempty"`
+	Method    string  `json:"method"`
+	Target    string  `json:"target"`
+	Proto     string  `json:"proto"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	SourceIP  string  `json:"source_ip,omitempty"`
+	Status    int     `json:"status"`
+	BytesIn   int64   `json:"bytes_in"`
+	BytesOut  int64   `json:"bytes_out"`
+	DialTime  float64 `json:"dial_time"`
+	Duration  float64 `json:"duration"`
+}
+
+// formatLine formats record as a line of the log format
+func (l *AccessLog) formatLine(rec *AccessRecord) []byte {
+	if l.format == AccessLogCombined {
+		return []byte(fmt.Sprintf("%s - %s [%s] %q %d %d \"-\" %q in=%d src=%s dial=%s duration=%s\n",
+			rec.Client,
+			logToken(rec.User),
+			rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			rec.Method+" "+rec.Target+" "+rec.Proto,
+			rec.Status,
+			rec.BytesOut,
+			rec.UserAgent,
+			rec.BytesIn,
+			orDash(rec.SourceIP),
+			strconv.FormatFloat(rec.DialTime.Seconds(), 'f', 3, 64),
+			strconv.FormatFloat(rec.Duration.Seconds(), 'f', 3, 64),
+		))
+	}
+
+	line, _ := json.Marshal(&accessRecordJSON{
+		Time:      rec.Time.Format(time.RFC3339Nano),
+		Client:    rec.Client,
+		User:      rec.User,
+		Method:    rec.Method,
+		Target:    rec.Target,
+		Proto:     rec.Proto,
+		UserAgent: rec.UserAgent,
+		SourceIP:  rec.SourceIP,
+		Status:    rec.Status,
+		BytesIn:   rec.BytesIn,
+		BytesOut:  rec.BytesOut,
+		DialTime:  rec.DialTime.Seconds(),
+		Duration:  rec.Duration.Seconds(),
+	})
+
+	return append(line, '\n')
+}
+
+// logToken returns the value as a single field of the combined line, values which could break the line
+// or forge other fields (spaces, quotes, control characters) are quoted
+func logToken(s string) string {
+	unsafe := strings.ContainsFunc(s, func(r rune) bool {
+		return r == ' ' || r == '"' || r == '\\' || !strconv.IsPrint(r)
+	})
+	if unsafe || !utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+
+	return orDash(s)
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+
+	return s
+}
+
+// Log writes the record, write errors are ignored
+func (l *AccessLog) Log(rec *AccessRecord) {
+	line := l.formatLine(rec)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, _ = l.w.Write(line)
+}
+
+// ZapAccessLog logs access records to the operational log at info level
+func ZapAccessLog(logger *zap.Logger) AccessLogFunc {
+	return func(rec *AccessRecord) {
+		logger.Info("Access",
+			zap.String("client", rec.Client),
+			zap.String("user", rec.User),
+			zap.String("method", rec.Method),
+			zap.String("target", rec.Target),
+			zap.String("proto", rec.Proto),
+			zap.String("userAgent", rec.UserAgent),
+			zap.String("sourceIp", rec.SourceIP),
+			zap.Int("status", rec.Status),
+			zap.Int64("bytesIn", rec.BytesIn),
+			zap.Int64("bytesOut", rec.BytesOut),
+			zap.Duration("dialTime", rec.DialTime),
+			zap.Duration("duration", rec.Duration),
+		)
+	}
+}
+
+// accessTracker collects access record of the request, nil tracker collects nothing
+type accessTracker struct {
+	rec AccessRecord
+
+	// Dial and copying may happen outside of the handler goroutine
+	dialTime atomic.Int64
+	bytes    byteCounters
+}
+
+type ctxAccessTrackerKeyType struct{}
+
+var ctxAccessTrackerKey ctxAccessTrackerKeyType
+
+func setCtxAccessTracker(ctx context.Context, t *accessTracker) context.Context {
+	return context.WithValue(ctx, ctxAccessTrackerKey, t)
+}
+
+// getCtxAccessTracker returns tracker of the request, nil when access log is disabled
+func getCtxAccessTracker(ctx context.Context) *accessTracker {
+	t, _ := ctx.Value(ctxAccessTrackerKey).(*accessTracker)
+
+	return t
+}
+
+// setUser sets user of the record from the request context
+func (t *accessTracker) setUser(ctx context.Context) {
+	if t == nil {
+		return
+	}
+
+	if usr, ok := ProxyUserFromContext(ctx); ok {
+		t.rec.User = usr.Name
+	}
+}
+
+func (t *accessTracker) setStatus(status int) {
+	if t == nil {
+		return
+	}
+
+	t.rec.Status = status
+}
+
+func (t *accessTracker) dialed(d time.Duration) {
+	if t == nil {
+		return
+	}
+
+	t.dialTime.Store(int64(d))
+}
+
+// connected sets source IP of the destination connection
+func (t *accessTracker) connected(conn net.Conn) {
+	if t == nil {
+		return
+	}
+
+	t.rec.SourceIP = connSourceIP(conn)
+}
+
+// counters returns counters of the transferred bytes, nil tracker has no counters
+func (t *accessTracker) counters() *byteCounters {
+	if t == nil {
+		return nil
+	}
+
+	return &t.bytes
+}
+
+func (t *accessTracker) record() AccessRecord {
+	rec := t.rec
+	rec.DialTime = time.Duration(t.dialTime.Load())
+	rec.BytesIn = t.bytes.in.Load()
+	rec.BytesOut = t.bytes.out.Load()
+	rec.Duration = time.Since(rec.Time)
+
+	return rec
+}
+
+// accessLogResponseWriter records response status
+type accessLogResponseWriter struct {
+	http.ResponseWriter
+	tracker *accessTracker
+}
+
+func (w *accessLogResponseWriter) WriteHeader(status int) {
+	if w.tracker.rec.Status == 0 {
+		w.tracker.rec.Status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogResponseWriter) Write(p []byte) (int, error) {
+	if w.tracker.rec.Status == 0 {
+		w.tracker.rec.Status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *accessLogResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	return hijacker.Hijack()
+}
+
+func (w *accessLogResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// makeAccessLogMiddleware logs access record of every request when access log is enabled,
+// CONNECT request is logged when its tunnel is closed
+func (s *Server) makeAccessLogMiddleware(next http.Handler) http.Handler {
+	if s.accessLogFunc == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.Host
+		if r.Method != http.MethodConnect {
+			target = r.URL.String()
+		}
+
+		tracker := &accessTracker{rec: AccessRecord{
+			Time:      time.Now(),
+			Client:    r.RemoteAddr,
+			Method:    r.Method,
+			Target:    target,
+			Proto:     r.Proto,
+			UserAgent: r.UserAgent(),
+		}}
+
+		next.ServeHTTP(&accessLogResponseWriter{ResponseWriter: w, tracker: tracker}, r.WithContext(setCtxAccessTracker(r.Context(), tracker)))
+
+		rec := tracker.record()
+		s.accessLogFunc(&rec)
+	})
+}
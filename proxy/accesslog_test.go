@@ -0,0 +1,212 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	rec := &AccessRecord{
+		Time:      time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC),
+		Client:    "192.0.2.1:50000",
+		User:      "alice",
+		Method:    http.MethodConnect,
+		Target:    "example.com:443",
+		Proto:     "HTTP/1.1",
+		UserAgent: "curl/8.0",
+		SourceIP:  "2001:db8::5",
+		Status:    http.StatusOK,
+		BytesIn:   100,
+		BytesOut:  2000,
+		DialTime:  12 * time.Millisecond,
+		Duration:  1500 * time.Millisecond,
+	}
+
+	var sb strings.Builder
+	MakeAccessLog(&sb, AccessLogCombined).Log(rec)
+
+	wantLine := `192.0.2.1:50000 - alice [01/Mar/2024:12:30:00 +0000] "CONNECT example.com:443 HTTP/1.1" 200 2000 "-" "curl/8.0" ` +
+		"in=100 src=2001:db8::5 dial=0.012 duration=1.500\n"
+	if sb.String() != wantLine {
+		t.Errorf("Combined line got = %q, want %q", sb.String(), wantLine)
+	}
+
+	// User name can't forge other fields or lines
+	forged := *rec
+	forged.User = "eve\n10.0.0.1 - admin"
+
+	sb.Reset()
+	MakeAccessLog(&sb, AccessLogCombined).Log(&forged)
+
+	wantLine = `192.0.2.1:50000 - "eve\n10.0.0.1 - admin" [01/Mar/2024:12:30:00 +0000] "CONNECT example.com:443 HTTP/1.1" 200 2000 "-" "curl/8.0" ` +
+		"in=100 src=2001:db8::5 dial=0.012 duration=1.500\n"
+	if sb.String() != wantLine {
+		t.Errorf("Combined line of the forged user got = %q, want %q", sb.String(), wantLine)
+	}
+
+	sb.Reset()
+	MakeAccessLog(&sb, AccessLogJSON).Log(rec)
+
+	var got map[string]any
+	if err := json.Unmarshal([]byte(sb.String()), &got); err != nil {
+		t.Fatalf("Failed to decode JSON line %q: %v", sb.String(), err)
+	}
+
+	for key, want := range map[string]any{
+		"time":      "2024-03-01T12:30:00Z",
+		"user":      "alice",
+		"target":    "example.com:443",
+		"source_ip": "2001:db8::5",
+		"status":    float64(200),
+		"bytes_in":  float64(100),
+		"bytes_out": float64(2000),
+		"dial_time": 0.012,
+		"duration":  1.5,
+	} {
+		if got[key] != want {
+			t.Errorf("JSON field %s got = %v, want %v", key, got[key], want)
+		}
+	}
+
+	if _, err := ParseAccessLogFormat("xml"); err == nil {
+		t.Errorf("ParseAccessLogFormat() of unknown format must fail")
+	}
+}
+
+func TestServerAccessLog(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = io.WriteString(w, "got "+string(body))
+	}))
+	defer backend.Close()
+
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	records := make(chan AccessRecord, 10)
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil),
+		WithListenAddr("127.0.0.1:0"),
+		WithAuthFunc(func(usr, passwd string) bool {
+			return usr == "user" && passwd == "pass"
+		}),
+		WithAccessLog(func(rec *AccessRecord) {
+			records <- *rec
+		}),
+	)
+
+	proxyAddr := startTestServer(t, srv)["http"]
+
+	nextRecord := func() AccessRecord {
+		select {
+		case rec := <-records:
+			return rec
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Access record is not logged")
+			return AccessRecord{}
+		}
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		Proxy: http.ProxyURL(&url.URL{Scheme: "http", User: url.UserPassword("user", "pass"), Host: proxyAddr}),
+	}}
+
+	resp, err := client.Post(backend.URL+"/upload", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("Failed to perform request: %v", err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	rec := nextRecord()
+	if rec.Method != http.MethodPost || rec.Target != backend.URL+"/upload" || rec.User != "user" || rec.Status != http.StatusOK {
+		t.Errorf("HTTP record got = %+v", rec)
+	}
+
+	if rec.BytesIn != 5 || rec.BytesOut != 9 {
+		t.Errorf("HTTP record bytes got = %d/%d, want 5/9", rec.BytesIn, rec.BytesOut)
+	}
+
+	if rec.SourceIP != "127.0.0.1" || rec.DialTime <= 0 {
+		t.Errorf("HTTP record source IP got = %q, dial time = %v", rec.SourceIP, rec.DialTime)
+	}
+
+	// Tunnel is logged when it's closed
+	conn, err := net.Dial("tcp4", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+
+	auth := base64.StdEncoding.EncodeToString([]byte("user:pass"))
+	_, _ = io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n"+
+		"Proxy-Authorization: Basic "+auth+"\r\n\r\n")
+
+	br := bufio.NewReader(conn)
+	connectResp, err := http.ReadResponse(br, nil)
+	if err != nil || connectResp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v, %v", connectResp, err)
+	}
+
+	_, _ = io.WriteString(conn, "ping!")
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		t.Fatalf("Failed to read from tunnel: %v", err)
+	}
+
+	select {
+	case rec := <-records:
+		t.Fatalf("Tunnel is logged before close: %+v", rec)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_ = conn.Close()
+
+	rec = nextRecord()
+	if rec.Method != http.MethodConnect || rec.Target != echo.Addr().String() || rec.Status != http.StatusOK {
+		t.Errorf("CONNECT record got = %+v", rec)
+	}
+
+	if rec.BytesIn != 5 || rec.BytesOut != 5 || rec.SourceIP != "127.0.0.1" {
+		t.Errorf("CONNECT record bytes got = %d/%d, source IP = %q", rec.BytesIn, rec.BytesOut, rec.SourceIP)
+	}
+
+	// Rejected credentials are logged without user
+	conn, err = net.Dial("tcp4", proxyAddr)
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	_, _ = io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n\r\n")
+
+	rec = nextRecord()
+	if rec.Status != http.StatusProxyAuthRequired || rec.User != "" || rec.SourceIP != "" {
+		t.Errorf("Rejected record got = %+v", rec)
+	}
+}
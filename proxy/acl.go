@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/codercms/freebind-proxy/utils"
+	"go.uber.org/zap"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClientIdentity is the implicit proxy user of clients connecting from the prefix,
+// such clients are authenticated without credentials
+type ClientIdentity struct {
+	Prefix netip.Prefix
+	User   string
+}
+
+// ParseClientIdentity parses identity in format "<prefix>=<user>"
+func ParseClientIdentity(s string) (ClientIdentity, error) {
+	prefixStr, usr, ok := strings.Cut(strings.TrimSpace(s), "=")
+	if !ok || len(strings.TrimSpace(usr)) == 0 {
+		return ClientIdentity{}, fmt.Errorf("client identity %q must be in format <prefix>=<user>", s)
+	}
+
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(prefixStr))
+	if err != nil {
+		return ClientIdentity{}, err
+	}
+
+	return ClientIdentity{Prefix: prefix.Masked(), User: strings.TrimSpace(usr)}, nil
+}
+
+// ClientACL restricts which clients may use the proxy by their source address
+type ClientACL struct {
+	// Allow are client addresses which may use the proxy, empty set allows any client
+	Allow utils.IPSet
+	// Deny are client addresses which must not use the proxy, they take precedence over Allow
+	Deny utils.IPSet
+	// Identities are implicit users of the client prefixes, the most specific prefix wins
+	Identities []ClientIdentity
+}
+
+// Check reports whether client may use the proxy and returns implicit user of the client (if any)
+func (a *ClientACL) Check(addr netip.Addr) (bool, *ProxyUser) {
+	addr = addr.Unmap()
+
+	if a.Deny.Contains(addr) || (!a.Allow.IsEmpty() && !a.Allow.Contains(addr)) {
+		return false, nil
+	}
+
+	var identity *ClientIdentity
+	for i := range a.Identities {
+		id := &a.Identities[i]
+		if id.Prefix.Contains(addr) && (identity == nil || id.Prefix.Bits() > identity.Prefix.Bits()) {
+			identity = id
+		}
+	}
+
+	if identity == nil {
+		return true, nil
+	}
+
+	return true, &ProxyUser{Name: identity.User}
+}
+
+// remoteAddrIP returns IP of the remote address in host:port format
+func remoteAddrIP(remote string) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addrPort.Addr(), true
+}
+
+// checkClient checks client against ACL (if any), rejected clients are logged
+func (s *Server) checkClient(remote string) (bool, *ProxyUser) {
+	if s.clientACL == nil {
+		return true, nil
+	}
+
+	addr, ok := remoteAddrIP(remote)
+	if !ok {
+		return false, nil
+	}
+
+	allowed, usr := s.clientACL.Check(addr)
+	if !allowed {
+		s.rejectLog.warn(s.logger, "Client rejected by ACL", zap.String("remote", remote))
+	}
+
+	return allowed, usr
+}
+
+// makeClientACLMiddleware rejects requests of clients not allowed by ACL (see [ClientACL]),
+// implicit user of the client is stored in the request context, so auth middleware accepts it without credentials
+func (s *Server) makeClientACLMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, usr := s.checkClient(r.RemoteAddr)
+		if !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+
+			return
+		}
+
+		if usr != nil {
+			r = r.WithContext(setCtxProxyUser(r.Context(), usr))
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitedLog logs at most one message per interval, number of suppressed messages is reported with the next one,
+// so floods of rejected clients don't flood the log
+type rateLimitedLog struct {
+	interval time.Duration
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func (l *rateLimitedLog) warn(logger *zap.Logger, msg string, fields ...zap.Field) {
+	l.mu.Lock()
+
+	now := time.Now()
+	if now.Sub(l.last) < l.interval {
+		l.suppressed++
+		l.mu.Unlock()
+
+		return
+	}
+
+	suppressed := l.suppressed
+	l.last = now
+	l.suppressed = 0
+
+	l.mu.Unlock()
+
+	if suppressed > 0 {
+		fields = append(fields, zap.Int("suppressed", suppressed))
+	}
+
+	logger.Warn(msg, fields...)
+}
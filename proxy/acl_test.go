@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientACLCheck(t *testing.T) {
+	acl := &ClientACL{
+		Identities: []ClientIdentity{
+			{netip.MustParsePrefix("10.0.0.0/8"), "office"},
+			{netip.MustParsePrefix("10.1.0.0/16"), "ci"},
+		},
+	}
+	acl.Allow.AddPrefix(netip.MustParsePrefix("10.0.0.0/8"))
+	acl.Allow.AddPrefix(netip.MustParsePrefix("192.168.0.0/16"))
+	acl.Deny.AddPrefix(netip.MustParsePrefix("10.2.0.0/16"))
+
+	tests := []struct {
+		addr        string
+		wantAllowed bool
+		wantUser    string
+	}{
+		{"10.0.0.1", true, "office"},
+		{"10.1.2.3", true, "ci"},
+		{"::ffff:10.1.2.3", true, "ci"},
+		{"10.2.0.1", false, ""},
+		{"192.168.1.1", true, ""},
+		{"172.16.0.1", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			allowed, usr := acl.Check(netip.MustParseAddr(tt.addr))
+			if allowed != tt.wantAllowed {
+				t.Errorf("Check() allowed got = %v, want %v", allowed, tt.wantAllowed)
+			}
+
+			var gotUser string
+			if usr != nil {
+				gotUser = usr.Name
+			}
+
+			if gotUser != tt.wantUser {
+				t.Errorf("Check() user got = %q, want %q", gotUser, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestClientACLMiddleware(t *testing.T) {
+	acl := &ClientACL{
+		Identities: []ClientIdentity{{netip.MustParsePrefix("10.1.0.0/16"), "ci"}},
+	}
+	acl.Deny.AddPrefix(netip.MustParsePrefix("10.2.0.0/16"))
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil),
+		WithClientACL(acl),
+		WithAuthFunc(func(usr, passwd string) bool {
+			return false
+		}),
+	)
+
+	var gotUser string
+	handler := srv.makeClientACLMiddleware(MakeProxyAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if usr, ok := ProxyUserFromContext(r.Context()); ok {
+			gotUser = usr.Name
+		}
+	}), srv.authFunc))
+
+	tests := []struct {
+		remote   string
+		wantCode int
+		wantUser string
+	}{
+		{"10.1.0.5:1234", http.StatusOK, "ci"},
+		{"10.2.0.5:1234", http.StatusForbidden, ""},
+		{"10.3.0.5:1234", http.StatusProxyAuthRequired, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remote, func(t *testing.T) {
+			gotUser = ""
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.RemoteAddr = tt.remote
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Status got = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if gotUser != tt.wantUser {
+				t.Errorf("User got = %q, want %q", gotUser, tt.wantUser)
+			}
+		})
+	}
+}
+
+func TestRateLimitedLog(t *testing.T) {
+	l := &rateLimitedLog{interval: time.Hour}
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil))
+	for i := 0; i < 5; i++ {
+		l.warn(srv.logger, "test")
+	}
+
+	if l.suppressed != 4 {
+		t.Errorf("Suppressed messages got = %d, want 4", l.suppressed)
+	}
+}
+
+func TestClientACLIdentityUncheckedCredentials(t *testing.T) {
+	acl := &ClientACL{
+		Identities: []ClientIdentity{{netip.MustParsePrefix("10.1.0.0/16"), "ci"}},
+	}
+
+	// Credentials are not checked, so client must not be able to claim other identity
+	srv := MakeServer(MakeNoIpDialerFactory(nil), WithClientACL(acl))
+
+	var gotUser *ProxyUser
+	handler := srv.makeClientACLMiddleware(MakeProxyAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUser, _ = ProxyUserFromContext(r.Context())
+	}), srv.authFunc))
+
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.RemoteAddr = "10.1.0.5:1234"
+	r.SetBasicAuth("admin-session-abc", "any")
+	r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if gotUser == nil || gotUser.Name != "ci" || gotUser.Session() != "abc" {
+		t.Errorf("HTTP user got = %+v, want ci with session abc", gotUser)
+	}
+
+	clientConn, srvConn := net.Pipe()
+	defer clientConn.Close()
+	defer srvConn.Close()
+
+	go func() {
+		_, _ = clientConn.Write([]byte{socks5Version, 1, socks5AuthUserPass})
+		_, _ = io.ReadFull(clientConn, make([]byte, 2))
+		_, _ = clientConn.Write(append([]byte{socks5UserPassVersion, 17}, "admin-session-abc\x03any"...))
+		_, _ = io.ReadFull(clientConn, make([]byte, 2))
+	}()
+
+	usr, err := srv.socksNegotiateAuth(srvConn, &ProxyUser{Name: "ci"})
+	if err != nil {
+		t.Fatalf("socksNegotiateAuth() error = %v", err)
+	}
+
+	if usr.Name != "ci" || usr.Session() != "abc" {
+		t.Errorf("SOCKS5 user got = %+v, want ci with session abc", usr)
+	}
+}
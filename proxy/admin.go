@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminConnJSON is the active connection in the admin API responses, age is in seconds
+type adminConnJSON struct {
+	ID       uint64  `json:"id"`
+	Protocol string  `json:"protocol"`
+	User     string  `json:"user,omitempty"`
+	Client   string  `json:"client"`
+	Target   string  `json:"target"`
+	SourceIP string  `json:"source_ip,omitempty"`
+	Started  string  `json:"started"`
+	Age      float64 `json:"age"`
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+}
+
+// adminAPI serves the admin API of the connections registry
+type adminAPI struct {
+	registry *ConnRegistry
+	token    string
+	logger   *zap.Logger
+}
+
+// MakeAdminHandler makes handler of the admin API, every request must carry "Authorization: Bearer <token>" header
+//
+//	GET /connections[?user=<user>&source_ip=<ip>] lists active connections
+//	DELETE /connections/{id} terminates the connection
+//	DELETE /connections?user=<user> or ?source_ip=<ip> terminates all connections of the user or source IP
+func MakeAdminHandler(registry *ConnRegistry, token string, logger *zap.Logger) http.Handler {
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	api := &adminAPI{registry: registry, token: token, logger: logger}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /connections", api.handleList)
+	mux.HandleFunc("DELETE /connections", api.handleKillMatching)
+	mux.HandleFunc("DELETE /connections/{id}", api.handleKill)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !api.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+
+			return
+		}
+
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (api *adminAPI) authorized(r *http.Request) bool {
+	const prefix = "Bearer "
+
+	auth := r.Header.Get("Authorization")
+	if len(api.token) == 0 || !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(api.token)) == 1
+}
+
+// connFilter parses user and source_ip query filters, nil filter matches all connections
+func connFilter(r *http.Request) (func(info *ConnInfo) bool, error) {
+	query := r.URL.Query()
+
+	user, hasUser := query.Get("user"), query.Has("user")
+
+	var sourceIP netip.Addr
+	hasSourceIP := query.Has("source_ip")
+	if hasSourceIP {
+		var err error
+		if sourceIP, err = netip.ParseAddr(query.Get("source_ip")); err != nil {
+			return nil, err
+		}
+
+		sourceIP = sourceIP.Unmap()
+	}
+
+	if !hasUser && !hasSourceIP {
+		return nil, nil
+	}
+
+	return func(info *ConnInfo) bool {
+		if hasUser && info.User != user {
+			return false
+		}
+
+		if hasSourceIP {
+			addr, err := netip.ParseAddr(info.SourceIP)
+			if err != nil || addr.Unmap() != sourceIP {
+				return false
+			}
+		}
+
+		return true
+	}, nil
+}
+
+func writeAdminJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func (api *adminAPI) handleList(w http.ResponseWriter, r *http.Request) {
+	filter, err := connFilter(r)
+	if err != nil {
+		http.Error(w, "Bad source_ip: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	now := time.Now()
+
+	conns := make([]adminConnJSON, 0)
+	for _, info := range api.registry.List() {
+		if filter != nil && !filter(&info) {
+			continue
+		}
+
+		conns = append(conns, adminConnJSON{
+			ID:       info.ID,
+			Protocol: info.Protocol.String(),
+			User:     info.User,
+			Client:   info.Client,
+			Target:   info.Target,
+			SourceIP: info.SourceIP,
+			Started:  info.Started.Format(time.RFC3339),
+			Age:      now.Sub(info.Started).Seconds(),
+			BytesIn:  info.BytesIn,
+			BytesOut: info.BytesOut,
+		})
+	}
+
+	writeAdminJSON(w, conns)
+}
+
+func (api *adminAPI) handleKill(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad connection ID", http.StatusBadRequest)
+
+		return
+	}
+
+	if !api.registry.Kill(id) {
+		http.Error(w, "Connection not found", http.StatusNotFound)
+
+		return
+	}
+
+	api.logger.Info("Killed connection via admin API", zap.Uint64("id", id), zap.String("remote", r.RemoteAddr))
+
+	writeAdminJSON(w, map[string]int{"killed": 1})
+}
+
+func (api *adminAPI) handleKillMatching(w http.ResponseWriter, r *http.Request) {
+	filter, err := connFilter(r)
+	if err != nil {
+		http.Error(w, "Bad source_ip: "+err.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	// Killing everything must not happen by mistake
+	if filter == nil {
+		http.Error(w, "user or source_ip filter is required", http.StatusBadRequest)
+
+		return
+	}
+
+	killed := api.registry.killWhere(filter)
+
+	api.logger.Info("Killed connections via admin API",
+		zap.String("query", r.URL.RawQuery),
+		zap.Int("killed", killed),
+		zap.String("remote", r.RemoteAddr),
+	)
+
+	writeAdminJSON(w, map[string]int{"killed": killed})
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestServerAdminAPI(t *testing.T) {
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil),
+		WithListenAddr("127.0.0.1:0"),
+		WithAdminListenAddr("127.0.0.1:0"),
+		WithAdminToken("secret"),
+		WithAuthFunc(func(usr, passwd string) bool {
+			return passwd == "pass"
+		}),
+	)
+
+	addrs := startTestServer(t, srv)
+	proxyAddr, adminAddr := addrs["http"], addrs["admin"]
+
+	connect := func(user string) net.Conn {
+		conn, err := net.Dial("tcp4", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":pass"))
+		_, _ = io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n"+
+			"Proxy-Authorization: Basic "+auth+"\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT failed: %v, %v", resp, err)
+		}
+
+		return conn
+	}
+
+	adminRequest := func(method, path, token string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, "http://"+adminAddr+path, nil)
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Admin request failed: %v", err)
+		}
+		defer resp.Body.Close()
+
+		body, _ := io.ReadAll(resp.Body)
+
+		return resp, body
+	}
+
+	list := func(path string) []adminConnJSON {
+		resp, body := adminRequest(http.MethodGet, path, "secret")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("List status got = %d, body = %s", resp.StatusCode, body)
+		}
+
+		var conns []adminConnJSON
+		if err := json.Unmarshal(body, &conns); err != nil {
+			t.Fatalf("Failed to decode %s: %v", body, err)
+		}
+
+		return conns
+	}
+
+	aliceConn1 := connect("alice")
+	defer aliceConn1.Close()
+	aliceConn2 := connect("alice")
+	defer aliceConn2.Close()
+	bobConn := connect("bob")
+	defer bobConn.Close()
+
+	if _, err := io.WriteString(bobConn, "ping"); err != nil {
+		t.Fatalf("Failed to write to tunnel: %v", err)
+	}
+	if _, err := io.ReadFull(bobConn, make([]byte, 4)); err != nil {
+		t.Fatalf("Failed to read from tunnel: %v", err)
+	}
+
+	if resp, _ := adminRequest(http.MethodGet, "/connections", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Status of wrong token got = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+
+	// Tunnel is registered before the client gets 200
+	conns := list("/connections")
+	if len(conns) != 3 {
+		t.Fatalf("Listed connections got = %+v, want 3", conns)
+	}
+
+	bobConns := list("/connections?user=bob")
+	if len(bobConns) != 1 {
+		t.Fatalf("Listed connections of bob got = %+v, want 1", bobConns)
+	}
+
+	bob := bobConns[0]
+	if bob.Protocol != "connect" || bob.Target != echo.Addr().String() || bob.SourceIP != "127.0.0.1" || bob.BytesIn != 4 || bob.BytesOut != 4 {
+		t.Errorf("Connection of bob got = %+v", bob)
+	}
+
+	if resp, _ := adminRequest(http.MethodDelete, "/connections", "secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Status of kill without filter got = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+
+	aliceConns := list("/connections?user=alice")
+	if len(aliceConns) != 2 {
+		t.Fatalf("Listed connections of alice got = %+v, want 2", aliceConns)
+	}
+
+	if resp, body := adminRequest(http.MethodDelete, "/connections/"+strconv.FormatUint(aliceConns[0].ID, 10), "secret"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("Status of kill got = %d, body = %s", resp.StatusCode, body)
+	}
+
+	if resp, _ := adminRequest(http.MethodDelete, "/connections/"+strconv.FormatUint(aliceConns[0].ID+100, 10), "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Status of unknown connection kill got = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	resp, body := adminRequest(http.MethodDelete, "/connections?source_ip=127.0.0.1", "secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Status of kill by source IP got = %d, body = %s", resp.StatusCode, body)
+	}
+
+	// Killed tunnels are closed
+	for _, conn := range []net.Conn{aliceConn1, aliceConn2, bobConn} {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		_, err := conn.Read(make([]byte, 1))
+		if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+			t.Errorf("Killed tunnel is still open, read error = %v", err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		if conns = list("/connections"); len(conns) == 0 {
+			break
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(conns) != 0 {
+		t.Errorf("Killed connections are still listed: %+v", conns)
+	}
+}
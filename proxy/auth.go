@@ -1,46 +1,211 @@
 package proxy
 
 import (
+	"context"
+	"crypto/x509"
 	"encoding/base64"
 	"net/http"
 	"strings"
 )
 
+// UsernameParamSession is the username parameter which pins egress IP to the session,
+// e.g. "user-session-abc123"
+const UsernameParamSession = "session"
+
+// knownUsernameParams is a set of parameters which can be passed in the proxy username
+var knownUsernameParams = map[string]struct{}{
+	UsernameParamSession: {},
+}
+
+// ProxyUser is a proxy username split into the base user name and parameters
+type ProxyUser struct {
+	Name   string
+	Params map[string]string
+
+	// unverified is set when name comes from the unchecked credentials, such name must not choose user policy
+	unverified bool
+}
+
+// Session returns session token passed in the username (if any)
+func (u *ProxyUser) Session() string {
+	return u.Params[UsernameParamSession]
+}
+
+// ParseProxyUser splits username in format "<user>[-<param>-<value>]..." into the base user and parameters.
+// Only known parameters are recognized, so user names containing dashes are kept intact,
+// parameter values must not contain dashes.
+func ParseProxyUser(username string) ProxyUser {
+	parts := strings.Split(username, "-")
+
+	for i := 1; i < len(parts); i++ {
+		if (len(parts)-i)%2 != 0 {
+			continue
+		}
+
+		params := make(map[string]string, (len(parts)-i)/2)
+		for j := i; j < len(parts); j += 2 {
+			if _, ok := knownUsernameParams[parts[j]]; !ok || len(parts[j+1]) == 0 {
+				params = nil
+				break
+			}
+
+			params[parts[j]] = parts[j+1]
+		}
+
+		if params != nil {
+			return ProxyUser{
+				Name:   strings.Join(parts[:i], "-"),
+				Params: params,
+			}
+		}
+	}
+
+	return ProxyUser{Name: username}
+}
+
+type ctxProxyUserKeyType struct{}
+
+var ctxProxyUserKey ctxProxyUserKeyType
+
+func setCtxProxyUser(ctx context.Context, usr *ProxyUser) context.Context {
+	return context.WithValue(ctx, ctxProxyUserKey, usr)
+}
+
+// ProxyUserFromContext returns proxy user which sent the request
+func ProxyUserFromContext(ctx context.Context) (*ProxyUser, bool) {
+	usr, ok := ctx.Value(ctxProxyUserKey).(*ProxyUser)
+
+	return usr, ok
+}
+
+// CertIdentityFunc maps verified client certificate to the proxy user name, false rejects the certificate
+type CertIdentityFunc func(cert *x509.Certificate) (string, bool)
+
+// CertCommonNameIdentity uses certificate subject common name as the user name,
+// when it's empty the first DNS or email SAN is used
+func CertCommonNameIdentity(cert *x509.Certificate) (string, bool) {
+	switch {
+	case len(cert.Subject.CommonName) > 0:
+		return cert.Subject.CommonName, true
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0], true
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0], true
+	default:
+		return "", false
+	}
+}
+
+// MakeProxyAuthMiddleware checks proxy credentials with checkFunc (base user name without parameters is checked)
+// and stores parsed proxy user in the request context, when checkFunc is nil credentials are optional and not checked
 func MakeProxyAuthMiddleware(next http.Handler, checkFunc AuthCheckFunc) http.Handler {
+	return MakeProxyCertAuthMiddleware(next, checkFunc, nil)
+}
+
+// MakeProxyCertAuthMiddleware works as [MakeProxyAuthMiddleware] and additionally accepts verified TLS client
+// certificate instead of credentials, certificate is mapped to the proxy user with certIdentity.
+// Credentials take precedence, so certificate holders can still pass username parameters, e.g. session.
+// Unchecked credentials don't override client identity (see [ClientACL.Identities]), only their parameters are used.
+// When checkFunc is nil and certIdentity is set only certificates are accepted
+func MakeProxyCertAuthMiddleware(next http.Handler, checkFunc AuthCheckFunc, certIdentity CertIdentityFunc) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !checkAuth(r, checkFunc) {
+		var usr *ProxyUser
+		var ok bool
+
+		// Client can be already identified by its address, see [ClientACL.Identities]
+		implicitUsr, hasImplicitUsr := ProxyUserFromContext(r.Context())
+
+		// Unchecked credentials must not bypass certificate authentication
+		if checkFunc != nil || certIdentity == nil {
+			usr, ok = checkAuth(r, checkFunc)
+			if ok && checkFunc == nil {
+				usr = unverifiedUser(usr, implicitUsr)
+			}
+		}
+
+		if !ok && certIdentity != nil {
+			usr, ok = checkClientCert(r, certIdentity)
+		}
+
+		if !ok {
+			usr, ok = implicitUsr, hasImplicitUsr
+		}
+
+		if !ok && (checkFunc != nil || certIdentity != nil) {
 			w.Header().Set("Proxy-Authenticate", "Basic realm=\"Restricted\"")
 			http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
 
 			return
 		}
 
+		if usr != nil {
+			r = r.WithContext(setCtxProxyUser(r.Context(), usr))
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
-func checkAuth(r *http.Request, checkFunc AuthCheckFunc) bool {
+func checkAuth(r *http.Request, checkFunc AuthCheckFunc) (*ProxyUser, bool) {
 	auth := r.Header.Get("Proxy-Authorization")
 	if auth == "" {
-		return false
+		return nil, false
 	}
 
 	// Expected authorization header format: "Basic <base64-encoded-credentials>"
 	const prefix = "Basic "
 	if !strings.HasPrefix(auth, prefix) {
-		return false
+		return nil, false
 	}
 
 	// Decode the base64 credentials
 	payload, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
 	if err != nil {
-		return false
+		return nil, false
 	}
 
 	colDelim := strings.IndexByte(string(payload), ':')
 	if colDelim < 0 || len(payload) < colDelim+2 {
-		return false
+		return nil, false
+	}
+
+	return checkCredentials(string(payload[:colDelim]), string(payload[colDelim+1:]), checkFunc)
+}
+
+// checkClientCert maps verified client certificate (if any) to the proxy user
+func checkClientCert(r *http.Request, certIdentity CertIdentityFunc) (*ProxyUser, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	name, ok := certIdentity(r.TLS.VerifiedChains[0][0])
+	if !ok || len(name) == 0 {
+		return nil, false
+	}
+
+	return &ProxyUser{Name: name}, true
+}
+
+// checkCredentials parses username and checks credentials with checkFunc (if any)
+func checkCredentials(username, passwd string, checkFunc AuthCheckFunc) (*ProxyUser, bool) {
+	usr := ParseProxyUser(username)
+
+	if checkFunc != nil && !checkFunc(usr.Name, passwd) {
+		return nil, false
+	}
+
+	return &usr, true
+}
+
+// unverifiedUser makes proxy user of the unchecked credentials, client can claim any name there,
+// so known client identity (see [ClientACL.Identities]) takes precedence and only username parameters are kept.
+// Without identity name is kept for logs and sessions, but it's not used to look up user policy
+func unverifiedUser(usr *ProxyUser, identity *ProxyUser) *ProxyUser {
+	if identity == nil {
+		usr.unverified = true
+
+		return usr
 	}
 
-	return checkFunc(string(payload[:colDelim]), string(payload[colDelim+1:]))
+	return &ProxyUser{Name: identity.Name, Params: usr.Params}
 }
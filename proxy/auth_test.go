@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseProxyUser(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		want     ProxyUser
+	}{
+		{
+			"plain user",
+			"user",
+			ProxyUser{Name: "user"},
+		},
+		{
+			"user with session",
+			"user-session-abc123",
+			ProxyUser{Name: "user", Params: map[string]string{"session": "abc123"}},
+		},
+		{
+			"dashed user with session",
+			"team-a-session-abc123",
+			ProxyUser{Name: "team-a", Params: map[string]string{"session": "abc123"}},
+		},
+		{
+			"dashed user",
+			"team-a-b",
+			ProxyUser{Name: "team-a-b"},
+		},
+		{
+			"unknown param",
+			"user-country-us",
+			ProxyUser{Name: "user-country-us"},
+		},
+		{
+			"empty session",
+			"user-session-",
+			ProxyUser{Name: "user-session-"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseProxyUser(tt.username); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseProxyUser() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyCertAuthMiddleware(t *testing.T) {
+	var gotUser string
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if usr, ok := ProxyUserFromContext(r.Context()); ok {
+			gotUser = usr.Name
+		}
+	})
+
+	checkFunc := func(usr, passwd string) bool {
+		return usr == "alice" && passwd == "secret"
+	}
+
+	verified := &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "bob"}}}},
+	}
+
+	tests := []struct {
+		name      string
+		checkFunc AuthCheckFunc
+		tls       *tls.ConnectionState
+		basicUser string
+		basicPass string
+		wantCode  int
+		wantUser  string
+	}{
+		{"certificate", checkFunc, verified, "", "", http.StatusOK, "bob"},
+		{"credentials take precedence", checkFunc, verified, "alice", "secret", http.StatusOK, "alice"},
+		{"bad credentials fall back to certificate", checkFunc, verified, "alice", "wrong", http.StatusOK, "bob"},
+		{"no certificate", checkFunc, nil, "", "", http.StatusProxyAuthRequired, ""},
+		{"unverified certificate", checkFunc, &tls.ConnectionState{}, "", "", http.StatusProxyAuthRequired, ""},
+		{"unchecked credentials", nil, nil, "alice", "any", http.StatusProxyAuthRequired, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotUser = ""
+
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			r.TLS = tt.tls
+			if len(tt.basicUser) > 0 {
+				r.SetBasicAuth(tt.basicUser, tt.basicPass)
+				r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+			}
+
+			w := httptest.NewRecorder()
+			MakeProxyCertAuthMiddleware(next, tt.checkFunc, CertCommonNameIdentity).ServeHTTP(w, r)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("Status got = %d, want %d", w.Code, tt.wantCode)
+			}
+
+			if gotUser != tt.wantUser {
+				t.Errorf("User got = %q, want %q", gotUser, tt.wantUser)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// configFile is the config file which can be reloaded without restart, content is parsed and applied by load,
+// previous content is kept when load fails
+type configFile struct {
+	path string
+	// name is the kind of the file in errors and logs, e.g. "credentials"
+	name string
+	load func(r io.Reader) error
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// Reload reads file again
+func (f *configFile) Reload() error {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s file: %w", f.name, err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s file: %w", f.name, err)
+	}
+
+	if err := f.load(file); err != nil {
+		return fmt.Errorf("failed to read %s file: %w", f.name, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.modTime = info.ModTime()
+
+	return nil
+}
+
+// WatchChanges reloads file when its modification time changes, it blocks until ctx is done
+func (f *configFile) WatchChanges(ctx context.Context, interval time.Duration, logger *zap.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(f.path)
+		if err != nil {
+			logger.Warn("Failed to stat "+f.name+" file", zap.String("file", f.path), zap.Error(err))
+
+			continue
+		}
+
+		f.mu.Lock()
+		changed := !info.ModTime().Equal(f.modTime)
+		f.mu.Unlock()
+
+		if !changed {
+			continue
+		}
+
+		if err := f.Reload(); err != nil {
+			logger.Error("Failed to reload "+f.name+" file", zap.String("file", f.path), zap.Error(err))
+
+			continue
+		}
+
+		logger.Info("Reloaded "+f.name+" file", zap.String("file", f.path))
+	}
+}
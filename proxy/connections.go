@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes active CONNECT or SOCKS5 tunnel, SOCKS5 UDP association or plain HTTP request in progress
+type ConnInfo struct {
+	ID       uint64
+	Protocol DialProtocol
+	User     string
+	Client   string
+	// Target is empty for SOCKS5 UDP associations, their datagrams may go to any destination
+	Target string
+	// SourceIP is empty until destination is connected
+	SourceIP string
+	Started  time.Time
+	// BytesIn is number of bytes sent from the client to the destination
+	BytesIn int64
+	// BytesOut is number of bytes sent from the destination to the client
+	BytesOut int64
+}
+
+// activeConn is the registered connection, nil connection tracks nothing
+type activeConn struct {
+	id       uint64
+	protocol DialProtocol
+	user     string
+	client   string
+	target   string
+	started  time.Time
+
+	sourceIP atomic.Pointer[string]
+	bytes    byteCounters
+
+	kill func()
+}
+
+// connected sets source IP of the destination connection or UDP relay socket
+func (c *activeConn) connected(conn interface{ LocalAddr() net.Addr }) {
+	if c == nil {
+		return
+	}
+
+	sourceIP := connSourceIP(conn)
+	c.sourceIP.Store(&sourceIP)
+}
+
+// counters returns counters of the transferred bytes, nil connection has no counters
+func (c *activeConn) counters() *byteCounters {
+	if c == nil {
+		return nil
+	}
+
+	return &c.bytes
+}
+
+func (c *activeConn) info() ConnInfo {
+	info := ConnInfo{
+		ID:       c.id,
+		Protocol: c.protocol,
+		User:     c.user,
+		Client:   c.client,
+		Target:   c.target,
+		Started:  c.started,
+		BytesIn:  c.bytes.in.Load(),
+		BytesOut: c.bytes.out.Load(),
+	}
+
+	if sourceIP := c.sourceIP.Load(); sourceIP != nil {
+		info.SourceIP = *sourceIP
+	}
+
+	return info
+}
+
+// ConnRegistry tracks active connections, so they can be listed and terminated, nil registry tracks nothing
+type ConnRegistry struct {
+	mu     sync.Mutex
+	lastID uint64
+	conns  map[uint64]*activeConn
+}
+
+// MakeConnRegistry makes empty registry
+func MakeConnRegistry() *ConnRegistry {
+	return &ConnRegistry{conns: make(map[uint64]*activeConn)}
+}
+
+// add registers connection of the request user, kill must terminate the connection,
+// connection must be removed when it's closed
+func (r *ConnRegistry) add(ctx context.Context, protocol DialProtocol, client, target string, kill func()) *activeConn {
+	if r == nil {
+		return nil
+	}
+
+	c := &activeConn{
+		protocol: protocol,
+		client:   client,
+		target:   target,
+		started:  time.Now(),
+		kill:     kill,
+	}
+
+	if usr, ok := ProxyUserFromContext(ctx); ok {
+		c.user = usr.Name
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastID++
+	c.id = r.lastID
+	r.conns[c.id] = c
+
+	return c
+}
+
+func (r *ConnRegistry) remove(c *activeConn) {
+	if r == nil || c == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.conns, c.id)
+}
+
+// List returns active connections ordered by ID
+func (r *ConnRegistry) List() []ConnInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infos := make([]ConnInfo, 0, len(r.conns))
+	for _, c := range r.conns {
+		infos = append(infos, c.info())
+	}
+
+	slices.SortFunc(infos, func(a, b ConnInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+
+	return infos
+}
+
+// killWhere terminates connections matching the filter, number of terminated connections is returned
+func (r *ConnRegistry) killWhere(match func(info *ConnInfo) bool) int {
+	var matched []*activeConn
+
+	r.mu.Lock()
+	for _, c := range r.conns {
+		info := c.info()
+		if match(&info) {
+			matched = append(matched, c)
+		}
+	}
+	r.mu.Unlock()
+
+	// Connections are removed by their handlers once they are closed
+	for _, c := range matched {
+		c.kill()
+	}
+
+	return len(matched)
+}
+
+// Kill terminates connection with the ID, false is returned when there is no such connection
+func (r *ConnRegistry) Kill(id uint64) bool {
+	return r.killWhere(func(info *ConnInfo) bool {
+		return info.ID == id
+	}) > 0
+}
+
+// KillUser terminates all connections of the user
+func (r *ConnRegistry) KillUser(user string) int {
+	return r.killWhere(func(info *ConnInfo) bool {
+		return info.User == user
+	})
+}
+
+// KillSourceIP terminates all connections made from the source IP
+func (r *ConnRegistry) KillSourceIP(addr netip.Addr) int {
+	addr = addr.Unmap()
+
+	return r.killWhere(func(info *ConnInfo) bool {
+		sourceIP, err := netip.ParseAddr(info.SourceIP)
+
+		return err == nil && sourceIP.Unmap() == addr
+	})
+}
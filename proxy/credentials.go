@@ -0,0 +1,300 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Credential is the user entry of the credentials file
+type Credential struct {
+	Name string
+	// Hash is bcrypt ($2a$, $2b$, $2y$) or argon2id ($argon2id$) password hash
+	Hash string
+	// Attrs are optional user attributes, e.g. "max_conns=10"
+	Attrs map[string]string
+	// Policy is parsed from the attributes (see [ParseUserPolicy]), nil when user is not restricted
+	Policy *UserPolicy
+}
+
+// verify checks password against the hash
+func (c *Credential) verify(passwd string) bool {
+	if strings.HasPrefix(c.Hash, "$argon2id$") {
+		return verifyArgon2id(c.Hash, passwd)
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(c.Hash), []byte(passwd)) == nil
+}
+
+// ReadCredentials reads credentials in htpasswd like format, one user per line:
+//
+//	<user>:<hash>[:<attr>=<value>,...]
+//
+// Empty lines and lines starting with "#" are skipped
+func ReadCredentials(r io.Reader) (map[string]*Credential, error) {
+	creds := make(map[string]*Credential)
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		// Neither bcrypt nor argon2 hashes contain colons
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, fmt.Errorf("line %d: expected <user>:<hash>[:<attrs>]", lineNo)
+		}
+
+		cred := &Credential{
+			Name: parts[0],
+			Hash: parts[1],
+		}
+
+		if err := checkPasswordHash(cred.Hash); err != nil {
+			return nil, fmt.Errorf("line %d: user %q: %w", lineNo, cred.Name, err)
+		}
+
+		if len(parts) == 3 && len(parts[2]) > 0 {
+			cred.Attrs = make(map[string]string)
+
+			for _, attr := range strings.Split(parts[2], ",") {
+				key, value, ok := strings.Cut(attr, "=")
+				if !ok || len(key) == 0 {
+					return nil, fmt.Errorf("line %d: malformed attribute %q", lineNo, attr)
+				}
+
+				cred.Attrs[strings.TrimSpace(key)] = strings.TrimSpace(value)
+			}
+		}
+
+		policy, err := ParseUserPolicy(cred.Attrs)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: user %q policy: %w", lineNo, cred.Name, err)
+		}
+		cred.Policy = policy
+
+		if _, ok := creds[cred.Name]; ok {
+			return nil, fmt.Errorf("line %d: duplicate user %q", lineNo, cred.Name)
+		}
+
+		creds[cred.Name] = cred
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+var errUnsupportedHash = errors.New("unsupported password hash, bcrypt or argon2id is expected")
+
+func checkPasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, _, _, err := parseArgon2id(hash)
+
+		return err
+	}
+
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return errUnsupportedHash
+	}
+
+	return nil
+}
+
+// maxArgon2Memory is the max accepted argon2 memory cost in KiB (1 GiB)
+const maxArgon2Memory = 1 << 20
+
+type argon2Params struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+}
+
+// parseArgon2id parses hash in PHC string format: $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+func parseArgon2id(hash string) (params argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.time, &params.threads); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2 params %q", parts[3])
+	}
+
+	// argon2.IDKey panics on zero time or threads, huge memory cost would exhaust memory on every login
+	if params.time < 1 || params.threads < 1 || params.memory > maxArgon2Memory {
+		return params, nil, nil, fmt.Errorf("argon2 params %q out of range (t >= 1, p >= 1, m <= %d)", parts[3], maxArgon2Memory)
+	}
+
+	if salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2 salt: %w", err)
+	}
+
+	if key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return params, nil, nil, fmt.Errorf("malformed argon2 hash: %w", err)
+	}
+
+	if len(salt) == 0 || len(key) == 0 {
+		return params, nil, nil, errors.New("empty argon2 salt or hash")
+	}
+
+	return params, salt, key, nil
+}
+
+func verifyArgon2id(hash, passwd string) bool {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+
+	derived := argon2.IDKey([]byte(passwd), salt, params.time, params.memory, params.threads, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// dummyCredential is verified for unknown users, so response time does not reveal whether user exists
+var dummyCredential = &Credential{
+	Hash: "$2a$10$3PHTVmMw4nLAzyS8iomjGO/OhTFxtbBUfSEYAqU6uMU38P3jRKHvu",
+}
+
+// verifiedKey is the per process HMAC key of the verification cache, so cached digests can't be brute forced offline
+var verifiedKey = func() []byte {
+	key := make([]byte, sha256.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(fmt.Errorf("failed to generate verification cache key: %w", err))
+	}
+
+	return key
+}()
+
+// verifiedDigest returns digest of the user and password in the verification cache
+func verifiedDigest(usr, passwd string) (digest [sha256.Size]byte) {
+	mac := hmac.New(sha256.New, verifiedKey)
+	mac.Write([]byte(usr + "\x00" + passwd))
+	copy(digest[:], mac.Sum(nil))
+
+	return digest
+}
+
+// CredentialsFile is the credentials file (see [ReadCredentials]) which can be reloaded without restart.
+// Successful verifications are cached until the file is reloaded, so passwords are not hashed on every request
+type CredentialsFile struct {
+	file configFile
+
+	mu    sync.RWMutex
+	creds map[string]*Credential
+	// verified are HMAC-SHA-256 digests of user and password which passed verification
+	verified map[string][sha256.Size]byte
+}
+
+// LoadCredentialsFile loads credentials from the file
+func LoadCredentialsFile(path string) (*CredentialsFile, error) {
+	f := &CredentialsFile{}
+	f.file = configFile{path: path, name: "credentials", load: f.load}
+
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *CredentialsFile) load(r io.Reader) error {
+	creds, err := ReadCredentials(r)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.creds = creds
+	f.verified = make(map[string][sha256.Size]byte)
+
+	return nil
+}
+
+// Reload reads credentials file again, previous credentials are kept on error
+func (f *CredentialsFile) Reload() error {
+	return f.file.Reload()
+}
+
+// Check verifies user password, it can be used as [AuthCheckFunc]
+func (f *CredentialsFile) Check(usr, passwd string) bool {
+	digest := verifiedDigest(usr, passwd)
+
+	f.mu.RLock()
+	cred, ok := f.creds[usr]
+	cached, isCached := f.verified[usr]
+	f.mu.RUnlock()
+
+	if !ok {
+		dummyCredential.verify(passwd)
+
+		return false
+	}
+
+	if isCached && subtle.ConstantTimeCompare(cached[:], digest[:]) == 1 {
+		return true
+	}
+
+	if !cred.verify(passwd) {
+		return false
+	}
+
+	f.mu.Lock()
+	// Credential could be replaced by reload during verification
+	if f.creds[usr] == cred {
+		f.verified[usr] = digest
+	}
+	f.mu.Unlock()
+
+	return true
+}
+
+// User returns user entry of the credentials file
+func (f *CredentialsFile) User(name string) (*Credential, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	cred, ok := f.creds[name]
+
+	return cred, ok
+}
+
+// Policy returns policy of the user, it can be used as [PolicyFunc]
+func (f *CredentialsFile) Policy(usr *ProxyUser) *UserPolicy {
+	cred, ok := f.User(usr.Name)
+	if !ok {
+		return nil
+	}
+
+	return cred.Policy
+}
+
+// WatchChanges reloads credentials file when its modification time changes, it blocks until ctx is done
+func (f *CredentialsFile) WatchChanges(ctx context.Context, interval time.Duration, logger *zap.Logger) {
+	f.file.WatchChanges(ctx, interval, logger)
+}
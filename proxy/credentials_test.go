@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func makeTestArgon2id(passwd string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(passwd), salt, 1, 64, 1, 32)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestReadCredentials(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("Failed to hash password: %v", err)
+	}
+
+	input := "# users\n" +
+		"alice:" + string(bcryptHash) + "\n" +
+		"\n" +
+		"bob:" + makeTestArgon2id("hunter2") + ":max_conns=10, team=a\n"
+
+	creds, err := ReadCredentials(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ReadCredentials() error = %v", err)
+	}
+
+	if len(creds) != 2 {
+		t.Fatalf("ReadCredentials() got %d users, want 2", len(creds))
+	}
+
+	if want := map[string]string{"max_conns": "10", "team": "a"}; !reflect.DeepEqual(creds["bob"].Attrs, want) {
+		t.Errorf("ReadCredentials() attrs got = %v, want %v", creds["bob"].Attrs, want)
+	}
+
+	if !creds["alice"].verify("secret") || creds["alice"].verify("wrong") {
+		t.Errorf("bcrypt verification failed")
+	}
+
+	if !creds["bob"].verify("hunter2") || creds["bob"].verify("wrong") {
+		t.Errorf("argon2id verification failed")
+	}
+
+	argon2Hash := makeTestArgon2id("hunter2")
+
+	for _, bad := range []string{
+		"alice",
+		"alice:plaintext",
+		"alice:" + string(bcryptHash) + ":noequals",
+		// Params argon2.IDKey panics on or which exhaust memory
+		"bob:" + strings.Replace(argon2Hash, "t=1", "t=0", 1),
+		"bob:" + strings.Replace(argon2Hash, "p=1", "p=0", 1),
+		"bob:" + strings.Replace(argon2Hash, "m=64", "m=4294967295", 1),
+	} {
+		if _, err := ReadCredentials(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadCredentials(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestCredentialsFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+
+	if err := os.WriteFile(path, []byte("alice:"+makeTestArgon2id("secret")+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write credentials: %v", err)
+	}
+
+	creds, err := LoadCredentialsFile(path)
+	if err != nil {
+		t.Fatalf("LoadCredentialsFile() error = %v", err)
+	}
+
+	if !creds.Check("alice", "secret") {
+		t.Errorf("Check() of valid password failed")
+	}
+	if _, ok := creds.verified["alice"]; !ok {
+		t.Errorf("Check() did not cache successful verification")
+	}
+	if creds.Check("alice", "wrong") || creds.Check("bob", "secret") {
+		t.Errorf("Check() of invalid credentials succeeded")
+	}
+
+	if err := os.WriteFile(path, []byte("alice:"+makeTestArgon2id("changed")+"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write credentials: %v", err)
+	}
+
+	if err := creds.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	// Cached verification of the old password must not survive reload
+	if creds.Check("alice", "secret") {
+		t.Errorf("Check() of the old password succeeded after reload")
+	}
+	if !creds.Check("alice", "changed") {
+		t.Errorf("Check() of the new password failed after reload")
+	}
+}
@@ -1,18 +1,121 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/codercms/freebind-proxy/utils"
-	"log"
 	"math/rand/v2"
 	"net"
 	"net/netip"
+	"strings"
+	"sync"
 	"syscall"
 )
 
+// DialProtocol is a client protocol which requested outgoing connection
+type DialProtocol int
+
+const (
+	// DialProtocolConnect is the HTTP CONNECT tunnel
+	DialProtocolConnect DialProtocol = iota
+	// DialProtocolHttp is the plain (not tunnelled) HTTP request
+	DialProtocolHttp
+	// DialProtocolSocks is the SOCKS5 CONNECT command
+	DialProtocolSocks
+	// DialProtocolDNS is the query of the DNS resolver (see [DNSResolver.Dialer])
+	DialProtocolDNS
+	// DialProtocolSocksUdp is the SOCKS5 UDP ASSOCIATE command, destinations of its datagrams are checked with it
+	DialProtocolSocksUdp
+)
+
+func (p DialProtocol) String() string {
+	switch p {
+	case DialProtocolConnect:
+		return "connect"
+	case DialProtocolHttp:
+		return "http"
+	case DialProtocolSocks:
+		return "socks"
+	case DialProtocolDNS:
+		return "dns"
+	case DialProtocolSocksUdp:
+		return "socks-udp"
+	default:
+		return "unknown"
+	}
+}
+
+// DialRequest describes who requests outgoing connection and where to
+type DialRequest struct {
+	// User is the authenticated proxy user, nil when client did not provide credentials
+	User *ProxyUser
+	// ClientAddr is the client remote address
+	ClientAddr string
+	// Target is the destination host:port
+	Target string
+
+	Protocol DialProtocol
+	// Attempt is the number of the dial attempt starting from 0, retried attempts should get dialer
+	// with another source IP (see [DialRetryPolicy])
+	Attempt int
+	// Prefixes restrict source IP to the prefixes (see [UserPolicy.Prefixes]), empty means no restriction.
+	// Factories which do not pick source IP ignore it
+	Prefixes []netip.Prefix
+}
+
+// DialerFactoryIface provides dialers for the outgoing connections, factories which also implement
+// [RequestDialerFactoryIface] are asked for dialer of every request instead
 type DialerFactoryIface interface {
 	GetDialer() *net.Dialer
 }
 
+// RequestDialerFactoryIface provides dialers for the outgoing connections, dialer can be chosen based on the request,
+// e.g. source IP can be picked by the user or the destination.
+// Dialers are requested concurrently, so implementations must be safe for concurrent use
+type RequestDialerFactoryIface interface {
+	GetRequestDialer(ctx context.Context, req *DialRequest) (*net.Dialer, error)
+}
+
+// requestDialerFactory returns factory which provides dialers per request,
+// factory without [RequestDialerFactoryIface] support is adapted with [LegacyDialerFactory]
+func requestDialerFactory(factory DialerFactoryIface) RequestDialerFactoryIface {
+	if reqFactory, ok := factory.(RequestDialerFactoryIface); ok {
+		return reqFactory
+	}
+
+	return LegacyDialerFactory{Factory: factory}
+}
+
+// LegacyDialerFactory adapts [DialerFactoryIface] to [RequestDialerFactoryIface], request is ignored
+type LegacyDialerFactory struct {
+	Factory DialerFactoryIface
+}
+
+func (f LegacyDialerFactory) GetRequestDialer(_ context.Context, _ *DialRequest) (*net.Dialer, error) {
+	return f.Factory.GetDialer(), nil
+}
+
+// DialerFactoryFunc is an adapter to allow the use of ordinary functions as dialer factories
+type DialerFactoryFunc func(ctx context.Context, req *DialRequest) (*net.Dialer, error)
+
+func (f DialerFactoryFunc) GetRequestDialer(ctx context.Context, req *DialRequest) (*net.Dialer, error) {
+	return f(ctx, req)
+}
+
+// GetDialer implements [DialerFactoryIface], it provides dialer of the empty request, nil on error
+func (f DialerFactoryFunc) GetDialer() *net.Dialer {
+	dialer, _ := f(context.Background(), &DialRequest{})
+
+	return dialer
+}
+
+// PacketListenerFactoryIface provides UDP sockets used to relay SOCKS5 UDP ASSOCIATE traffic,
+// request has no target since datagrams of the association may be sent to any destination
+type PacketListenerFactoryIface interface {
+	ListenPacket(ctx context.Context, req *DialRequest) (net.PacketConn, error)
+}
+
 // StaticDialerFactory provides user specified dialer
 // if user provided dialer is unspecified provides empty dialer struct
 type StaticDialerFactory struct {
@@ -33,41 +136,314 @@ func (f *StaticDialerFactory) GetDialer() *net.Dialer {
 	return f.dialer
 }
 
-// RandIpDialerFactory provides dialer with random IP from provided network prefix
+func (f *StaticDialerFactory) GetRequestDialer(_ context.Context, _ *DialRequest) (*net.Dialer, error) {
+	return f.dialer, nil
+}
+
+// SetSocketOptions makes dialer apply socket options after its own control function
+func (f *StaticDialerFactory) SetSocketOptions(opts *SocketOptions) {
+	d := *f.dialer
+
+	if controlCtx := f.dialer.ControlContext; controlCtx != nil {
+		d.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+			if err := controlCtx(ctx, network, address, c); err != nil {
+				return err
+			}
+
+			return opts.Control(network, address, c)
+		}
+	} else {
+		control := f.dialer.Control
+
+		d.Control = func(network, address string, c syscall.RawConn) error {
+			if control != nil {
+				if err := control(network, address, c); err != nil {
+					return err
+				}
+			}
+
+			return opts.Control(network, address, c)
+		}
+	}
+
+	if opts.overridesKeepAlive() {
+		d.KeepAlive = -1
+	}
+
+	f.dialer = &d
+}
+
+// ListenPacket listens UDP on the dialer local address IP (if any) and random port
+func (f *StaticDialerFactory) ListenPacket(ctx context.Context, _ *DialRequest) (net.PacketConn, error) {
+	laddr := ":0"
+	if tcpAddr, ok := f.dialer.LocalAddr.(*net.TCPAddr); ok && tcpAddr != nil {
+		laddr = net.JoinHostPort(tcpAddr.IP.String(), "0")
+	}
+
+	lc := net.ListenConfig{Control: f.dialer.Control}
+
+	return lc.ListenPacket(ctx, "udp", laddr)
+}
+
+// RandIpDialerFactory provides dialer with random IP from provided network prefix.
+// Dialers are requested concurrently, so source of the randReader passed to the constructors
+// must be safe for concurrent use, e.g. [utils.ShardedSource]
 type RandIpDialerFactory struct {
-	randReader *rand.Rand
+	alloc        utils.AddrAllocator
+	freebindMode FreebindMode
+	sockOpts     *SocketOptions
 
-	prefix netip.Prefix
+	// restricted are allocators restricted to the requested prefixes, keyed by the prefixes list
+	restrictedMu sync.Mutex
+	restricted   map[string]utils.AddrAllocator
 }
 
+// MakeRandIpDialerFactory makes factory which provides dialers with random IPs from the prefix,
+// factory supports source prefixes of the user policies (see [UserPolicy.Prefixes])
 func MakeRandIpDialerFactory(randReader *rand.Rand, prefix netip.Prefix) *RandIpDialerFactory {
-	return &RandIpDialerFactory{
-		randReader: randReader,
+	// Weighted allocator of the single prefix can't fail and can be restricted to the part of the prefix
+	factory, _ := MakeWeightedRandIpDialerFactory(randReader, utils.WeightedPrefix{Prefix: prefix, Weight: 1})
+
+	return factory
+}
+
+// MakeWeightedRandIpDialerFactory makes factory which provides dialers with random IPs from the prefixes,
+// prefix is chosen proportionally to its weight
+func MakeWeightedRandIpDialerFactory(randReader *rand.Rand, prefixes ...utils.WeightedPrefix) (*RandIpDialerFactory, error) {
+	allocs := make([]utils.AddrAllocator, len(prefixes))
+	for i, p := range prefixes {
+		allocs[i] = utils.NewRandomAllocator(randReader, p.Prefix)
+	}
+
+	alloc, err := utils.NewWeightedAllocator(randReader, prefixes, allocs)
+	if err != nil {
+		return nil, err
+	}
+
+	return MakeAllocIpDialerFactory(alloc), nil
+}
 
-		prefix: prefix,
+// MakeAllocIpDialerFactory makes factory which provides dialers with IPs picked by the allocator,
+// e.g. [utils.PermutationAllocator]
+func MakeAllocIpDialerFactory(alloc utils.AddrAllocator) *RandIpDialerFactory {
+	return &RandIpDialerFactory{
+		alloc: alloc,
 	}
 }
 
+// SetFreebindMode sets socket option used to bind sockets to non-local source IPs,
+// default is [FreebindModeFreebind]
+func (f *RandIpDialerFactory) SetFreebindMode(mode FreebindMode) {
+	f.freebindMode = mode
+}
+
+// SetSocketOptions sets options of the dialed and listened sockets
+func (f *RandIpDialerFactory) SetSocketOptions(opts *SocketOptions) {
+	f.sockOpts = opts
+}
+
+// GetDialer provides dialer with source IP from any of the prefixes
 func (f *RandIpDialerFactory) GetDialer() *net.Dialer {
-	randIp := utils.GetRandomIpFromPrefix(f.randReader, f.prefix)
+	return f.getDialer(f.alloc)
+}
+
+// GetRequestDialer provides dialer which binds source IP of the destination address family,
+// when allocator supports it (see [utils.FamilyAddrAllocator]).
+// Source IP of each family is picked on the first dial and then reused by the dialer,
+// so dual stack destinations are dialed with Happy Eyeballs where each family has its own source IP
+func (f *RandIpDialerFactory) GetRequestDialer(_ context.Context, req *DialRequest) (*net.Dialer, error) {
+	if len(req.Prefixes) == 0 {
+		return f.getDialer(f.alloc), nil
+	}
+
+	alloc, err := f.restrictedAlloc(req.Prefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	return f.getDialer(alloc), nil
+}
+
+// supportsPrefixes reports whether allocator can be restricted to the source prefixes of the requests
+func (f *RandIpDialerFactory) supportsPrefixes() bool {
+	_, ok := f.alloc.(utils.RestrictableAllocator)
+
+	return ok
+}
+
+// restrictedAlloc returns allocator restricted to the prefixes, allocators are cached since policies are few
+func (f *RandIpDialerFactory) restrictedAlloc(prefixes []netip.Prefix) (utils.AddrAllocator, error) {
+	keyParts := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		keyParts[i] = p.String()
+	}
+	key := strings.Join(keyParts, ",")
+
+	f.restrictedMu.Lock()
+	defer f.restrictedMu.Unlock()
+
+	if alloc, ok := f.restricted[key]; ok {
+		return alloc, nil
+	}
+
+	restrictable, ok := f.alloc.(utils.RestrictableAllocator)
+	if !ok {
+		return nil, ErrPrefixesNotSupported
+	}
+
+	alloc, err := restrictable.Restrict(prefixes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to restrict source prefixes to %s: %w", key, err)
+	}
+
+	if f.restricted == nil {
+		f.restricted = make(map[string]utils.AddrAllocator)
+	}
+	f.restricted[key] = alloc
+
+	return alloc, nil
+}
+
+func (f *RandIpDialerFactory) getDialer(alloc utils.AddrAllocator) *net.Dialer {
+	if familyAlloc, ok := alloc.(utils.FamilyAddrAllocator); ok {
+		src := &familySources{alloc: familyAlloc, mode: f.freebindMode, sockOpts: f.sockOpts}
+
+		d := &net.Dialer{
+			ControlContext: src.control,
+		}
+		if f.sockOpts.overridesKeepAlive() {
+			d.KeepAlive = -1
+		}
+
+		return d
+	}
+
+	randIp := alloc.NextAddr()
 
 	d := net.Dialer{
 		LocalAddr: &net.TCPAddr{
 			IP: randIp.AsSlice(),
 		},
 
-		Control: func(network, address string, c syscall.RawConn) error {
-			return c.Control(func(fd uintptr) {
-				if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_FREEBIND, 1); err != nil {
-					log.Printf("Failed to set IP_FREEBIND: %v\n", err)
-				}
-
-				//if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
-				//	log.Printf("Failed to set SO_KEEPALIVE: %v\n", err)
-				//}
-			})
-		},
+		Control: makeFreebindControl(f.freebindMode, f.sockOpts),
+	}
+	if f.sockOpts.overridesKeepAlive() {
+		d.KeepAlive = -1
 	}
 
 	return &d
 }
+
+// ListenPacket listens UDP on random IP from provided network prefix (restricted to the request prefixes, if any)
+// and random port
+func (f *RandIpDialerFactory) ListenPacket(ctx context.Context, req *DialRequest) (net.PacketConn, error) {
+	alloc := f.alloc
+	if len(req.Prefixes) > 0 {
+		var err error
+		if alloc, err = f.restrictedAlloc(req.Prefixes); err != nil {
+			return nil, err
+		}
+	}
+
+	return f.listenPacketAddr(ctx, alloc.NextAddr())
+}
+
+// addrPacketListener can listen UDP on the given source IP, e.g. to reuse source IP of the sticky session
+type addrPacketListener interface {
+	listenPacketAddr(ctx context.Context, addr netip.Addr) (net.PacketConn, error)
+}
+
+// listenPacketAddr listens UDP on the IP and random port
+func (f *RandIpDialerFactory) listenPacketAddr(ctx context.Context, addr netip.Addr) (net.PacketConn, error) {
+	lc := net.ListenConfig{Control: makeFreebindControl(f.freebindMode, f.sockOpts)}
+
+	return lc.ListenPacket(ctx, "udp", netip.AddrPortFrom(addr, 0).String())
+}
+
+var ErrNoSourceAddr = errors.New("no source address of the destination address family")
+
+// ErrPrefixesNotSupported is returned when source prefixes are requested but allocator can't be restricted
+var ErrPrefixesNotSupported = errors.New("allocator does not support source prefixes restriction")
+
+// prefixesSupporter is implemented by factories which pick source IP, so they can tell whether
+// source prefixes of the requests can be applied
+type prefixesSupporter interface {
+	supportsPrefixes() bool
+}
+
+// familySources lazily picks dialer source IP for each address family
+type familySources struct {
+	alloc    utils.FamilyAddrAllocator
+	mode     FreebindMode
+	sockOpts *SocketOptions
+
+	mu sync.Mutex
+	// addrs are IPv6 (0) and IPv4 (1) source addresses
+	addrs [2]netip.Addr
+}
+
+func (s *familySources) addr(is4 bool) (netip.Addr, bool) {
+	idx := 0
+	if is4 {
+		idx = 1
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.addrs[idx].IsValid() {
+		addr, ok := s.alloc.NextAddrOf(is4)
+		if !ok {
+			return netip.Addr{}, false
+		}
+
+		s.addrs[idx] = addr
+	}
+
+	return s.addrs[idx], true
+}
+
+// control binds socket to the source IP of the socket family,
+// socket family matches destination address family, so each Happy Eyeballs attempt gets suitable source IP
+func (s *familySources) control(_ context.Context, network, _ string, c syscall.RawConn) error {
+	is4 := isNetwork4(network)
+
+	addr, ok := s.addr(is4)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSourceAddr, network)
+	}
+
+	var sa syscall.Sockaddr
+	if is4 {
+		sa = &syscall.SockaddrInet4{Addr: addr.As4()}
+	} else {
+		sa = &syscall.SockaddrInet6{Addr: addr.As16()}
+	}
+
+	var setErr, bindErr error
+	err := c.Control(func(fd uintptr) {
+		if setErr = setFreebind(fd, is4, s.mode); setErr != nil {
+			return
+		}
+
+		// Options like SO_BINDTODEVICE must be set before socket is bound
+		if setErr = s.sockOpts.apply(fd, network); setErr != nil {
+			return
+		}
+
+		bindErr = syscall.Bind(int(fd), sa)
+	})
+	if err != nil {
+		return err
+	}
+
+	if setErr != nil {
+		return setErr
+	}
+
+	if bindErr != nil {
+		return fmt.Errorf("bind %s: %w", addr, bindErr)
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/codercms/freebind-proxy/utils"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func makeTestWeightedFactory(t *testing.T, prefixes ...string) *RandIpDialerFactory {
+	t.Helper()
+
+	randReader := rand.New(rand.NewPCG(1, 2))
+
+	weighted := make([]utils.WeightedPrefix, len(prefixes))
+	for i, p := range prefixes {
+		weighted[i] = utils.WeightedPrefix{Prefix: netip.MustParsePrefix(p), Weight: 1}
+	}
+
+	factory, err := MakeWeightedRandIpDialerFactory(randReader, weighted...)
+	if err != nil {
+		t.Fatalf("MakeWeightedRandIpDialerFactory() error = %v", err)
+	}
+
+	return factory
+}
+
+func TestRandIpDialerFactoryMatchesDestinationFamily(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	factory := makeTestWeightedFactory(t, "::1/128", "127.0.0.2/32")
+
+	for i := 0; i < 10; i++ {
+		conn, err := factory.getDialer(factory.alloc).DialContext(context.Background(), "tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("DialContext() error = %v", err)
+		}
+
+		local := conn.LocalAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+		_ = conn.Close()
+
+		if want := netip.MustParseAddr("127.0.0.2"); local != want {
+			t.Fatalf("DialContext() source IP got = %v, want %v", local, want)
+		}
+	}
+
+	v6Factory := makeTestWeightedFactory(t, "::1/128")
+
+	_, err = v6Factory.getDialer(v6Factory.alloc).DialContext(context.Background(), "tcp", listener.Addr().String())
+	if !errors.Is(err, ErrNoSourceAddr) {
+		t.Errorf("DialContext() without IPv4 prefix error = %v, want %v", err, ErrNoSourceAddr)
+	}
+}
+
+// legacyTestFactory implements only [DialerFactoryIface]
+type legacyTestFactory struct {
+	calls int
+}
+
+func (f *legacyTestFactory) GetDialer() *net.Dialer {
+	f.calls++
+
+	return &net.Dialer{}
+}
+
+func TestServerLegacyDialerFactory(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	factory := &legacyTestFactory{}
+	srv := MakeServer(factory)
+
+	conn, err := srv.dial(context.Background(), DialProtocolConnect, "127.0.0.1:1234", "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial() error = %v", err)
+	}
+	_ = conn.Close()
+
+	if factory.calls != 1 {
+		t.Errorf("Legacy factory calls got = %d, want 1", factory.calls)
+	}
+}
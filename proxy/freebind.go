@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// Linux socket options missing in syscall package
+const (
+	sysIPV6_TRANSPARENT = 0x4b
+	sysIPV6_FREEBIND    = 0x4e
+)
+
+// FreebindMode selects socket option which allows binding sockets to non-local addresses
+type FreebindMode int
+
+const (
+	// FreebindModeFreebind uses IP_FREEBIND (IPv4) or IPV6_FREEBIND (IPv6) socket option
+	FreebindModeFreebind FreebindMode = iota
+	// FreebindModeTransparent uses IP_TRANSPARENT (IPv4) or IPV6_TRANSPARENT (IPv6) socket option,
+	// it's required for TPROXY setups and needs CAP_NET_ADMIN
+	FreebindModeTransparent
+)
+
+func (m FreebindMode) String() string {
+	switch m {
+	case FreebindModeFreebind:
+		return "freebind"
+	case FreebindModeTransparent:
+		return "transparent"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseFreebindMode parses mode name ("freebind" or "transparent")
+func ParseFreebindMode(s string) (FreebindMode, error) {
+	switch s {
+	case "freebind":
+		return FreebindModeFreebind, nil
+	case "transparent":
+		return FreebindModeTransparent, nil
+	default:
+		return 0, fmt.Errorf("unknown freebind mode %q", s)
+	}
+}
+
+// SockOptError is returned by dials when socket option can't be set,
+// e.g. kernel does not support it or process lacks capabilities
+type SockOptError struct {
+	Opt string
+	Err error
+}
+
+func (e *SockOptError) Error() string {
+	return fmt.Sprintf("failed to set %s: %v", e.Opt, e.Err)
+}
+
+func (e *SockOptError) Unwrap() error {
+	return e.Err
+}
+
+// setFreebind sets socket option of the mode suitable for the socket address family
+func setFreebind(fd uintptr, is4 bool, mode FreebindMode) error {
+	var level, opt int
+	var name string
+
+	switch {
+	case mode == FreebindModeTransparent && is4:
+		level, opt, name = syscall.SOL_IP, syscall.IP_TRANSPARENT, "IP_TRANSPARENT"
+	case mode == FreebindModeTransparent:
+		level, opt, name = syscall.SOL_IPV6, sysIPV6_TRANSPARENT, "IPV6_TRANSPARENT"
+	case is4:
+		level, opt, name = syscall.SOL_IP, syscall.IP_FREEBIND, "IP_FREEBIND"
+	default:
+		level, opt, name = syscall.SOL_IPV6, sysIPV6_FREEBIND, "IPV6_FREEBIND"
+	}
+
+	if err := syscall.SetsockoptInt(int(fd), level, opt, 1); err != nil {
+		return &SockOptError{Opt: name, Err: err}
+	}
+
+	return nil
+}
+
+// isNetwork4 reports whether socket network is IPv4, e.g. "tcp4" or "udp4"
+func isNetwork4(network string) bool {
+	return strings.HasSuffix(network, "4")
+}
+
+// makeFreebindControl makes socket control func which sets freebind option of the mode and socket options (if any),
+// so socket can be bound to non-local address
+func makeFreebindControl(mode FreebindMode, sockOpts *SocketOptions) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var setErr error
+
+		err := c.Control(func(fd uintptr) {
+			if setErr = setFreebind(fd, isNetwork4(network), mode); setErr != nil {
+				return
+			}
+
+			setErr = sockOpts.apply(fd, network)
+		})
+		if err != nil {
+			return err
+		}
+
+		return setErr
+	}
+}
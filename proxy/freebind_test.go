@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+func TestFreebindControlSetsFamilyOption(t *testing.T) {
+	tests := []struct {
+		network string
+		addr    string
+		level   int
+		opt     int
+	}{
+		{"tcp4", "127.0.0.1:0", syscall.SOL_IP, syscall.IP_FREEBIND},
+		{"tcp6", "[::1]:0", syscall.SOL_IPV6, sysIPV6_FREEBIND},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			lc := net.ListenConfig{Control: makeFreebindControl(FreebindModeFreebind, nil)}
+
+			listener, err := lc.Listen(context.Background(), tt.network, tt.addr)
+			if err != nil {
+				t.Skipf("Failed to listen: %v", err)
+			}
+			defer listener.Close()
+
+			rawConn, err := listener.(*net.TCPListener).SyscallConn()
+			if err != nil {
+				t.Fatalf("Failed to get raw conn: %v", err)
+			}
+
+			var val int
+			var getErr error
+			_ = rawConn.Control(func(fd uintptr) {
+				val, getErr = syscall.GetsockoptInt(int(fd), tt.level, tt.opt)
+			})
+			if getErr != nil {
+				t.Fatalf("Failed to get socket option: %v", getErr)
+			}
+
+			if val != 1 {
+				t.Errorf("Socket option got = %d, want 1", val)
+			}
+		})
+	}
+}
+
+func TestServerDialSockOptError(t *testing.T) {
+	var attempts int
+
+	factory := DialerFactoryFunc(func(ctx context.Context, req *DialRequest) (*net.Dialer, error) {
+		attempts++
+
+		return &net.Dialer{
+			Control: func(network, address string, c syscall.RawConn) error {
+				return &SockOptError{Opt: "IP_FREEBIND", Err: syscall.EPERM}
+			},
+		}, nil
+	})
+
+	policy := DialRetryPolicy{Attempts: 3, Retryable: dialErrorClasses}
+	srv := MakeServer(factory, WithDialRetryPolicy(policy))
+
+	_, err := srv.dial(context.Background(), DialProtocolConnect, "127.0.0.1:1234", "tcp", "127.0.0.1:1")
+
+	var sockOptErr *SockOptError
+	if !errors.As(err, &sockOptErr) {
+		t.Fatalf("dial() error = %v, want SockOptError", err)
+	}
+
+	if attempts != 1 {
+		t.Errorf("dial() attempts got = %d, want 1", attempts)
+	}
+
+	if status := dialErrorStatus(err, http.StatusBadGateway); status != http.StatusInternalServerError {
+		t.Errorf("dialErrorStatus() got = %d, want %d", status, http.StatusInternalServerError)
+	}
+}
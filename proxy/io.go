@@ -4,7 +4,9 @@ import (
 	"errors"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -84,3 +86,87 @@ func CopyBufferWithTimeout(dst io.Writer, src io.Reader, buf []byte) (written in
 	}
 	return written, err
 }
+
+// byteCounters counts bytes transferred through the proxy, in is client to destination, out is destination to client
+type byteCounters struct {
+	in  atomic.Int64
+	out atomic.Int64
+}
+
+// directionCounters returns counters of the direction ("in" or "out"), nil counters are skipped
+func directionCounters(direction string, counters []*byteCounters) []*atomic.Int64 {
+	var res []*atomic.Int64
+	for _, c := range counters {
+		if c == nil {
+			continue
+		}
+
+		if direction == "in" {
+			res = append(res, &c.in)
+		} else {
+			res = append(res, &c.out)
+		}
+	}
+
+	return res
+}
+
+type byteCountingWriter struct {
+	io.Writer
+	counters []*atomic.Int64
+}
+
+func (w *byteCountingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	for _, c := range w.counters {
+		c.Add(int64(n))
+	}
+
+	return n, err
+}
+
+// countBytes wraps writer, so written bytes are added to the direction ("in" or "out") counters
+func countBytes(w io.Writer, direction string, counters ...*byteCounters) io.Writer {
+	dirCounters := directionCounters(direction, counters)
+	if len(dirCounters) == 0 {
+		return w
+	}
+
+	return &byteCountingWriter{Writer: w, counters: dirCounters}
+}
+
+type byteCountingBody struct {
+	io.Reader
+	io.Closer
+	counters []*atomic.Int64
+}
+
+func (b *byteCountingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	for _, c := range b.counters {
+		c.Add(int64(n))
+	}
+
+	return n, err
+}
+
+// countBodyBytes wraps request body, so bytes sent to the destination are added to the "in" counters,
+// empty body is kept as is, so transport doesn't send it chunked
+func countBodyBytes(body io.ReadCloser, counters ...*byteCounters) io.ReadCloser {
+	dirCounters := directionCounters("in", counters)
+	if len(dirCounters) == 0 || body == nil || body == http.NoBody {
+		return body
+	}
+
+	return &byteCountingBody{Reader: body, Closer: body, counters: dirCounters}
+}
+
+// connSourceIP returns local IP of the destination connection
+func connSourceIP(conn interface{ LocalAddr() net.Addr }) string {
+	local := conn.LocalAddr().String()
+	if host, _, err := net.SplitHostPort(local); err == nil {
+		return host
+	}
+
+	return local
+}
@@ -0,0 +1,333 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/codercms/freebind-proxy/utils"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request outcomes of the requests metric
+const (
+	outcomeOk           = "ok"
+	outcomeDenied       = "denied"
+	outcomeTooManyConns = "too_many_conns"
+	outcomeDialError    = "dial_error"
+	outcomeError        = "error"
+)
+
+// Methods of the SOCKS5 requests in the requests metric
+const (
+	socksMethodConnect = "SOCKS_CONNECT"
+	socksMethodUdp     = "SOCKS_UDP"
+)
+
+// metricsMethods are request methods reported as is, other methods are reported as "OTHER",
+// so clients can't blow up number of series
+var metricsMethods = []string{
+	http.MethodConnect, http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+	http.MethodPatch, http.MethodDelete, http.MethodOptions, http.MethodTrace,
+	socksMethodConnect, socksMethodUdp,
+}
+
+// dialDurationBuckets are upper bounds of the dial latency histogram in seconds
+var dialDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// counterVec is the set of counters with the same label names, values of the labels must come from bounded sets
+type counterVec struct {
+	labels []string
+
+	mu     sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+func newCounterVec(labels ...string) *counterVec {
+	return &counterVec{labels: labels, values: make(map[string]*atomic.Uint64)}
+}
+
+func (c *counterVec) add(n uint64, labelValues ...string) {
+	key := strings.Join(labelValues, "\x00")
+
+	c.mu.RLock()
+	v, ok := c.values[key]
+	c.mu.RUnlock()
+
+	if !ok {
+		c.mu.Lock()
+		if v, ok = c.values[key]; !ok {
+			v = &atomic.Uint64{}
+			c.values[key] = v
+		}
+		c.mu.Unlock()
+	}
+
+	v.Add(n)
+}
+
+func (c *counterVec) write(w io.Writer, name, help string) {
+	writeMetricHeader(w, name, help, "counter")
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	keys := make([]string, 0, len(c.values))
+	for key := range c.values {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		_, _ = fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(c.labels, strings.Split(key, "\x00")), c.values[key].Load())
+	}
+}
+
+// histogram counts observations in the cumulative buckets
+type histogram struct {
+	buckets []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+
+	h.count++
+	h.sum += v
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	writeMetricHeader(w, name, help, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		_, _ = fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+	}
+
+	_, _ = fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	_, _ = fmt.Fprintf(w, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	_, _ = fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+func writeMetricHeader(w io.Writer, name, help, kind string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		sb.WriteString(name)
+		sb.WriteString("=")
+		sb.WriteString(strconv.Quote(values[i]))
+	}
+
+	sb.WriteByte('}')
+
+	return sb.String()
+}
+
+// Metrics collects proxy metrics and exposes them in Prometheus text format, labels never contain client or
+// destination addresses, so number of series stays bounded. Nil metrics collect nothing
+type Metrics struct {
+	requests      *counterVec
+	dialDuration  *histogram
+	dialErrors    *counterVec
+	activeTunnels atomic.Int64
+	tunnelBytes   *counterVec
+	authFailures  *counterVec
+
+	prefixUsage func() []utils.PrefixUsage
+}
+
+// MakeMetrics makes empty metrics
+func MakeMetrics() *Metrics {
+	return &Metrics{
+		requests:     newCounterVec("method", "outcome"),
+		dialDuration: newHistogram(dialDurationBuckets),
+		dialErrors:   newCounterVec("class"),
+		tunnelBytes:  newCounterVec("direction"),
+		authFailures: newCounterVec("protocol"),
+	}
+}
+
+// SetPrefixUsageFunc sets source of the per subnet source IP allocations, e.g. [utils.WeightedAllocator.Usage]
+func (m *Metrics) SetPrefixUsageFunc(usage func() []utils.PrefixUsage) {
+	m.prefixUsage = usage
+}
+
+func (m *Metrics) request(method, outcome string) {
+	if m == nil {
+		return
+	}
+
+	if !slices.Contains(metricsMethods, method) {
+		method = "OTHER"
+	}
+
+	m.requests.add(1, method, outcome)
+}
+
+func (m *Metrics) dialed(d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.dialDuration.observe(d.Seconds())
+}
+
+func (m *Metrics) dialError(class DialErrorClass) {
+	if m == nil {
+		return
+	}
+
+	m.dialErrors.add(1, string(class))
+}
+
+// tunnelStarted counts active tunnel, returned function must be called when tunnel is closed
+func (m *Metrics) tunnelStarted() func() {
+	if m == nil {
+		return func() {}
+	}
+
+	m.activeTunnels.Add(1)
+
+	return func() {
+		m.activeTunnels.Add(-1)
+	}
+}
+
+func (m *Metrics) authFailure(protocol string) {
+	if m == nil {
+		return
+	}
+
+	m.authFailures.add(1, protocol)
+}
+
+// dialOutcome returns request outcome of the failed dial
+func dialOutcome(err error) string {
+	if errors.Is(err, ErrDestinationDenied) {
+		return outcomeDenied
+	}
+
+	return outcomeDialError
+}
+
+// countAuthFailures wraps auth function, so rejected credentials are counted, nil function stays nil
+func (s *Server) countAuthFailures(authFunc AuthCheckFunc, protocol string) AuthCheckFunc {
+	if authFunc == nil || s.metrics == nil {
+		return authFunc
+	}
+
+	return func(usr, passwd string) bool {
+		ok := authFunc(usr, passwd)
+		if !ok {
+			s.metrics.authFailure(protocol)
+		}
+
+		return ok
+	}
+}
+
+// countingWriter counts bytes written to the tunnel side
+type countingWriter struct {
+	io.Writer
+	metrics   *Metrics
+	direction string
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	if n > 0 {
+		w.metrics.tunnelBytes.add(uint64(n), w.direction)
+	}
+
+	return n, err
+}
+
+// countTunnelBytes wraps writer of the tunnel side, direction is "in" (client to destination)
+// or "out" (destination to client)
+func (m *Metrics) countTunnelBytes(w io.Writer, direction string) io.Writer {
+	if m == nil {
+		return w
+	}
+
+	return &countingWriter{Writer: w, metrics: m, direction: direction}
+}
+
+// WriteText writes metrics in Prometheus text format
+func (m *Metrics) WriteText(w io.Writer) {
+	m.requests.write(w, "freebind_proxy_requests_total", "Proxy requests by method and outcome.")
+	m.dialDuration.write(w, "freebind_proxy_dial_duration_seconds", "Time to establish outgoing connection including retries.")
+	m.dialErrors.write(w, "freebind_proxy_dial_errors_total", "Failed dial attempts by error class.")
+
+	writeMetricHeader(w, "freebind_proxy_active_tunnels", "Currently open CONNECT and SOCKS5 tunnels.", "gauge")
+	_, _ = fmt.Fprintf(w, "freebind_proxy_active_tunnels %d\n", m.activeTunnels.Load())
+
+	m.tunnelBytes.write(w, "freebind_proxy_tunnel_bytes_total", "Bytes transferred through tunnels, in is client to destination, out is destination to client.")
+	m.authFailures.write(w, "freebind_proxy_auth_failures_total", "Rejected client credentials by protocol.")
+
+	if m.prefixUsage != nil {
+		usage := m.prefixUsage()
+
+		var total uint64
+		for _, u := range usage {
+			total += u.Allocated
+		}
+
+		writeMetricHeader(w, "freebind_proxy_source_prefix_allocations_total", "Source IPs allocated from the subnet.", "counter")
+		for _, u := range usage {
+			_, _ = fmt.Fprintf(w, "freebind_proxy_source_prefix_allocations_total{prefix=%q} %d\n", u.Prefix.String(), u.Allocated)
+		}
+
+		writeMetricHeader(w, "freebind_proxy_source_prefix_share", "Share of the source IPs allocated from the subnet.", "gauge")
+		for _, u := range usage {
+			share := math.NaN()
+			if total > 0 {
+				share = float64(u.Allocated) / float64(total)
+			}
+
+			_, _ = fmt.Fprintf(w, "freebind_proxy_source_prefix_share{prefix=%q} %s\n", u.Prefix.String(), strconv.FormatFloat(share, 'g', -1, 64))
+		}
+	}
+}
+
+// ServeHTTP serves metrics to Prometheus
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	m.WriteText(w)
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"github.com/codercms/freebind-proxy/utils"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWriteText(t *testing.T) {
+	m := MakeMetrics()
+	m.SetPrefixUsageFunc(func() []utils.PrefixUsage {
+		return []utils.PrefixUsage{
+			{Prefix: netip.MustParsePrefix("2001:db8::/48"), Allocated: 3},
+			{Prefix: netip.MustParsePrefix("2001:db8:1::/48"), Allocated: 1},
+		}
+	})
+
+	m.request(http.MethodGet, outcomeOk)
+	m.request("BREW", outcomeError)
+	m.dialed(30 * time.Millisecond)
+	m.dialError(DialErrRefused)
+
+	var sb strings.Builder
+	m.WriteText(&sb)
+	out := sb.String()
+
+	for _, want := range []string{
+		`freebind_proxy_requests_total{method="GET",outcome="ok"} 1`,
+		`freebind_proxy_requests_total{method="OTHER",outcome="error"} 1`,
+		`freebind_proxy_dial_duration_seconds_bucket{le="0.025"} 0`,
+		`freebind_proxy_dial_duration_seconds_bucket{le="0.05"} 1`,
+		`freebind_proxy_dial_duration_seconds_count 1`,
+		`freebind_proxy_dial_errors_total{class="refused"} 1`,
+		`freebind_proxy_active_tunnels 0`,
+		`freebind_proxy_source_prefix_allocations_total{prefix="2001:db8::/48"} 3`,
+		`freebind_proxy_source_prefix_share{prefix="2001:db8:1::/48"} 0.25`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("Metrics output doesn't contain %q:\n%s", want, out)
+		}
+	}
+
+	// Nil metrics collect nothing
+	var nilMetrics *Metrics
+	nilMetrics.request(http.MethodGet, outcomeOk)
+	nilMetrics.tunnelStarted()()
+}
+
+func TestServerMetrics(t *testing.T) {
+	// Echo server is the tunnel destination
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil),
+		WithListenAddr("127.0.0.1:0"),
+		WithMetricsListenAddr("127.0.0.1:0"),
+		WithAuthFunc(func(usr, passwd string) bool {
+			return usr == "user" && passwd == "pass"
+		}),
+	)
+
+	addrs := startTestServer(t, srv)
+	proxyAddr, metricsAddr := addrs["http"], addrs["metrics"]
+
+	connect := func(credentials string) (net.Conn, *http.Response) {
+		conn, err := net.Dial("tcp4", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+
+		auth := base64.StdEncoding.EncodeToString([]byte(credentials))
+		_, _ = io.WriteString(conn, "CONNECT "+echo.Addr().String()+" HTTP/1.1\r\nHost: "+echo.Addr().String()+"\r\n"+
+			"Proxy-Authorization: Basic "+auth+"\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+
+		return conn, resp
+	}
+
+	conn, resp := connect("user:wrong")
+	_ = conn.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("Status of bad credentials got = %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+	}
+
+	conn, resp = connect("user:pass")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Status got = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatalf("Failed to write to tunnel: %v", err)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatalf("Failed to read from tunnel: %v", err)
+	}
+
+	metricsResp, err := http.Get("http://" + metricsAddr + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to get metrics: %v", err)
+	}
+	body, _ := io.ReadAll(metricsResp.Body)
+	_ = metricsResp.Body.Close()
+	_ = conn.Close()
+
+	for _, want := range []string{
+		`freebind_proxy_requests_total{method="CONNECT",outcome="ok"} 1`,
+		`freebind_proxy_auth_failures_total{protocol="http"} 1`,
+		`freebind_proxy_active_tunnels 1`,
+		`freebind_proxy_tunnel_bytes_total{direction="in"} 4`,
+		`freebind_proxy_tunnel_bytes_total{direction="out"} 4`,
+		`freebind_proxy_dial_duration_seconds_count 1`,
+	} {
+		if !strings.Contains(string(body), want+"\n") {
+			t.Errorf("Metrics output doesn't contain %q:\n%s", want, body)
+		}
+	}
+}
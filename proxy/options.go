@@ -1,6 +1,8 @@
 package proxy
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"go.uber.org/zap"
 	"net/http"
 	"time"
@@ -22,6 +24,32 @@ func WithListenAddr(addr string) *ListenAddrOption {
 	return &ListenAddrOption{addr}
 }
 
+// SocksListenAddrOption enables SOCKS5 server on the specified address
+type SocksListenAddrOption struct {
+	addr string
+}
+
+func (o *SocksListenAddrOption) apply(srv *Server) {
+	srv.socksListenAddr = o.addr
+}
+
+func WithSocksListenAddr(addr string) *SocksListenAddrOption {
+	return &SocksListenAddrOption{addr}
+}
+
+// SocksUdpIdleTimeoutOption sets time after which idle SOCKS5 UDP associations are expired
+type SocksUdpIdleTimeoutOption struct {
+	timeout time.Duration
+}
+
+func (o *SocksUdpIdleTimeoutOption) apply(srv *Server) {
+	srv.socksUdpIdleTimeout = o.timeout
+}
+
+func WithSocksUdpIdleTimeout(timeout time.Duration) *SocksUdpIdleTimeoutOption {
+	return &SocksUdpIdleTimeoutOption{timeout}
+}
+
 type WithLoggerOption struct {
 	logger *zap.Logger
 }
@@ -82,3 +110,223 @@ func (o *WithHttpTransportOption) apply(srv *Server) {
 func WithHttpTransport(transport *http.Transport) *WithHttpTransportOption {
 	return &WithHttpTransportOption{transport}
 }
+
+// DialRetryPolicyOption sets retry policy of the failed dials
+type DialRetryPolicyOption struct {
+	policy DialRetryPolicy
+}
+
+func (o *DialRetryPolicyOption) apply(srv *Server) {
+	srv.dialRetryPolicy = o.policy
+}
+
+func WithDialRetryPolicy(policy DialRetryPolicy) *DialRetryPolicyOption {
+	return &DialRetryPolicyOption{policy}
+}
+
+// SocketOptionsOption sets options of the outgoing sockets, they are passed to the dialer factory
+// which must implement [SocketOptionsSetter]
+type SocketOptionsOption struct {
+	opts SocketOptions
+}
+
+func (o *SocketOptionsOption) apply(srv *Server) {
+	srv.socketOptions = &o.opts
+}
+
+func WithSocketOptions(opts SocketOptions) *SocketOptionsOption {
+	return &SocketOptionsOption{opts}
+}
+
+// TLSConfigOption makes proxy HTTP listener serve over TLS, so clients can use https:// proxy URLs
+// and credentials are not sent in the clear, see [FileCertificate] and [GenerateSelfSignedCertificate]
+type TLSConfigOption struct {
+	config *tls.Config
+}
+
+func (o *TLSConfigOption) apply(srv *Server) {
+	srv.tlsConfig = o.config
+}
+
+func WithTLSConfig(config *tls.Config) *TLSConfigOption {
+	return &TLSConfigOption{config}
+}
+
+// ClientCertAuthOption makes TLS listener (see [WithTLSConfig]) request client certificates signed by clientCAs,
+// verified certificate authenticates client as the user returned by identity (see [CertCommonNameIdentity])
+type ClientCertAuthOption struct {
+	clientCAs *x509.CertPool
+	identity  CertIdentityFunc
+}
+
+func (o *ClientCertAuthOption) apply(srv *Server) {
+	srv.clientCAs = o.clientCAs
+	srv.certIdentity = o.identity
+}
+
+func WithClientCertAuth(clientCAs *x509.CertPool, identity CertIdentityFunc) *ClientCertAuthOption {
+	if identity == nil {
+		identity = CertCommonNameIdentity
+	}
+
+	return &ClientCertAuthOption{clientCAs, identity}
+}
+
+// PolicyFuncOption sets provider of the per user policies, see [UserPolicy]
+type PolicyFuncOption struct {
+	policyFunc PolicyFunc
+}
+
+func (o *PolicyFuncOption) apply(srv *Server) {
+	srv.policyFunc = o.policyFunc
+}
+
+func WithPolicyFunc(policyFunc PolicyFunc) *PolicyFuncOption {
+	return &PolicyFuncOption{policyFunc}
+}
+
+// ClientACLOption restricts which clients may use HTTP and SOCKS5 proxy by their address
+type ClientACLOption struct {
+	acl *ClientACL
+}
+
+func (o *ClientACLOption) apply(srv *Server) {
+	srv.clientACL = o.acl
+}
+
+func WithClientACL(acl *ClientACL) *ClientACLOption {
+	return &ClientACLOption{acl}
+}
+
+// DestinationGuardOption protects from SSRF by denying destinations which resolve to non-public addresses
+// (see [DestinationGuard])
+type DestinationGuardOption struct {
+	guard *DestinationGuard
+}
+
+func (o *DestinationGuardOption) apply(srv *Server) {
+	srv.destGuard = o.guard
+}
+
+func WithDestinationGuard(guard *DestinationGuard) *DestinationGuardOption {
+	return &DestinationGuardOption{guard}
+}
+
+// DestinationCheckFuncOption restricts destinations of all clients, e.g. with [DestinationRulesFile.Check]
+type DestinationCheckFuncOption struct {
+	checkFunc DestinationCheckFunc
+}
+
+func (o *DestinationCheckFuncOption) apply(srv *Server) {
+	srv.destCheckFunc = o.checkFunc
+}
+
+func WithDestinationCheckFunc(checkFunc DestinationCheckFunc) *DestinationCheckFuncOption {
+	return &DestinationCheckFuncOption{checkFunc}
+}
+
+// ResolverOption sets resolver of the destination hosts, e.g. [DNSResolver], resolved addresses are dialed as is
+type ResolverOption struct {
+	resolver Resolver
+}
+
+func (o *ResolverOption) apply(srv *Server) {
+	srv.resolver = o.resolver
+}
+
+func WithResolver(resolver Resolver) *ResolverOption {
+	return &ResolverOption{resolver}
+}
+
+// MetricsOption sets metrics collected by the server, e.g. to expose them on own HTTP server
+type MetricsOption struct {
+	metrics *Metrics
+}
+
+func (o *MetricsOption) apply(srv *Server) {
+	srv.metrics = o.metrics
+}
+
+func WithMetrics(metrics *Metrics) *MetricsOption {
+	return &MetricsOption{metrics}
+}
+
+// MetricsListenAddrOption enables Prometheus metrics listener, metrics are served at /metrics
+type MetricsListenAddrOption struct {
+	addr string
+}
+
+func (o *MetricsListenAddrOption) apply(srv *Server) {
+	srv.metricsListenAddr = o.addr
+}
+
+func WithMetricsListenAddr(addr string) *MetricsListenAddrOption {
+	return &MetricsListenAddrOption{addr}
+}
+
+// AccessLogOption enables access log, record is made per plain HTTP request and per CONNECT tunnel,
+// e.g. with [AccessLog.Log] or [ZapAccessLog]
+type AccessLogOption struct {
+	logFunc AccessLogFunc
+}
+
+func (o *AccessLogOption) apply(srv *Server) {
+	srv.accessLogFunc = o.logFunc
+}
+
+func WithAccessLog(logFunc AccessLogFunc) *AccessLogOption {
+	return &AccessLogOption{logFunc}
+}
+
+// ConnRegistryOption sets registry of the active connections, e.g. to list and terminate them with own API
+type ConnRegistryOption struct {
+	registry *ConnRegistry
+}
+
+func (o *ConnRegistryOption) apply(srv *Server) {
+	srv.connRegistry = o.registry
+}
+
+func WithConnRegistry(registry *ConnRegistry) *ConnRegistryOption {
+	return &ConnRegistryOption{registry}
+}
+
+// AdminListenAddrOption enables admin API listener, see [MakeAdminHandler], token must be set with [WithAdminToken]
+type AdminListenAddrOption struct {
+	addr string
+}
+
+func (o *AdminListenAddrOption) apply(srv *Server) {
+	srv.adminListenAddr = o.addr
+}
+
+func WithAdminListenAddr(addr string) *AdminListenAddrOption {
+	return &AdminListenAddrOption{addr}
+}
+
+// AdminTokenOption sets bearer token of the admin API
+type AdminTokenOption struct {
+	token string
+}
+
+func (o *AdminTokenOption) apply(srv *Server) {
+	srv.adminToken = o.token
+}
+
+func WithAdminToken(token string) *AdminTokenOption {
+	return &AdminTokenOption{token}
+}
+
+// RequestDialerFactoryOption sets factory which provides dialer of every request,
+// it replaces the factory passed to [MakeServer]
+type RequestDialerFactoryOption struct {
+	factory RequestDialerFactoryIface
+}
+
+func (o *RequestDialerFactoryOption) apply(srv *Server) {
+	srv.dFactory = o.factory
+}
+
+func WithRequestDialerFactory(factory RequestDialerFactoryIface) *RequestDialerFactoryOption {
+	return &RequestDialerFactoryOption{factory}
+}
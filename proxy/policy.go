@@ -0,0 +1,480 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrDestinationDenied is returned when destination is not allowed by the user policy
+	ErrDestinationDenied = errors.New("destination is not allowed by policy")
+	// ErrTooManyConns is returned when user reached max number of concurrent connections
+	ErrTooManyConns = errors.New("too many concurrent connections")
+)
+
+// HostPattern matches destination host and port, patterns are:
+//
+//   - "*" matches any host
+//   - "example.com" matches the host exactly (case-insensitive)
+//   - "*.example.com" matches subdomains of example.com
+//   - "10.0.0.0/8", "2001:db8::1" match IP literal destinations in the prefix
+//
+// Pattern can be suffixed with ":<port>" to match only the port, IPv6 must be bracketed then, e.g. "[2001:db8::/32]:443"
+type HostPattern struct {
+	host     string
+	wildcard bool
+	prefix   netip.Prefix
+	port     uint16
+
+	raw string
+}
+
+// ParseHostPattern parses destination pattern, see [HostPattern]
+func ParseHostPattern(s string) (HostPattern, error) {
+	p := HostPattern{raw: s}
+
+	host := strings.TrimSpace(s)
+	if strings.HasPrefix(host, "[") {
+		end := strings.IndexByte(host, ']')
+		if end < 0 {
+			return HostPattern{}, fmt.Errorf("malformed host pattern %q", s)
+		}
+
+		rest := host[end+1:]
+		host = host[1:end]
+
+		if len(rest) > 0 {
+			if rest[0] != ':' {
+				return HostPattern{}, fmt.Errorf("malformed host pattern %q", s)
+			}
+
+			port, err := strconv.ParseUint(rest[1:], 10, 16)
+			if err != nil || port == 0 {
+				return HostPattern{}, fmt.Errorf("bad port of host pattern %q", s)
+			}
+
+			p.port = uint16(port)
+		}
+	} else if strings.Count(host, ":") == 1 {
+		var portStr string
+		host, portStr, _ = strings.Cut(host, ":")
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || port == 0 {
+			return HostPattern{}, fmt.Errorf("bad port of host pattern %q", s)
+		}
+
+		p.port = uint16(port)
+	}
+
+	if len(host) == 0 {
+		return HostPattern{}, fmt.Errorf("empty host pattern %q", s)
+	}
+
+	if prefix, err := netip.ParsePrefix(host); err == nil {
+		p.prefix = prefix.Masked()
+
+		return p, nil
+	}
+
+	if addr, err := netip.ParseAddr(host); err == nil {
+		p.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+
+		return p, nil
+	}
+
+	if host == "*" {
+		p.wildcard = true
+
+		return p, nil
+	}
+
+	if domain, ok := strings.CutPrefix(host, "*."); ok {
+		p.wildcard = true
+		host = domain
+	}
+
+	p.host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	return p, nil
+}
+
+// ParseHostPatterns parses comma separated list of patterns
+func ParseHostPatterns(s string) ([]HostPattern, error) {
+	var patterns []HostPattern
+
+	for _, part := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(part)) == 0 {
+			continue
+		}
+
+		p, err := ParseHostPattern(part)
+		if err != nil {
+			return nil, err
+		}
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+func (p HostPattern) String() string {
+	return p.raw
+}
+
+// Match reports whether destination host:port matches the pattern
+func (p HostPattern) Match(target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		host, portStr = target, ""
+	}
+
+	if p.port != 0 && portStr != strconv.Itoa(int(p.port)) {
+		return false
+	}
+
+	if p.prefix.IsValid() {
+		addr, err := netip.ParseAddr(host)
+
+		return err == nil && p.prefix.Contains(addr.Unmap())
+	}
+
+	if p.wildcard && len(p.host) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	if p.wildcard {
+		return strings.HasSuffix(host, "."+p.host)
+	}
+
+	return host == p.host
+}
+
+// UserPolicy restricts traffic of the proxy user, zero values mean no restriction
+type UserPolicy struct {
+	// Prefixes are source prefixes user traffic may egress from, they may cover configured subnets
+	// or be parts of them (see [utils.RestrictableAllocator])
+	Prefixes []netip.Prefix
+	// Allow are destinations user may connect to, empty list allows any destination
+	Allow []HostPattern
+	// Deny are destinations user must not connect to, they take precedence over Allow
+	Deny []HostPattern
+	// MaxConns limits number of concurrent tunnels and HTTP requests of the user
+	MaxConns int
+	// Bandwidth limits total transfer rate of all user connections in bytes per second (both directions)
+	Bandwidth int64
+}
+
+// PolicyFunc returns policy of the authenticated user, nil means no restrictions.
+// Name of the user whose credentials are not checked (no auth func) can't be trusted,
+// so such users get policy of the anonymous user with empty name
+type PolicyFunc func(usr *ProxyUser) *UserPolicy
+
+// AllowsDestination reports whether user may connect to the destination host:port
+func (p *UserPolicy) AllowsDestination(target string) bool {
+	for _, pattern := range p.Deny {
+		if pattern.Match(target) {
+			return false
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.Allow {
+		if pattern.Match(target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseUserPolicy makes policy from the user attributes (see [Credential.Attrs]):
+//
+//   - prefixes - source prefixes separated by spaces, e.g. "10.0.0.0/24 2001:db8::/48"
+//   - allow, deny - destination patterns separated by spaces (see [HostPattern])
+//   - max_conns - max number of concurrent connections
+//   - bandwidth - transfer rate limit in bytes per second
+//
+// Nil policy is returned when attributes don't restrict anything
+func ParseUserPolicy(attrs map[string]string) (*UserPolicy, error) {
+	p := &UserPolicy{}
+	restricted := false
+
+	if v, ok := attrs["prefixes"]; ok {
+		for _, s := range strings.Fields(v) {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("bad prefix %q: %w", s, err)
+			}
+
+			p.Prefixes = append(p.Prefixes, prefix.Masked())
+			restricted = true
+		}
+	}
+
+	for _, attr := range []struct {
+		name     string
+		patterns *[]HostPattern
+	}{
+		{"allow", &p.Allow},
+		{"deny", &p.Deny},
+	} {
+		for _, s := range strings.Fields(attrs[attr.name]) {
+			pattern, err := ParseHostPattern(s)
+			if err != nil {
+				return nil, err
+			}
+
+			*attr.patterns = append(*attr.patterns, pattern)
+			restricted = true
+		}
+	}
+
+	if v, ok := attrs["max_conns"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad max_conns %q", v)
+		}
+
+		p.MaxConns = n
+		restricted = true
+	}
+
+	if v, ok := attrs["bandwidth"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad bandwidth %q", v)
+		}
+
+		p.Bandwidth = n
+		restricted = true
+	}
+
+	if !restricted {
+		return nil, nil
+	}
+
+	return p, nil
+}
+
+// userState tracks resources used by the user across connections
+type userState struct {
+	conns   int
+	limiter *rateLimiter
+}
+
+// userStates tracks concurrent connections and bandwidth of the users with policies
+type userStates struct {
+	mu     sync.Mutex
+	states map[string]*userState
+}
+
+// state returns state of the user, limiter is updated when policy bandwidth changes
+func (u *userStates) state(name string, policy *UserPolicy) *userState {
+	if u.states == nil {
+		u.states = make(map[string]*userState)
+	}
+
+	state, ok := u.states[name]
+	if !ok {
+		state = &userState{}
+		u.states[name] = state
+	}
+
+	switch {
+	case policy.Bandwidth == 0:
+		state.limiter = nil
+	case state.limiter == nil || state.limiter.rate != float64(policy.Bandwidth):
+		state.limiter = newRateLimiter(policy.Bandwidth)
+	}
+
+	return state
+}
+
+// acquire reserves connection slot of the user, returned release func must be called when connection is closed
+func (u *userStates) acquire(name string, policy *UserPolicy) (release func(), err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	state := u.state(name, policy)
+
+	if policy.MaxConns > 0 && state.conns >= policy.MaxConns {
+		return nil, ErrTooManyConns
+	}
+
+	state.conns++
+
+	return func() {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+
+		state.conns--
+	}, nil
+}
+
+// limiter returns rate limiter shared by all connections of the user, nil means no limit
+func (u *userStates) limiter(name string, policy *UserPolicy) *rateLimiter {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.state(name, policy).limiter
+}
+
+// rateLimiter is a token bucket limiting transfer rate, burst is one second of transfer
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSec),
+		tokens: float64(bytesPerSec),
+		last:   time.Now(),
+	}
+}
+
+// wait takes n tokens and waits until the debt (if any) is repaid
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+
+	now := time.Now()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rateLimitedReader limits rate of reads
+type rateLimitedReader struct {
+	io.Reader
+	ctx     context.Context
+	limiter *rateLimiter
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if waitErr := r.limiter.wait(r.ctx, n); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+
+	return n, err
+}
+
+// rateLimitedConn limits rate of reads from the connection
+type rateLimitedConn struct {
+	net.Conn
+	reader rateLimitedReader
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// limitConnRate wraps connection when limiter is set
+func limitConnRate(ctx context.Context, conn net.Conn, limiter *rateLimiter) net.Conn {
+	if limiter == nil {
+		return conn
+	}
+
+	return &rateLimitedConn{
+		Conn:   conn,
+		reader: rateLimitedReader{Reader: conn, ctx: ctx, limiter: limiter},
+	}
+}
+
+// rateLimitedBody limits rate of reads from the request body
+type rateLimitedBody struct {
+	rateLimitedReader
+	io.Closer
+}
+
+// userPolicy returns policy of the request user, nil means no restrictions.
+// User with unverified name gets policy of the anonymous user, so client can't choose policy by claiming a name
+func (s *Server) userPolicy(ctx context.Context) (*ProxyUser, *UserPolicy) {
+	if s.policyFunc == nil {
+		return nil, nil
+	}
+
+	usr, ok := ProxyUserFromContext(ctx)
+	if !ok {
+		return nil, nil
+	}
+
+	if usr.unverified {
+		usr = &ProxyUser{Params: usr.Params}
+	}
+
+	return usr, s.policyFunc(usr)
+}
+
+// acquireUserConn reserves connection slot of the request user according to its policy,
+// returned limiter (if any) must limit rate of the connection
+func (s *Server) acquireUserConn(ctx context.Context, clientAddr string) (release func(), limiter *rateLimiter, err error) {
+	usr, policy := s.userPolicy(ctx)
+	if policy == nil {
+		return func() {}, nil, nil
+	}
+
+	release, err = s.users.acquire(usr.Name, policy)
+	if err != nil {
+		s.logger.Warn("User connection rejected by policy",
+			zap.String("remote", clientAddr),
+			zap.String("user", usr.Name),
+			zap.Int("maxConns", policy.MaxConns),
+		)
+
+		return nil, nil, err
+	}
+
+	return release, s.users.limiter(usr.Name, policy), nil
+}
+
+// userLimiter returns rate limiter of the request user (if any)
+func (s *Server) userLimiter(ctx context.Context) *rateLimiter {
+	usr, policy := s.userPolicy(ctx)
+	if policy == nil {
+		return nil
+	}
+
+	return s.users.limiter(usr.Name, policy)
+}
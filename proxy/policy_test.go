@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHostPatternMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		target  string
+		want    bool
+	}{
+		{"*", "example.com:443", true},
+		{"example.com", "EXAMPLE.com:80", true},
+		{"example.com", "www.example.com:80", false},
+		{"*.example.com", "www.example.com:443", true},
+		{"*.example.com", "example.com:443", false},
+		{"example.com:443", "example.com:443", true},
+		{"example.com:443", "example.com:80", false},
+		{"10.0.0.0/8", "10.1.2.3:22", true},
+		{"10.0.0.0/8", "11.1.2.3:22", false},
+		{"10.0.0.0/8", "ten.example:22", false},
+		{"2001:db8::1", "[2001:db8::1]:443", true},
+		{"[2001:db8::/32]:443", "[2001:db8::5]:443", true},
+		{"[2001:db8::/32]:443", "[2001:db8::5]:80", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.target, func(t *testing.T) {
+			p, err := ParseHostPattern(tt.pattern)
+			if err != nil {
+				t.Fatalf("ParseHostPattern() error = %v", err)
+			}
+
+			if got := p.Match(tt.target); got != tt.want {
+				t.Errorf("Match() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, bad := range []string{"", "example.com:0", "example.com:http", "[::1"} {
+		if _, err := ParseHostPattern(bad); err == nil {
+			t.Errorf("ParseHostPattern(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParseUserPolicy(t *testing.T) {
+	policy, err := ParseUserPolicy(map[string]string{
+		"prefixes":  "10.0.0.0/24 2001:db8::/48",
+		"allow":     "*.example.com example.com",
+		"deny":      "admin.example.com",
+		"max_conns": "2",
+		"bandwidth": "1024",
+	})
+	if err != nil {
+		t.Fatalf("ParseUserPolicy() error = %v", err)
+	}
+
+	wantPrefixes := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24"), netip.MustParsePrefix("2001:db8::/48")}
+	if !reflect.DeepEqual(policy.Prefixes, wantPrefixes) {
+		t.Errorf("ParseUserPolicy() prefixes got = %v, want %v", policy.Prefixes, wantPrefixes)
+	}
+
+	if policy.MaxConns != 2 || policy.Bandwidth != 1024 {
+		t.Errorf("ParseUserPolicy() limits got = %d conns %d bytes/s, want 2 conns 1024 bytes/s", policy.MaxConns, policy.Bandwidth)
+	}
+
+	for target, want := range map[string]bool{
+		"www.example.com:443":   true,
+		"example.com:80":        true,
+		"admin.example.com:443": false,
+		"example.org:443":       false,
+	} {
+		if got := policy.AllowsDestination(target); got != want {
+			t.Errorf("AllowsDestination(%s) got = %v, want %v", target, got, want)
+		}
+	}
+
+	if policy, err := ParseUserPolicy(map[string]string{"team": "a"}); err != nil || policy != nil {
+		t.Errorf("ParseUserPolicy() of unrelated attributes got = %v, %v, want nil policy", policy, err)
+	}
+
+	if _, err := ParseUserPolicy(map[string]string{"max_conns": "0"}); err == nil {
+		t.Errorf("ParseUserPolicy() of zero max_conns succeeded")
+	}
+}
+
+func TestServerUserPolicy(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	policy, err := ParseUserPolicy(map[string]string{
+		"deny":      "example.com",
+		"max_conns": "1",
+	})
+	if err != nil {
+		t.Fatalf("ParseUserPolicy() error = %v", err)
+	}
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil), WithPolicyFunc(func(usr *ProxyUser) *UserPolicy {
+		if usr.Name == "limited" {
+			return policy
+		}
+
+		return nil
+	}))
+
+	ctx := setCtxProxyUser(context.Background(), &ProxyUser{Name: "limited"})
+
+	if _, err := srv.dial(ctx, DialProtocolConnect, "127.0.0.1:1234", "tcp", "example.com:443"); !errors.Is(err, ErrDestinationDenied) {
+		t.Errorf("dial() to denied destination error = %v, want %v", err, ErrDestinationDenied)
+	}
+
+	conn, err := srv.dial(ctx, DialProtocolConnect, "127.0.0.1:1234", "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial() to allowed destination error = %v", err)
+	}
+	_ = conn.Close()
+
+	release, _, err := srv.acquireUserConn(ctx, "127.0.0.1:1234")
+	if err != nil {
+		t.Fatalf("acquireUserConn() error = %v", err)
+	}
+
+	if _, _, err := srv.acquireUserConn(ctx, "127.0.0.1:1234"); !errors.Is(err, ErrTooManyConns) {
+		t.Errorf("acquireUserConn() over limit error = %v, want %v", err, ErrTooManyConns)
+	}
+
+	// Other users are not limited
+	otherCtx := setCtxProxyUser(context.Background(), &ProxyUser{Name: "other"})
+	if _, _, err := srv.acquireUserConn(otherCtx, "127.0.0.1:1234"); err != nil {
+		t.Errorf("acquireUserConn() of unrestricted user error = %v", err)
+	}
+
+	release()
+
+	if _, _, err := srv.acquireUserConn(ctx, "127.0.0.1:1234"); err != nil {
+		t.Errorf("acquireUserConn() after release error = %v", err)
+	}
+}
+
+func TestServerUserPolicyPrefixes(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	sources := make(chan netip.Addr, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			sources <- conn.RemoteAddr().(*net.TCPAddr).AddrPort().Addr().Unmap()
+			_ = conn.Close()
+		}
+	}()
+
+	// Allowed prefix is a part of the subnet
+	allowed := netip.MustParsePrefix("127.0.5.0/24")
+	policy := &UserPolicy{Prefixes: []netip.Prefix{allowed}}
+
+	factory := MakeRandIpDialerFactory(rand.New(rand.NewPCG(1, 2)), netip.MustParsePrefix("127.0.0.0/16"))
+
+	srv := MakeServer(factory,
+		WithListenAddr("127.0.0.1:0"),
+		WithAuthFunc(func(usr, passwd string) bool {
+			return passwd == "pass"
+		}),
+		WithPolicyFunc(func(usr *ProxyUser) *UserPolicy {
+			if usr.Name == "limited" {
+				return policy
+			}
+
+			return nil
+		}),
+	)
+
+	proxyAddr := startTestServer(t, srv)["http"]
+
+	auth := base64.StdEncoding.EncodeToString([]byte("limited:pass"))
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp4", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+
+		_, _ = io.WriteString(conn, "CONNECT "+listener.Addr().String()+" HTTP/1.1\r\nHost: "+listener.Addr().String()+"\r\n"+
+			"Proxy-Authorization: Basic "+auth+"\r\n\r\n")
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		_ = conn.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT failed: %v, %v", resp, err)
+		}
+
+		select {
+		case src := <-sources:
+			if !allowed.Contains(src) {
+				t.Errorf("Source IP got = %v, want IP of %s", src, allowed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Connection is not accepted")
+		}
+	}
+}
+
+// staticTestAlloc provides the same address and can't be restricted
+type staticTestAlloc struct {
+	addr netip.Addr
+}
+
+func (a staticTestAlloc) NextAddr() netip.Addr {
+	return a.addr
+}
+
+func TestServerUserPolicyPrefixesNotSupported(t *testing.T) {
+	factory := MakeAllocIpDialerFactory(staticTestAlloc{netip.MustParseAddr("127.0.0.1")})
+
+	srv := MakeServer(factory,
+		WithListenAddr("127.0.0.1:0"),
+		WithPolicyFunc(func(usr *ProxyUser) *UserPolicy {
+			return nil
+		}),
+	)
+
+	if err := srv.Run(context.Background()); !errors.Is(err, ErrPrefixesNotSupported) {
+		t.Errorf("Run() error = %v, want %v", err, ErrPrefixesNotSupported)
+	}
+}
+
+func TestServerUserPolicyUnverifiedName(t *testing.T) {
+	anonymous := &UserPolicy{MaxConns: 1}
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil), WithPolicyFunc(func(usr *ProxyUser) *UserPolicy {
+		if len(usr.Name) == 0 {
+			return anonymous
+		}
+
+		return nil
+	}))
+
+	var gotUsr *ProxyUser
+	var gotPolicy *UserPolicy
+	handler := MakeProxyAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUsr, gotPolicy = srv.userPolicy(r.Context())
+	}), srv.authFunc)
+
+	// Credentials are not checked, so claimed name must not choose the policy
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.SetBasicAuth("vip-session-abc", "any")
+	r.Header.Set("Proxy-Authorization", r.Header.Get("Authorization"))
+
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+
+	if gotPolicy != anonymous {
+		t.Errorf("userPolicy() got = %+v, want policy of the anonymous user", gotPolicy)
+	}
+
+	if gotUsr == nil || len(gotUsr.Name) > 0 || gotUsr.Session() != "abc" {
+		t.Errorf("userPolicy() user got = %+v, want anonymous user with session abc", gotUsr)
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codercms/freebind-proxy/route"
+	"github.com/codercms/freebind-proxy/utils"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// Preflight check names
+const (
+	PreflightCheckRoute   = "route"
+	PreflightCheckBind    = "bind"
+	PreflightCheckConnect = "connect"
+)
+
+// PreflightConfig configures startup self-test, see [Preflight]
+type PreflightConfig struct {
+	// Samples is the number of addresses checked per prefix, default is 3
+	Samples int
+	// ConnectTimeout limits time of the loopback connect check, default is 2 seconds
+	ConnectTimeout time.Duration
+	// FreebindMode is the socket option used to bind sampled addresses, it should match the dialer factory mode
+	FreebindMode FreebindMode
+}
+
+// PreflightError describes failed preflight check of the sampled address with the hint how to fix it
+type PreflightError struct {
+	Check  string
+	Prefix netip.Prefix
+	Addr   netip.Addr
+	Err    error
+	Hint   string
+}
+
+func (e *PreflightError) Error() string {
+	return fmt.Sprintf("%s check failed for %s (subnet %s): %v, %s", e.Check, e.Addr, e.Prefix, e.Err, e.Hint)
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+var errNoLocalRoute = errors.New("address is not routed locally")
+
+// Preflight verifies that freebind actually works for the prefixes: kernel has local route covering sampled addresses,
+// sampled addresses can be bound with freebind socket option and connection from them to the loopback listener succeeds.
+// All failed checks are returned joined (see [errors.Join]) as [PreflightError]
+func Preflight(ctx context.Context, prefixes []netip.Prefix, cfg PreflightConfig) error {
+	if cfg.Samples < 1 {
+		cfg.Samples = 3
+	}
+	if cfg.ConnectTimeout < 1 {
+		cfg.ConnectTimeout = 2 * time.Second
+	}
+
+	randReader := rand.New(utils.NewCryptoSource())
+
+	var errs []error
+	for _, prefix := range prefixes {
+		prefix = prefix.Masked()
+
+		for i := 0; i < cfg.Samples; i++ {
+			addr := utils.GetRandomIpFromPrefix(randReader, prefix)
+
+			if err := preflightAddr(ctx, addr, &cfg); err != nil {
+				err.Prefix = prefix
+				errs = append(errs, err)
+
+				// Other samples of the prefix most likely fail the same way
+				break
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func preflightAddr(ctx context.Context, addr netip.Addr, cfg *PreflightConfig) *PreflightError {
+	isLocal, err := route.IsLocalAddr(addr)
+	if err == nil && !isLocal {
+		err = errNoLocalRoute
+	}
+	if err != nil {
+		return &PreflightError{
+			Check: PreflightCheckRoute,
+			Addr:  addr,
+			Err:   err,
+			Hint:  "add AnyIP route, e.g. \"ip route add local <subnet> dev lo\" or run with -add-route",
+		}
+	}
+
+	lc := net.ListenConfig{Control: makeFreebindControl(cfg.FreebindMode, nil)}
+
+	bindListener, err := lc.Listen(ctx, "tcp", netip.AddrPortFrom(addr, 0).String())
+	if err != nil {
+		return &PreflightError{
+			Check: PreflightCheckBind,
+			Addr:  addr,
+			Err:   err,
+			Hint:  fmt.Sprintf("check that kernel supports %s mode socket option and the process is allowed to set it", cfg.FreebindMode),
+		}
+	}
+	_ = bindListener.Close()
+
+	loopback := "127.0.0.1:0"
+	if addr.Is6() {
+		loopback = "[::1]:0"
+	}
+
+	listener, err := net.Listen("tcp", loopback)
+	if err != nil {
+		return &PreflightError{
+			Check: PreflightCheckConnect,
+			Addr:  addr,
+			Err:   err,
+			Hint:  "loopback interface must be configured for the subnet address family",
+		}
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			_ = conn.Close()
+		}
+	}()
+
+	dialer := net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: addr.AsSlice()},
+		Control:   makeFreebindControl(cfg.FreebindMode, nil),
+		Timeout:   cfg.ConnectTimeout,
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", listener.Addr().String())
+	if err != nil {
+		return &PreflightError{
+			Check: PreflightCheckConnect,
+			Addr:  addr,
+			Err:   err,
+			Hint:  "replies to the subnet addresses are not delivered to the host, check AnyIP route and firewall",
+		}
+	}
+	_ = conn.Close()
+
+	return nil
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	err := Preflight(context.Background(), []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}, PreflightConfig{})
+	if err != nil {
+		t.Fatalf("Preflight() of loopback subnet error = %v", err)
+	}
+
+	err = Preflight(context.Background(), []netip.Prefix{
+		netip.MustParsePrefix("127.0.0.0/8"),
+		netip.MustParsePrefix("192.0.2.0/24"),
+	}, PreflightConfig{})
+
+	var preflightErr *PreflightError
+	if !errors.As(err, &preflightErr) {
+		t.Fatalf("Preflight() of not routed subnet error = %v, want %T", err, preflightErr)
+	}
+
+	if preflightErr.Check != PreflightCheckRoute || preflightErr.Prefix != netip.MustParsePrefix("192.0.2.0/24") {
+		t.Errorf("Preflight() error = %v, want route check failure of 192.0.2.0/24", preflightErr)
+	}
+}
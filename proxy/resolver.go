@@ -0,0 +1,634 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver resolves destination hosts, [net.Resolver] and [DNSResolver] implement it
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// lookupNetIP resolves host with the configured resolver, IP literals are returned as is
+func (s *Server) lookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	if s.resolver != nil {
+		return s.resolver.LookupNetIP(ctx, network, host)
+	}
+
+	return net.DefaultResolver.LookupNetIP(ctx, network, host)
+}
+
+// DNSUpstream is the upstream DNS server
+type DNSUpstream struct {
+	// Proto is "udp" (truncated responses are retried over TCP), "tcp", "tls" (DNS-over-TLS) or "https" (DNS-over-HTTPS)
+	Proto string
+	// Addr is the server host:port, URL of the "https" server
+	Addr string
+	// TLSConfig is used by "tls" and "https" servers, nil means system roots and server name of the Addr
+	TLSConfig *tls.Config
+}
+
+// ParseDNSUpstream parses upstream server, formats are:
+//
+//   - "1.1.1.1", "udp://1.1.1.1:53" - plain DNS over UDP
+//   - "tcp://1.1.1.1" - plain DNS over TCP
+//   - "tls://1.1.1.1#cloudflare-dns.com" - DNS-over-TLS, server name to verify certificate against follows "#"
+//   - "https://dns.google/dns-query" - DNS-over-HTTPS
+func ParseDNSUpstream(s string) (DNSUpstream, error) {
+	proto, addr, ok := strings.Cut(strings.TrimSpace(s), "://")
+	if !ok {
+		proto, addr = "udp", proto
+	}
+
+	if proto == "https" {
+		if _, err := url.Parse(s); err != nil {
+			return DNSUpstream{}, err
+		}
+
+		return DNSUpstream{Proto: proto, Addr: s}, nil
+	}
+
+	var defaultPort string
+	switch proto {
+	case "udp", "tcp":
+		defaultPort = "53"
+	case "tls":
+		defaultPort = "853"
+	default:
+		return DNSUpstream{}, fmt.Errorf("unknown DNS upstream protocol %q", proto)
+	}
+
+	u := DNSUpstream{Proto: proto}
+
+	addr, serverName, _ := strings.Cut(addr, "#")
+	if len(serverName) > 0 {
+		if proto != "tls" {
+			return DNSUpstream{}, fmt.Errorf("server name is supported by tls upstreams only: %q", s)
+		}
+
+		u.TLSConfig = &tls.Config{ServerName: serverName}
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+	}
+
+	if _, _, err := net.SplitHostPort(addr); err != nil || len(addr) == 0 {
+		return DNSUpstream{}, fmt.Errorf("malformed DNS upstream %q", s)
+	}
+
+	u.Addr = addr
+
+	return u, nil
+}
+
+func (u DNSUpstream) String() string {
+	if u.Proto == "https" {
+		return u.Addr
+	}
+
+	return u.Proto + "://" + u.Addr
+}
+
+// tlsConfig returns TLS config of the upstream with server name defaulting to the host of the address
+func (u DNSUpstream) tlsConfig() *tls.Config {
+	var cfg *tls.Config
+	if u.TLSConfig != nil {
+		cfg = u.TLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+
+	if len(cfg.ServerName) == 0 && u.Proto == "tls" {
+		cfg.ServerName, _, _ = net.SplitHostPort(u.Addr)
+	}
+
+	return cfg
+}
+
+var errDNSServerFailure = errors.New("DNS server failure")
+
+type dnsCacheKey struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type dnsCacheEntry struct {
+	addrs     []netip.Addr
+	expiresAt time.Time
+}
+
+// DNSResolver resolves hosts with the upstream servers, answers are cached according to their TTL,
+// NXDOMAIN and empty answers are cached as well (negative caching).
+// Zero value has no cache and no query timeout, [MakeDNSResolver] makes resolver with default limits
+type DNSResolver struct {
+	// Upstreams are queried in order until one of them answers, no upstreams means system resolver (no caching then)
+	Upstreams []DNSUpstream
+	// Hosts are static overrides of the host addresses, names are lower case without trailing dot
+	Hosts map[string][]netip.Addr
+	// Dialer provides dialers of the queries (see [DialProtocolDNS]), e.g. freebind dialer factory,
+	// so queries egress from the subnet addresses, nil means default dialer
+	Dialer RequestDialerFactoryIface
+	// Timeout limits time of the single upstream query
+	Timeout time.Duration
+	// CacheSize is the max number of cached answers, 0 disables cache
+	CacheSize int
+	// MaxTTL caps TTL of the cached answers
+	MaxTTL time.Duration
+	// NegativeTTL is TTL of the negative answers without SOA record
+	NegativeTTL time.Duration
+
+	mu          sync.Mutex
+	cache       map[dnsCacheKey]*dnsCacheEntry
+	httpClients map[string]*http.Client
+
+	now func() time.Time
+}
+
+// MakeDNSResolver makes resolver of the upstreams with default limits
+func MakeDNSResolver(upstreams ...DNSUpstream) *DNSResolver {
+	return &DNSResolver{
+		Upstreams:   upstreams,
+		Timeout:     5 * time.Second,
+		CacheSize:   4096,
+		MaxTTL:      time.Hour,
+		NegativeTTL: 30 * time.Second,
+	}
+}
+
+// timeNow returns current time of the cache, now func is replaced by tests
+func (r *DNSResolver) timeNow() time.Time {
+	if r.now != nil {
+		return r.now()
+	}
+
+	return time.Now()
+}
+
+// LookupNetIP looks up host addresses, network is "ip", "ip4" or "ip6"
+func (r *DNSResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var qtypes []dnsmessage.Type
+	switch network {
+	case "ip":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	case "ip4":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeA}
+	case "ip6":
+		qtypes = []dnsmessage.Type{dnsmessage.TypeAAAA}
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	if static, ok := r.Hosts[name]; ok {
+		var addrs []netip.Addr
+		for _, addr := range static {
+			if (addr.Unmap().Is4() && network != "ip6") || (!addr.Unmap().Is4() && network != "ip4") {
+				addrs = append(addrs, addr)
+			}
+		}
+
+		if len(addrs) == 0 {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+
+		return addrs, nil
+	}
+
+	if len(r.Upstreams) == 0 {
+		return net.DefaultResolver.LookupNetIP(ctx, network, host)
+	}
+
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+
+	results := make([]result, len(qtypes))
+
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			results[i].addrs, results[i].err = r.lookup(ctx, name, qtype)
+		}()
+	}
+	wg.Wait()
+
+	var addrs []netip.Addr
+	var errs []error
+	for _, res := range results {
+		if res.err != nil {
+			errs = append(errs, res.err)
+		}
+
+		addrs = append(addrs, res.addrs...)
+	}
+
+	if len(addrs) > 0 {
+		return addrs, nil
+	}
+
+	if len(errs) > 0 {
+		// Both queries usually fail the same way
+		return nil, &net.DNSError{Err: errs[0].Error(), Name: host, IsTemporary: true}
+	}
+
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+// lookup returns cached answer or queries upstreams, empty answer means host has no addresses of the type
+func (r *DNSResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]netip.Addr, error) {
+	key := dnsCacheKey{name: name, qtype: qtype}
+
+	r.mu.Lock()
+	entry, ok := r.cache[key]
+	r.mu.Unlock()
+
+	if ok && r.timeNow().Before(entry.expiresAt) {
+		return entry.addrs, nil
+	}
+
+	addrs, ttl, err := r.query(ctx, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	r.store(key, &dnsCacheEntry{addrs: addrs, expiresAt: r.timeNow().Add(min(ttl, r.MaxTTL))})
+
+	return addrs, nil
+}
+
+func (r *DNSResolver) store(key dnsCacheKey, entry *dnsCacheEntry) {
+	if r.CacheSize <= 0 || !entry.expiresAt.After(r.timeNow()) {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cache == nil {
+		r.cache = make(map[dnsCacheKey]*dnsCacheEntry)
+	}
+
+	if len(r.cache) >= r.CacheSize {
+		now := r.timeNow()
+		for k, e := range r.cache {
+			if !now.Before(e.expiresAt) {
+				delete(r.cache, k)
+			}
+		}
+
+		// Still full of live entries
+		if len(r.cache) >= r.CacheSize {
+			clear(r.cache)
+		}
+	}
+
+	r.cache[key] = entry
+}
+
+// query asks upstreams in order until one of them answers
+func (r *DNSResolver) query(ctx context.Context, name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var errs []error
+
+	for _, upstream := range r.Upstreams {
+		id := uint16(rand.Uint32())
+		if upstream.Proto == "https" {
+			// RFC 8484 recommends zero ID, so responses are cache friendly
+			id = 0
+		}
+
+		msg, err := buildDNSQuery(id, qname, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		queryCtx, cancel := ctx, context.CancelFunc(func() {})
+		if r.Timeout > 0 {
+			queryCtx, cancel = context.WithTimeout(ctx, r.Timeout)
+		}
+
+		resp, err := r.exchange(queryCtx, upstream, msg)
+		cancel()
+
+		if err == nil {
+			var addrs []netip.Addr
+			var ttl time.Duration
+
+			addrs, ttl, err = r.parseResponse(resp, id, qname, qtype)
+			if err == nil {
+				return addrs, ttl, nil
+			}
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", upstream, err))
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return nil, 0, errors.Join(errs...)
+}
+
+func buildDNSQuery(id uint16, name dnsmessage.Name, qtype dnsmessage.Type) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+
+	return b.Finish()
+}
+
+var errDNSQuestionMismatch = errors.New("DNS response question doesn't match the query")
+
+// parseResponse returns addresses of the answer and its TTL, NXDOMAIN and NODATA answers have no addresses.
+// Response must repeat the query question, so answer to another query can't be cached under the query name
+func (r *DNSResolver) parseResponse(resp []byte, id uint16, qname dnsmessage.Name, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	var p dnsmessage.Parser
+
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !h.Response || h.ID != id {
+		return nil, 0, errors.New("unexpected DNS response")
+	}
+
+	if h.RCode != dnsmessage.RCodeSuccess && h.RCode != dnsmessage.RCodeNameError {
+		return nil, 0, fmt.Errorf("%w: %s", errDNSServerFailure, h.RCode)
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(questions) != 1 || questions[0].Type != qtype || questions[0].Class != dnsmessage.ClassINET ||
+		!strings.EqualFold(questions[0].Name.String(), qname.String()) {
+		return nil, 0, errDNSQuestionMismatch
+	}
+
+	var addrs []netip.Addr
+	ttl := r.MaxTTL
+
+	for {
+		ah, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// CNAME chain is followed by the upstream, its records are in the same answer
+		switch {
+		case ah.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			res, err := p.AResource()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			addrs = append(addrs, netip.AddrFrom4(res.A))
+		case ah.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			res, err := p.AAAAResource()
+			if err != nil {
+				return nil, 0, err
+			}
+
+			addrs = append(addrs, netip.AddrFrom16(res.AAAA))
+		default:
+			if err := p.SkipAnswer(); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		ttl = min(ttl, time.Duration(ah.TTL)*time.Second)
+	}
+
+	if len(addrs) > 0 {
+		return addrs, ttl, nil
+	}
+
+	// Negative answer TTL is the min of SOA TTL and its MINIMUM field (RFC 2308)
+	ttl = r.NegativeTTL
+	for {
+		ah, err := p.AuthorityHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if ah.Type != dnsmessage.TypeSOA {
+			if err := p.SkipAuthority(); err != nil {
+				return nil, 0, err
+			}
+
+			continue
+		}
+
+		soa, err := p.SOAResource()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		ttl = time.Duration(min(ah.TTL, soa.MinTTL)) * time.Second
+	}
+
+	return nil, ttl, nil
+}
+
+// exchange sends query to the upstream and returns response
+func (r *DNSResolver) exchange(ctx context.Context, upstream DNSUpstream, msg []byte) ([]byte, error) {
+	switch upstream.Proto {
+	case "udp":
+		resp, err := r.exchangeUDP(ctx, upstream.Addr, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		var p dnsmessage.Parser
+		if h, err := p.Start(resp); err == nil && h.Truncated {
+			return r.exchangeStream(ctx, upstream, msg)
+		}
+
+		return resp, nil
+	case "tcp", "tls":
+		return r.exchangeStream(ctx, upstream, msg)
+	case "https":
+		return r.exchangeHTTPS(ctx, upstream, msg)
+	default:
+		return nil, fmt.Errorf("unknown DNS upstream protocol %q", upstream.Proto)
+	}
+}
+
+func (r *DNSResolver) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{}
+	if r.Dialer != nil {
+		var err error
+		dialer, err = r.Dialer.GetRequestDialer(ctx, &DialRequest{Target: addr, Protocol: DialProtocolDNS})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dialer.DialContext(ctx, network, addr)
+}
+
+func (r *DNSResolver) exchangeUDP(ctx context.Context, addr string, msg []byte) ([]byte, error) {
+	conn, err := r.dial(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+
+		// Ignore stray responses, e.g. late answers to the previous queries
+		if n >= 2 && bytes.Equal(buf[:2], msg[:2]) {
+			return buf[:n], nil
+		}
+	}
+}
+
+// exchangeStream exchanges length prefixed messages over TCP or TLS
+func (r *DNSResolver) exchangeStream(ctx context.Context, upstream DNSUpstream, msg []byte) ([]byte, error) {
+	conn, err := r.dial(ctx, "tcp", upstream.Addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if upstream.Proto == "tls" {
+		tlsConn := tls.Client(conn, upstream.tlsConfig())
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return nil, err
+		}
+
+		conn = tlsConn
+	}
+
+	req := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(req, uint16(len(msg)))
+	copy(req[2:], msg)
+
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+func (r *DNSResolver) exchangeHTTPS(ctx context.Context, upstream DNSUpstream, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.Addr, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := r.httpClient(upstream).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS server responded with status %s", resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+// httpClient returns client of the DNS-over-HTTPS upstream, connections are kept alive between queries
+func (r *DNSResolver) httpClient(upstream DNSUpstream) *http.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	client, ok := r.httpClients[upstream.Addr]
+	if !ok {
+		client = &http.Client{
+			Transport: &http.Transport{
+				DialContext:       r.dial,
+				TLSClientConfig:   upstream.tlsConfig(),
+				ForceAttemptHTTP2: true,
+				IdleConnTimeout:   90 * time.Second,
+			},
+		}
+
+		if r.httpClients == nil {
+			r.httpClients = make(map[string]*http.Client)
+		}
+		r.httpClients[upstream.Addr] = client
+	}
+
+	return client
+}
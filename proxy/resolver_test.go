@@ -0,0 +1,450 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubDNSServer answers A and AAAA queries from the records, it serves UDP and TCP on the same port
+type stubDNSServer struct {
+	records map[string][]netip.Addr
+	// truncated names are answered over UDP with TC flag set
+	truncated map[string]bool
+
+	queries atomic.Int32
+	addr    string
+}
+
+func startStubDNSServer(t *testing.T, records map[string][]netip.Addr, truncated map[string]bool) *stubDNSServer {
+	srv := &stubDNSServer{records: records, truncated: truncated}
+
+	var tcpListener net.Listener
+	var udpConn net.PacketConn
+	for i := 0; i < 10 && udpConn == nil; i++ {
+		l, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+
+		if udpConn, err = net.ListenPacket("udp4", l.Addr().String()); err != nil {
+			_ = l.Close()
+			continue
+		}
+
+		tcpListener = l
+	}
+	if udpConn == nil {
+		t.Fatalf("Failed to listen UDP and TCP on the same port")
+	}
+
+	t.Cleanup(func() {
+		_ = tcpListener.Close()
+		_ = udpConn.Close()
+	})
+
+	srv.addr = tcpListener.Addr().String()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := udpConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			_, _ = udpConn.WriteTo(srv.answer(buf[:n], true), addr)
+		}
+	}()
+
+	go func() {
+		for {
+			conn, err := tcpListener.Accept()
+			if err != nil {
+				return
+			}
+
+			go srv.serveStream(conn)
+		}
+	}()
+
+	return srv
+}
+
+func (srv *stubDNSServer) serveStream(conn net.Conn) {
+	defer conn.Close()
+
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return
+	}
+
+	resp := srv.answer(msg, false)
+
+	binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+	_, _ = conn.Write(append(size[:], resp...))
+}
+
+func (srv *stubDNSServer) answer(msg []byte, udp bool) []byte {
+	srv.queries.Add(1)
+
+	var p dnsmessage.Parser
+
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	name := q.Name.String()
+	name = name[:len(name)-1]
+
+	addrs, ok := srv.records[name]
+
+	respHeader := dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true}
+	if !ok {
+		respHeader.RCode = dnsmessage.RCodeNameError
+	}
+	if udp && srv.truncated[name] {
+		respHeader.Truncated = true
+		addrs = nil
+	}
+
+	b := dnsmessage.NewBuilder(nil, respHeader)
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, addr := range addrs {
+		switch {
+		case q.Type == dnsmessage.TypeA && addr.Is4():
+			_ = b.AResource(rh, dnsmessage.AResource{A: addr.As4()})
+		case q.Type == dnsmessage.TypeAAAA && addr.Is6():
+			_ = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+	}
+
+	if !ok {
+		_ = b.StartAuthorities()
+		_ = b.SOAResource(
+			dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("example.com."), Class: dnsmessage.ClassINET, TTL: 300},
+			dnsmessage.SOAResource{NS: dnsmessage.MustNewName("ns.example.com."), MBox: dnsmessage.MustNewName("admin.example.com."), MinTTL: 10},
+		)
+	}
+
+	resp, _ := b.Finish()
+
+	return resp
+}
+
+func TestDNSResolverCache(t *testing.T) {
+	stub := startStubDNSServer(t, map[string][]netip.Addr{
+		"www.example.com": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+		"big.example.com": {netip.MustParseAddr("192.0.2.2")},
+	}, map[string]bool{"big.example.com": true})
+
+	upstream, err := ParseDNSUpstream(stub.addr)
+	if err != nil {
+		t.Fatalf("ParseDNSUpstream() error = %v", err)
+	}
+
+	var dnsDials atomic.Int32
+
+	resolver := MakeDNSResolver(upstream)
+	resolver.Dialer = DialerFactoryFunc(func(ctx context.Context, req *DialRequest) (*net.Dialer, error) {
+		if req.Protocol == DialProtocolDNS {
+			dnsDials.Add(1)
+		}
+
+		return &net.Dialer{}, nil
+	})
+
+	now := time.Now()
+	resolver.now = func() time.Time {
+		return now
+	}
+
+	ctx := context.Background()
+
+	addrs, err := resolver.LookupNetIP(ctx, "ip", "WWW.example.com.")
+	if err != nil {
+		t.Fatalf("LookupNetIP() error = %v", err)
+	}
+
+	want := []netip.Addr{netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")}
+	if !reflect.DeepEqual(addrs, want) {
+		t.Errorf("LookupNetIP() got = %v, want %v", addrs, want)
+	}
+
+	if dnsDials.Load() != 2 {
+		t.Errorf("Queries dialed with dialer factory got = %d, want 2", dnsDials.Load())
+	}
+
+	if addrs, err := resolver.LookupNetIP(ctx, "ip6", "www.example.com"); err != nil || !reflect.DeepEqual(addrs, want[1:]) {
+		t.Errorf("LookupNetIP() of ip6 got = %v, %v, want %v", addrs, err, want[1:])
+	}
+
+	if stub.queries.Load() != 2 {
+		t.Errorf("Queries after cached lookup got = %d, want 2", stub.queries.Load())
+	}
+
+	// Negative answer is cached for the SOA minimum TTL
+	for i := 0; i < 2; i++ {
+		_, err = resolver.LookupNetIP(ctx, "ip4", "missing.example.com")
+
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Errorf("LookupNetIP() of missing host error = %v, want not found", err)
+		}
+	}
+
+	if stub.queries.Load() != 3 {
+		t.Errorf("Queries after negative lookups got = %d, want 3", stub.queries.Load())
+	}
+
+	// Expired answers are queried again
+	now = now.Add(2 * time.Minute)
+
+	if _, err := resolver.LookupNetIP(ctx, "ip4", "www.example.com"); err != nil {
+		t.Fatalf("LookupNetIP() error = %v", err)
+	}
+
+	if stub.queries.Load() != 4 {
+		t.Errorf("Queries after TTL expiration got = %d, want 4", stub.queries.Load())
+	}
+
+	// Truncated UDP answer is retried over TCP
+	addrs, err = resolver.LookupNetIP(ctx, "ip4", "big.example.com")
+	if err != nil || !reflect.DeepEqual(addrs, []netip.Addr{netip.MustParseAddr("192.0.2.2")}) {
+		t.Errorf("LookupNetIP() of truncated answer got = %v, %v", addrs, err)
+	}
+}
+
+func TestDNSResolverZeroValue(t *testing.T) {
+	stub := startStubDNSServer(t, map[string][]netip.Addr{
+		"www.example.com": {netip.MustParseAddr("192.0.2.1")},
+	}, nil)
+
+	resolver := &DNSResolver{
+		Upstreams: []DNSUpstream{{Proto: "udp", Addr: stub.addr}},
+		CacheSize: 10,
+		MaxTTL:    time.Hour,
+	}
+
+	for i := 0; i < 2; i++ {
+		addrs, err := resolver.LookupNetIP(context.Background(), "ip4", "www.example.com")
+		if err != nil || !reflect.DeepEqual(addrs, []netip.Addr{netip.MustParseAddr("192.0.2.1")}) {
+			t.Fatalf("LookupNetIP() got = %v, %v", addrs, err)
+		}
+	}
+
+	if stub.queries.Load() != 1 {
+		t.Errorf("Queries after cached lookup got = %d, want 1", stub.queries.Load())
+	}
+
+	if client := resolver.httpClient(DNSUpstream{Proto: "https", Addr: "https://dns.example/dns-query"}); client == nil {
+		t.Errorf("httpClient() got nil client")
+	}
+}
+
+func TestDNSResolverQuestionMismatch(t *testing.T) {
+	qname := dnsmessage.MustNewName("www.example.com.")
+
+	response := func(q dnsmessage.Question) []byte {
+		b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, Response: true})
+		_ = b.StartQuestions()
+		_ = b.Question(q)
+		_ = b.StartAnswers()
+		_ = b.AResource(
+			dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+			dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		)
+
+		resp, _ := b.Finish()
+
+		return resp
+	}
+
+	resolver := MakeDNSResolver()
+
+	tests := []struct {
+		name     string
+		question dnsmessage.Question
+		wantErr  bool
+	}{
+		{"same question", dnsmessage.Question{Name: dnsmessage.MustNewName("WWW.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}, false},
+		{"other name", dnsmessage.Question{Name: dnsmessage.MustNewName("evil.example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}, true},
+		{"other type", dnsmessage.Question{Name: qname, Type: dnsmessage.TypeAAAA, Class: dnsmessage.ClassINET}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := resolver.parseResponse(response(tt.question), 1, qname, dnsmessage.TypeA)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseResponse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil && !errors.Is(err, errDNSQuestionMismatch) {
+				t.Errorf("parseResponse() error = %v, want %v", err, errDNSQuestionMismatch)
+			}
+		})
+	}
+}
+
+func TestDNSResolverHosts(t *testing.T) {
+	resolver := MakeDNSResolver(DNSUpstream{Proto: "udp", Addr: "192.0.2.53:53"})
+	resolver.Hosts = map[string][]netip.Addr{
+		"internal.example": {netip.MustParseAddr("10.0.0.1")},
+	}
+
+	addrs, err := resolver.LookupNetIP(context.Background(), "ip", "Internal.Example")
+	if err != nil || !reflect.DeepEqual(addrs, []netip.Addr{netip.MustParseAddr("10.0.0.1")}) {
+		t.Errorf("LookupNetIP() of static host got = %v, %v", addrs, err)
+	}
+
+	if _, err := resolver.LookupNetIP(context.Background(), "ip6", "internal.example"); err == nil {
+		t.Errorf("LookupNetIP() of static host without IPv6 addresses succeeded")
+	}
+}
+
+func TestDNSResolverEncrypted(t *testing.T) {
+	stub := startStubDNSServer(t, map[string][]netip.Addr{
+		"www.example.com": {netip.MustParseAddr("192.0.2.1")},
+	}, nil)
+
+	cert, err := GenerateSelfSignedCertificate("127.0.0.1")
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCertificate() error = %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	tlsListener, err := tls.Listen("tcp4", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer tlsListener.Close()
+
+	go func() {
+		for {
+			conn, err := tlsListener.Accept()
+			if err != nil {
+				return
+			}
+
+			go stub.serveStream(conn)
+		}
+	}()
+
+	dohServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+
+		msg, _ := io.ReadAll(r.Body)
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(stub.answer(msg, false))
+	}))
+	defer dohServer.Close()
+
+	dohRoots := x509.NewCertPool()
+	dohRoots.AddCert(dohServer.Certificate())
+
+	upstreams := []DNSUpstream{
+		{Proto: "tls", Addr: tlsListener.Addr().String(), TLSConfig: &tls.Config{RootCAs: roots}},
+		{Proto: "https", Addr: dohServer.URL + "/dns-query", TLSConfig: &tls.Config{RootCAs: dohRoots}},
+	}
+	for _, upstream := range upstreams {
+		t.Run(upstream.Proto, func(t *testing.T) {
+			resolver := MakeDNSResolver(upstream)
+
+			addrs, err := resolver.LookupNetIP(context.Background(), "ip4", "www.example.com")
+			if err != nil || !reflect.DeepEqual(addrs, []netip.Addr{netip.MustParseAddr("192.0.2.1")}) {
+				t.Errorf("LookupNetIP() got = %v, %v", addrs, err)
+			}
+		})
+	}
+}
+
+func TestParseDNSUpstream(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"1.1.1.1", "udp://1.1.1.1:53"},
+		{"tcp://[2606:4700:4700::1111]", "tcp://[2606:4700:4700::1111]:53"},
+		{"tls://1.1.1.1#cloudflare-dns.com", "tls://1.1.1.1:853"},
+		{"https://dns.google/dns-query", "https://dns.google/dns-query"},
+	}
+	for _, tt := range tests {
+		u, err := ParseDNSUpstream(tt.s)
+		if err != nil {
+			t.Errorf("ParseDNSUpstream(%q) error = %v", tt.s, err)
+			continue
+		}
+
+		if u.String() != tt.want {
+			t.Errorf("ParseDNSUpstream(%q) got = %s, want %s", tt.s, u, tt.want)
+		}
+	}
+
+	if u, _ := ParseDNSUpstream("tls://1.1.1.1#cloudflare-dns.com"); u.tlsConfig().ServerName != "cloudflare-dns.com" {
+		t.Errorf("ParseDNSUpstream() server name got = %q, want cloudflare-dns.com", u.tlsConfig().ServerName)
+	}
+
+	for _, bad := range []string{"quic://1.1.1.1", "udp://1.1.1.1#name"} {
+		if _, err := ParseDNSUpstream(bad); err == nil {
+			t.Errorf("ParseDNSUpstream(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestServerResolver(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	resolver := MakeDNSResolver()
+	resolver.Hosts = map[string][]netip.Addr{"target.test": {netip.MustParseAddr("127.0.0.1")}}
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil), WithResolver(resolver))
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	conn, err := srv.dial(context.Background(), DialProtocolConnect, "127.0.0.1:1234", "tcp", net.JoinHostPort("target.test", port))
+	if err != nil {
+		t.Fatalf("dial() error = %v", err)
+	}
+	_ = conn.Close()
+}
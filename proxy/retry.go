@@ -0,0 +1,384 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// proxyStatusName identifies the proxy in Proxy-Status header
+const proxyStatusName = "freebind-proxy"
+
+// DialErrorClass is a class of the dial error used to decide whether dial should be retried
+type DialErrorClass string
+
+const (
+	// DialErrAddrNotAvail means source address can't be bound, e.g. it's not routed to the host (EADDRNOTAVAIL)
+	DialErrAddrNotAvail DialErrorClass = "addr-not-avail"
+	// DialErrRefused means destination refused connection, e.g. source IP is banned
+	DialErrRefused DialErrorClass = "refused"
+	// DialErrReset means connection was reset by the destination or a middlebox
+	DialErrReset DialErrorClass = "reset"
+	// DialErrTimeout means dial attempt timed out
+	DialErrTimeout DialErrorClass = "timeout"
+	// DialErrUnreachable means destination network or host is unreachable
+	DialErrUnreachable DialErrorClass = "unreachable"
+	// DialErrOther is any other error, e.g. DNS resolution failure
+	DialErrOther DialErrorClass = "other"
+)
+
+var dialErrorClasses = []DialErrorClass{
+	DialErrAddrNotAvail,
+	DialErrRefused,
+	DialErrReset,
+	DialErrTimeout,
+	DialErrUnreachable,
+	DialErrOther,
+}
+
+// ParseDialErrorClasses parses comma separated list of error classes, e.g. "refused,timeout"
+func ParseDialErrorClasses(s string) ([]DialErrorClass, error) {
+	var classes []DialErrorClass
+
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+
+		class := DialErrorClass(name)
+		if !slices.Contains(dialErrorClasses, class) {
+			return nil, fmt.Errorf("unknown dial error class %q", name)
+		}
+
+		classes = append(classes, class)
+	}
+
+	return classes, nil
+}
+
+// ClassifyDialError returns class of the dial error
+func ClassifyDialError(err error) DialErrorClass {
+	switch {
+	case errors.Is(err, syscall.EADDRNOTAVAIL), errors.Is(err, syscall.EADDRINUSE):
+		return DialErrAddrNotAvail
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return DialErrRefused
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.ECONNABORTED):
+		return DialErrReset
+	case errors.Is(err, syscall.ENETUNREACH), errors.Is(err, syscall.EHOSTUNREACH):
+		return DialErrUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return DialErrTimeout
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return DialErrTimeout
+	}
+
+	return DialErrOther
+}
+
+// DialRetryPolicy configures retries of the failed dials, each attempt gets fresh dialer from the dialer factory,
+// so it's made from another source IP (see [DialRequest.Attempt])
+type DialRetryPolicy struct {
+	// Attempts is the max number of dial attempts including the first one, values below 2 disable retries
+	Attempts int
+	// Budget limits total time of all attempts, 0 means no limit
+	Budget time.Duration
+	// AttemptTimeout limits time of the single attempt, 0 means no limit
+	AttemptTimeout time.Duration
+	// Retryable are classes of errors which are retried
+	Retryable []DialErrorClass
+}
+
+// DefaultDialRetryPolicy is a policy with retries disabled
+var DefaultDialRetryPolicy = DialRetryPolicy{
+	Attempts: 1,
+}
+
+func (p *DialRetryPolicy) isRetryable(err error) bool {
+	return slices.Contains(p.Retryable, ClassifyDialError(err))
+}
+
+// dialSources records source addresses sockets of the dialer were bound to
+type dialSources struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (s *dialSources) add(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !slices.Contains(s.addrs, addr) {
+		s.addrs = append(s.addrs, addr)
+	}
+}
+
+func (s *dialSources) list() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.addrs)
+}
+
+// recordDialSources returns copy of the dialer which records source addresses of the dialed sockets
+func recordDialSources(d *net.Dialer) (*net.Dialer, *dialSources) {
+	sources := &dialSources{}
+
+	if d.LocalAddr != nil {
+		sources.add(d.LocalAddr.String())
+
+		return d, sources
+	}
+
+	control, controlCtx := d.Control, d.ControlContext
+
+	wrapped := *d
+	wrapped.Control = nil
+	wrapped.ControlContext = func(ctx context.Context, network, address string, c syscall.RawConn) error {
+		var err error
+		if controlCtx != nil {
+			err = controlCtx(ctx, network, address, c)
+		} else if control != nil {
+			err = control(network, address, c)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Socket is already bound when control function binds it itself
+		_ = c.Control(func(fd uintptr) {
+			sa, err := syscall.Getsockname(int(fd))
+			if err != nil {
+				return
+			}
+
+			var addr netip.Addr
+			switch sa := sa.(type) {
+			case *syscall.SockaddrInet4:
+				addr = netip.AddrFrom4(sa.Addr)
+			case *syscall.SockaddrInet6:
+				addr = netip.AddrFrom16(sa.Addr)
+			}
+
+			if addr.IsValid() && !addr.IsUnspecified() {
+				sources.add(addr.String())
+			}
+		})
+
+		return nil
+	}
+
+	return &wrapped, sources
+}
+
+// dial dials the target with dialer provided by the dialer factory, failed attempts are retried according to
+// the retry policy, every failed attempt is logged with the source IP it was made from
+func (s *Server) dial(ctx context.Context, protocol DialProtocol, clientAddr, network, target string) (net.Conn, error) {
+	policy := &s.dialRetryPolicy
+
+	if policy.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, policy.Budget)
+		defer cancel()
+	}
+
+	attempts := max(policy.Attempts, 1)
+	start := time.Now()
+
+	if s.destCheckFunc != nil {
+		if err := s.destCheckFunc(protocol, target); err != nil {
+			s.logger.Warn("Destination denied by rules",
+				zap.String("host", target),
+				zap.String("remote", clientAddr),
+				zap.String("protocol", protocol.String()),
+				zap.Error(err),
+			)
+
+			return nil, err
+		}
+	}
+
+	usr, usrPolicy := s.userPolicy(ctx)
+	if usrPolicy != nil && !usrPolicy.AllowsDestination(target) {
+		s.logger.Warn("Destination denied by user policy",
+			zap.String("host", target),
+			zap.String("remote", clientAddr),
+			zap.String("user", usr.Name),
+		)
+
+		return nil, ErrDestinationDenied
+	}
+
+	resolved, err := s.resolveTarget(ctx, network, target)
+	if err != nil {
+		var deniedErr *DestinationDeniedError
+		if errors.As(err, &deniedErr) {
+			s.logger.Warn("Destination denied",
+				zap.String("host", target),
+				zap.String("remote", clientAddr),
+				zap.String("addr", deniedErr.Addr.String()),
+				zap.String("reason", deniedErr.Reason),
+			)
+		} else {
+			s.logger.Warn("Failed to resolve host",
+				zap.String("host", target),
+				zap.String("remote", clientAddr),
+				zap.Error(err),
+			)
+		}
+
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		req := s.makeDialRequest(ctx, protocol, clientAddr, target)
+		req.Attempt = attempt
+		if usrPolicy != nil {
+			req.Prefixes = usrPolicy.Prefixes
+		}
+
+		dialer, err := s.dFactory.GetRequestDialer(ctx, req)
+		if err != nil {
+			s.logger.Warn("Failed to get dialer",
+				zap.String("host", target),
+				zap.String("remote", clientAddr),
+				zap.Error(err),
+			)
+
+			return nil, err
+		}
+
+		dialer, sources := recordDialSources(dialer)
+
+		attemptCtx, attemptCancel := ctx, context.CancelFunc(func() {})
+		if policy.AttemptTimeout > 0 {
+			attemptCtx, attemptCancel = context.WithTimeout(ctx, policy.AttemptTimeout)
+		}
+
+		var conn net.Conn
+		if resolved != nil {
+			// Dial exactly the resolved addresses, so dialer can't re-resolve host to the denied one
+			conn, err = dialAddrs(attemptCtx, dialer, network, resolved)
+		} else {
+			conn, err = dialer.DialContext(attemptCtx, network, target)
+		}
+		attemptCancel()
+
+		if err == nil {
+			s.logSelectedIp(clientAddr, conn)
+			s.metrics.dialed(time.Since(start))
+
+			return conn, nil
+		}
+
+		s.metrics.dialError(ClassifyDialError(err))
+
+		var sockOptErr *SockOptError
+		if errors.As(err, &sockOptErr) {
+			// Misconfigured host or missing capabilities, other source IPs fail the same way
+			s.logger.Error("Failed to set socket option",
+				zap.String("host", target),
+				zap.String("remote", clientAddr),
+				zap.String("option", sockOptErr.Opt),
+				zap.Error(sockOptErr.Err),
+			)
+
+			return nil, err
+		}
+
+		retry := attempt+1 < attempts && ctx.Err() == nil && policy.isRetryable(err)
+
+		s.logger.Warn("Failed to dial host",
+			zap.String("host", target),
+			zap.String("remote", clientAddr),
+			zap.Strings("dialerIp", sources.list()),
+			zap.Int("attempt", attempt+1),
+			zap.String("errClass", string(ClassifyDialError(err))),
+			zap.Bool("retry", retry),
+			zap.Error(err),
+		)
+
+		if !retry {
+			return nil, err
+		}
+	}
+}
+
+// dialErrorStatus returns HTTP status reported to the client for the failed dial,
+// local socket setup failures are reported as internal errors, destinations denied by policy as forbidden,
+// other errors get the fallback status
+func dialErrorStatus(err error, fallback int) int {
+	var sockOptErr *SockOptError
+	if errors.As(err, &sockOptErr) {
+		return http.StatusInternalServerError
+	}
+
+	if errors.Is(err, ErrDestinationDenied) {
+		return http.StatusForbidden
+	}
+
+	return fallback
+}
+
+// dialErrorMessage returns message reported to the client for the failed dial,
+// denied destinations are reported with the reason
+func dialErrorMessage(err error, fallback string) string {
+	var deniedErr *DestinationDeniedError
+	if errors.As(err, &deniedErr) {
+		return "Forbidden: " + deniedErr.Error()
+	}
+
+	var ruleErr *DestinationRuleError
+	if errors.As(err, &ruleErr) {
+		return "Forbidden: " + ruleErr.Error()
+	}
+
+	if errors.Is(err, ErrDestinationDenied) {
+		return "Forbidden: destination is denied by user policy"
+	}
+
+	return fallback
+}
+
+// proxyStatus returns Proxy-Status header value (RFC 9209) explaining why destination was denied,
+// empty string is returned for other errors
+func proxyStatus(err error) string {
+	if !errors.Is(err, ErrDestinationDenied) {
+		return ""
+	}
+
+	errType := "http_request_denied"
+
+	var deniedErr *DestinationDeniedError
+	if errors.As(err, &deniedErr) {
+		errType = "destination_ip_prohibited"
+	}
+
+	details := strings.TrimPrefix(dialErrorMessage(err, ""), "Forbidden: ")
+
+	return fmt.Sprintf("%s; error=%s; details=%s", proxyStatusName, errType, strconv.Quote(details))
+}
+
+// writeDialError responds to the client with the failed dial error
+func writeDialError(w http.ResponseWriter, err error, msg string, fallbackStatus int) {
+	if status := proxyStatus(err); len(status) > 0 {
+		w.Header().Set("Proxy-Status", status)
+	}
+
+	http.Error(w, dialErrorMessage(err, msg), dialErrorStatus(err, fallbackStatus))
+}
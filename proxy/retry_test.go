@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyDialError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want DialErrorClass
+	}{
+		{"bind", fmt.Errorf("bind 10.0.0.1: %w", syscall.EADDRNOTAVAIL), DialErrAddrNotAvail},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, DialErrRefused},
+		{"reset", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNRESET)}, DialErrReset},
+		{"unreachable", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, DialErrUnreachable},
+		{"timeout", &net.OpError{Op: "dial", Err: os.ErrDeadlineExceeded}, DialErrTimeout},
+		{"dns", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, DialErrOther},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyDialError(tt.err); got != tt.want {
+				t.Errorf("ClassifyDialError() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDialErrorClasses(t *testing.T) {
+	got, err := ParseDialErrorClasses("refused, timeout,")
+	if err != nil {
+		t.Fatalf("ParseDialErrorClasses() error = %v", err)
+	}
+
+	if want := []DialErrorClass{DialErrRefused, DialErrTimeout}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseDialErrorClasses() got = %v, want %v", got, want)
+	}
+
+	if _, err := ParseDialErrorClasses("refused,banned"); err == nil {
+		t.Errorf("ParseDialErrorClasses() of the unknown class succeeded")
+	}
+}
+
+func TestServerDialRetry(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	var attempts []int
+
+	// The first attempt fails as if source IP was not routed to the host
+	factory := DialerFactoryFunc(func(ctx context.Context, req *DialRequest) (*net.Dialer, error) {
+		attempts = append(attempts, req.Attempt)
+
+		if req.Attempt == 0 {
+			return &net.Dialer{
+				Control: func(network, address string, c syscall.RawConn) error {
+					return fmt.Errorf("bind 10.0.0.1: %w", syscall.EADDRNOTAVAIL)
+				},
+			}, nil
+		}
+
+		return &net.Dialer{}, nil
+	})
+
+	tests := []struct {
+		name         string
+		policy       DialRetryPolicy
+		wantErr      bool
+		wantAttempts []int
+	}{
+		{"no retries", DefaultDialRetryPolicy, true, []int{0}},
+		{"not retryable", DialRetryPolicy{Attempts: 3, Retryable: []DialErrorClass{DialErrRefused}}, true, []int{0}},
+		{"retryable", DialRetryPolicy{Attempts: 3, Retryable: []DialErrorClass{DialErrAddrNotAvail}}, false, []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts = nil
+
+			srv := MakeServer(factory, WithDialRetryPolicy(tt.policy))
+
+			conn, err := srv.dial(context.Background(), DialProtocolConnect, "127.0.0.1:1234", "tcp", listener.Addr().String())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("dial() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if err != nil && !errors.Is(err, syscall.EADDRNOTAVAIL) {
+				t.Errorf("dial() error = %v, want %v", err, syscall.EADDRNOTAVAIL)
+			}
+
+			if conn != nil {
+				_ = conn.Close()
+			}
+
+			if !reflect.DeepEqual(attempts, tt.wantAttempts) {
+				t.Errorf("dial() attempts got = %v, want %v", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
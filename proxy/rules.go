@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DestinationCheckFunc checks destination host:port requested by the client protocol, error of the denied
+// destination must match [ErrDestinationDenied]
+type DestinationCheckFunc func(protocol DialProtocol, target string) error
+
+// DestinationRuleError is returned when destination is denied by the rules
+type DestinationRuleError struct {
+	Target string
+	Reason string
+}
+
+func (e *DestinationRuleError) Error() string {
+	return fmt.Sprintf("destination %s is %s", e.Target, e.Reason)
+}
+
+// Is makes denied destination match [ErrDestinationDenied]
+func (e *DestinationRuleError) Is(target error) bool {
+	return target == ErrDestinationDenied
+}
+
+// PortRange is the inclusive range of ports
+type PortRange struct {
+	From, To uint16
+}
+
+// ParsePortRanges parses comma separated list of ports and port ranges, e.g. "443,8000-8999"
+func ParsePortRanges(s string) ([]PortRange, error) {
+	var ranges []PortRange
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+
+		fromStr, toStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			toStr = fromStr
+		}
+
+		from, err := strconv.ParseUint(strings.TrimSpace(fromStr), 10, 16)
+		if err != nil || from == 0 {
+			return nil, fmt.Errorf("bad port %q", part)
+		}
+
+		to, err := strconv.ParseUint(strings.TrimSpace(toStr), 10, 16)
+		if err != nil || to < from {
+			return nil, fmt.Errorf("bad port range %q", part)
+		}
+
+		ranges = append(ranges, PortRange{From: uint16(from), To: uint16(to)})
+	}
+
+	return ranges, nil
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// DestinationRules restrict destinations of all clients, deny rules take precedence over allow rules
+type DestinationRules struct {
+	// Allow are destinations which may be requested, empty list allows any destination
+	Allow []HostPattern
+	// Deny are destinations which must not be requested
+	Deny []HostPattern
+	// ConnectPorts are ports which may be tunnelled (HTTP CONNECT and SOCKS5), empty list allows any port
+	ConnectPorts []PortRange
+}
+
+// ReadDestinationRules reads rules, one rule per line:
+//
+//	# comment
+//	allow *.example.com, example.com
+//	deny admin.example.com
+//	deny 10.0.0.0/8
+//	connect-ports 443, 8000-8999
+//
+// See [HostPattern] for the format of the destination patterns
+func ReadDestinationRules(r io.Reader) (*DestinationRules, error) {
+	rules := &DestinationRules{}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		kind, value, _ := strings.Cut(line, " ")
+
+		var err error
+		switch kind {
+		case "allow", "deny":
+			var patterns []HostPattern
+			if patterns, err = ParseHostPatterns(value); err == nil && len(patterns) == 0 {
+				err = fmt.Errorf("no destinations")
+			}
+
+			if kind == "allow" {
+				rules.Allow = append(rules.Allow, patterns...)
+			} else {
+				rules.Deny = append(rules.Deny, patterns...)
+			}
+		case "connect-ports":
+			var ports []PortRange
+			if ports, err = ParsePortRanges(value); err == nil && len(ports) == 0 {
+				err = fmt.Errorf("no ports")
+			}
+
+			rules.ConnectPorts = append(rules.ConnectPorts, ports...)
+		default:
+			err = fmt.Errorf("unknown rule %q", kind)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// Check checks destination against the rules, it can be used as [DestinationCheckFunc]
+func (r *DestinationRules) Check(protocol DialProtocol, target string) error {
+	for _, p := range r.Deny {
+		if p.Match(target) {
+			return &DestinationRuleError{Target: target, Reason: fmt.Sprintf("denied by rule %q", p.String())}
+		}
+	}
+
+	if len(r.Allow) > 0 && !matchAny(r.Allow, target) {
+		return &DestinationRuleError{Target: target, Reason: "not allowed by rules"}
+	}
+
+	if len(r.ConnectPorts) > 0 && (protocol == DialProtocolConnect || protocol == DialProtocolSocks || protocol == DialProtocolSocksUdp) {
+		_, portStr, err := net.SplitHostPort(target)
+		if err != nil {
+			return &DestinationRuleError{Target: target, Reason: "missing port"}
+		}
+
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil || !r.allowsConnectPort(uint16(port)) {
+			return &DestinationRuleError{Target: target, Reason: fmt.Sprintf("port %s is not allowed for tunnels", portStr)}
+		}
+	}
+
+	return nil
+}
+
+func (r *DestinationRules) allowsConnectPort(port uint16) bool {
+	for _, pr := range r.ConnectPorts {
+		if pr.Contains(port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchAny(patterns []HostPattern, target string) bool {
+	for _, p := range patterns {
+		if p.Match(target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// DestinationRulesFile is the rules file (see [ReadDestinationRules]) which can be reloaded without restart
+type DestinationRulesFile struct {
+	file configFile
+
+	mu    sync.RWMutex
+	rules *DestinationRules
+}
+
+// LoadDestinationRulesFile loads rules from the file
+func LoadDestinationRulesFile(path string) (*DestinationRulesFile, error) {
+	f := &DestinationRulesFile{}
+	f.file = configFile{path: path, name: "rules", load: f.load}
+
+	if err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *DestinationRulesFile) load(r io.Reader) error {
+	rules, err := ReadDestinationRules(r)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rules = rules
+
+	return nil
+}
+
+// Reload reads rules file again, previous rules are kept on error
+func (f *DestinationRulesFile) Reload() error {
+	return f.file.Reload()
+}
+
+// Rules returns currently loaded rules
+func (f *DestinationRulesFile) Rules() *DestinationRules {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	return f.rules
+}
+
+// Check checks destination against currently loaded rules, it can be used as [DestinationCheckFunc]
+func (f *DestinationRulesFile) Check(protocol DialProtocol, target string) error {
+	return f.Rules().Check(protocol, target)
+}
+
+// WatchChanges reloads rules file when its modification time changes, it blocks until ctx is done
+func (f *DestinationRulesFile) WatchChanges(ctx context.Context, interval time.Duration, logger *zap.Logger) {
+	f.file.WatchChanges(ctx, interval, logger)
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadDestinationRules(t *testing.T) {
+	rules, err := ReadDestinationRules(strings.NewReader(`
+# Only example.com and its subdomains
+allow *.example.com, example.com
+allow 192.0.2.0/24
+deny admin.example.com
+connect-ports 443, 8000-8999
+`))
+	if err != nil {
+		t.Fatalf("ReadDestinationRules() error = %v", err)
+	}
+
+	tests := []struct {
+		protocol DialProtocol
+		target   string
+		want     bool
+	}{
+		{DialProtocolConnect, "www.example.com:443", true},
+		{DialProtocolConnect, "example.com:8080", true},
+		{DialProtocolConnect, "example.com:25", false},
+		{DialProtocolSocks, "example.com:25", false},
+		{DialProtocolHttp, "example.com:25", true},
+		{DialProtocolHttp, "admin.example.com:80", false},
+		{DialProtocolHttp, "example.org:80", false},
+		{DialProtocolConnect, "192.0.2.10:443", true},
+		{DialProtocolConnect, "198.51.100.1:443", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.protocol.String()+" "+tt.target, func(t *testing.T) {
+			err := rules.Check(tt.protocol, tt.target)
+			if got := err == nil; got != tt.want {
+				t.Errorf("Check() error = %v, want allowed %v", err, tt.want)
+			}
+
+			if err != nil && !errors.Is(err, ErrDestinationDenied) {
+				t.Errorf("Check() error doesn't match %v", ErrDestinationDenied)
+			}
+		})
+	}
+
+	for _, bad := range []string{"permit example.com", "allow", "connect-ports 0", "connect-ports 10-5", "deny [::1"} {
+		if _, err := ReadDestinationRules(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadDestinationRules(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestDestinationRulesFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+
+	if err := os.WriteFile(path, []byte("deny example.com\n"), 0600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+
+	rulesFile, err := LoadDestinationRulesFile(path)
+	if err != nil {
+		t.Fatalf("LoadDestinationRulesFile() error = %v", err)
+	}
+
+	if err := rulesFile.Check(DialProtocolHttp, "example.com:80"); err == nil {
+		t.Errorf("Check() of denied destination succeeded")
+	}
+
+	if err := os.WriteFile(path, []byte("deny example.org\n"), 0600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+
+	if err := rulesFile.Reload(); err != nil {
+		t.Fatalf("Reload() error = %v", err)
+	}
+
+	if err := rulesFile.Check(DialProtocolHttp, "example.com:80"); err != nil {
+		t.Errorf("Check() after reload error = %v", err)
+	}
+
+	// Broken file keeps previous rules
+	if err := os.WriteFile(path, []byte("permit example.com\n"), 0600); err != nil {
+		t.Fatalf("Failed to write rules: %v", err)
+	}
+
+	if err := rulesFile.Reload(); err == nil {
+		t.Errorf("Reload() of broken file succeeded")
+	}
+
+	if err := rulesFile.Check(DialProtocolHttp, "example.org:80"); err == nil {
+		t.Errorf("Check() of denied destination succeeded after failed reload")
+	}
+}
+
+func TestServerDestinationRules(t *testing.T) {
+	rules, err := ReadDestinationRules(strings.NewReader("deny *.internal\nconnect-ports 443\n"))
+	if err != nil {
+		t.Fatalf("ReadDestinationRules() error = %v", err)
+	}
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil),
+		WithListenAddr("127.0.0.1:0"),
+		WithDestinationCheckFunc(rules.Check),
+	)
+
+	proxyAddr := startTestServer(t, srv)["http"]
+
+	requests := []string{
+		"CONNECT smtp.example.com:25 HTTP/1.1\r\nHost: smtp.example.com:25\r\n\r\n",
+		"GET http://db.internal/ HTTP/1.1\r\nHost: db.internal\r\n\r\n",
+	}
+	for _, req := range requests {
+		conn, err := net.Dial("tcp4", proxyAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to proxy: %v", err)
+		}
+
+		if _, err := conn.Write([]byte(req)); err != nil {
+			t.Fatalf("Failed to write request: %v", err)
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+		_ = resp.Body.Close()
+		_ = conn.Close()
+
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Status got = %d, want %d", resp.StatusCode, http.StatusForbidden)
+		}
+
+		if status := resp.Header.Get("Proxy-Status"); !strings.Contains(status, "error=http_request_denied") {
+			t.Errorf("Proxy-Status got = %q, want http_request_denied error", status)
+		}
+	}
+}
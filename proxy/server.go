@@ -2,13 +2,17 @@ package proxy
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"go.uber.org/zap"
 	"io"
+	"maps"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"strings"
 	"time"
 )
@@ -16,7 +20,7 @@ import (
 type AuthCheckFunc func(usr, passwd string) bool
 
 type Server struct {
-	dFactory DialerFactoryIface
+	dFactory RequestDialerFactoryIface
 
 	authFunc AuthCheckFunc
 
@@ -24,6 +28,10 @@ type Server struct {
 
 	listenAddr string
 
+	socksListenAddr string
+
+	socksUdpIdleTimeout time.Duration
+
 	gracefulShutdownTimeout time.Duration
 
 	logger *zap.Logger
@@ -31,19 +39,74 @@ type Server struct {
 	srvCtx context.Context
 
 	baseHttpTransport *http.Transport
+
+	dialRetryPolicy DialRetryPolicy
+
+	socketOptions *SocketOptions
+
+	tlsConfig *tls.Config
+
+	clientCAs    *x509.CertPool
+	certIdentity CertIdentityFunc
+
+	policyFunc PolicyFunc
+	users      userStates
+
+	clientACL *ClientACL
+	rejectLog rateLimitedLog
+
+	destGuard     *DestinationGuard
+	destCheckFunc DestinationCheckFunc
+
+	resolver Resolver
+
+	metrics           *Metrics
+	metricsListenAddr string
+
+	accessLogFunc AccessLogFunc
+
+	connRegistry    *ConnRegistry
+	adminListenAddr string
+	adminToken      string
+
+	// ready is closed when listeners are bound, addrs are their addresses
+	ready chan struct{}
+	addrs map[string]net.Addr
 }
 
+// MakeServer makes proxy server which dials destinations with dialers of the factory,
+// factory may be nil when [WithRequestDialerFactory] option is used
 func MakeServer(dFactory DialerFactoryIface, options ...Option) *Server {
-	srv := &Server{dFactory: dFactory}
+	srv := &Server{
+		dialRetryPolicy: DefaultDialRetryPolicy,
+		rejectLog:       rateLimitedLog{interval: time.Second},
+		ready:           make(chan struct{}),
+	}
+
+	if dFactory != nil {
+		srv.dFactory = requestDialerFactory(dFactory)
+	}
 
 	for _, option := range options {
 		option.apply(srv)
 	}
 
+	if len(srv.metricsListenAddr) > 0 && srv.metrics == nil {
+		srv.metrics = MakeMetrics()
+	}
+
+	if len(srv.adminListenAddr) > 0 && srv.connRegistry == nil {
+		srv.connRegistry = MakeConnRegistry()
+	}
+
 	if srv.gracefulShutdownTimeout < 1 {
 		srv.gracefulShutdownTimeout = 5 * time.Second
 	}
 
+	if srv.socksUdpIdleTimeout < 1 {
+		srv.socksUdpIdleTimeout = 2 * time.Minute
+	}
+
 	if len(srv.listenAddr) == 0 {
 		srv.listenAddr = ":8080"
 	}
@@ -59,6 +122,14 @@ func MakeServer(dFactory DialerFactoryIface, options ...Option) *Server {
 		srv.baseHttpTransport = http.DefaultTransport.(*http.Transport)
 	}
 
+	if srv.socketOptions != nil {
+		if setter, ok := srv.dFactory.(SocketOptionsSetter); ok {
+			setter.SetSocketOptions(srv.socketOptions)
+		} else {
+			srv.logger.Warn("Dialer factory does not support socket options, they are ignored")
+		}
+	}
+
 	return srv
 }
 
@@ -71,9 +142,11 @@ func (s *Server) configureHttpServer() {
 		}
 	})
 
-	if s.authFunc != nil {
-		httpHandler = MakeProxyAuthMiddleware(httpHandler, s.authFunc)
-	}
+	httpHandler = MakeProxyCertAuthMiddleware(httpHandler, s.countAuthFailures(s.authFunc, "http"), s.certIdentity)
+	// ACL is checked before credentials
+	httpHandler = s.makeClientACLMiddleware(httpHandler)
+	// Rejected clients and credentials are logged too
+	httpHandler = s.makeAccessLogMiddleware(httpHandler)
 
 	s.httpSrv.Addr = s.listenAddr
 	s.httpSrv.Handler = httpHandler
@@ -102,28 +175,126 @@ func (s *Server) configureHttpServer() {
 	}
 }
 
-// Run starts proxy HTTP server
+// Run starts proxy HTTP server and SOCKS5 server (if SOCKS5 listen address is set)
 func (s *Server) Run(ctx context.Context) error {
+	// Policies are loaded lazily, so factory which can't apply their source prefixes is rejected upfront
+	if supporter, ok := s.dFactory.(prefixesSupporter); ok && s.policyFunc != nil && !supporter.supportsPrefixes() {
+		return fmt.Errorf("user policies require source prefixes support: %w", ErrPrefixesNotSupported)
+	}
+
 	listener, err := net.Listen("tcp", s.listenAddr)
 	if err != nil {
 		return fmt.Errorf("failed to bind HTTP server addr: %w", err)
 	}
 
-	s.logger.Info("Listening on address", zap.String("addr", listener.Addr().String()))
+	if s.clientCAs != nil && s.tlsConfig == nil {
+		_ = listener.Close()
+
+		return errors.New("client certificate authentication requires TLS listener")
+	}
+
+	if s.tlsConfig != nil {
+		tlsConfig := proxyTLSConfig(s.tlsConfig)
+
+		if s.clientCAs != nil {
+			tlsConfig.ClientCAs = s.clientCAs
+			// Clients without certificate may still authenticate with credentials
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	s.logger.Info("Listening on address", zap.String("addr", listener.Addr().String()), zap.Bool("tls", s.tlsConfig != nil))
+
+	listenAddrs := map[string]net.Addr{"http": listener.Addr()}
+
+	var socksSrv *socksServer
+	if len(s.socksListenAddr) > 0 {
+		socksListener, err := net.Listen("tcp", s.socksListenAddr)
+		if err != nil {
+			_ = listener.Close()
+
+			return fmt.Errorf("failed to bind SOCKS5 server addr: %w", err)
+		}
+
+		s.logger.Info("Listening on SOCKS5 address", zap.String("addr", socksListener.Addr().String()))
+
+		listenAddrs["socks5"] = socksListener.Addr()
+
+		socksSrv = &socksServer{
+			listener: socksListener,
+			conns:    make(map[net.Conn]struct{}),
+		}
+	}
+
+	closeListeners := func() {
+		_ = listener.Close()
+		if socksSrv != nil {
+			_ = socksSrv.listener.Close()
+		}
+	}
+
+	if len(s.metricsListenAddr) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.metrics)
+
+		metricsSrv, metricsAddr, err := s.serveAux("metrics", s.metricsListenAddr, mux)
+		if err != nil {
+			closeListeners()
+
+			return err
+		}
+		defer metricsSrv.Close()
+
+		listenAddrs["metrics"] = metricsAddr
+	}
+
+	if len(s.adminListenAddr) > 0 {
+		if len(s.adminToken) == 0 {
+			closeListeners()
+
+			return errors.New("admin API requires token")
+		}
+
+		adminSrv, adminAddr, err := s.serveAux("admin", s.adminListenAddr, MakeAdminHandler(s.connRegistry, s.adminToken, s.logger))
+		if err != nil {
+			closeListeners()
+
+			return err
+		}
+		defer adminSrv.Close()
+
+		listenAddrs["admin"] = adminAddr
+	}
 
 	s.srvCtx = ctx
 
 	s.configureHttpServer()
 
-	errChan := make(chan error, 1)
-	go func() {
-		defer close(errChan)
+	s.addrs = listenAddrs
+	close(s.ready)
 
+	errChan := make(chan error, 2)
+	go func() {
 		errChan <- s.httpSrv.Serve(listener)
 	}()
 
+	if socksSrv != nil {
+		go func() {
+			if err := s.serveSocks(socksSrv); err != nil {
+				errChan <- fmt.Errorf("SOCKS5 server failed: %w", err)
+			}
+		}()
+	}
+
 	select {
 	case err := <-errChan:
+		if socksSrv != nil {
+			_ = socksSrv.listener.Close()
+		}
+		_ = s.httpSrv.Close()
+
 		return err
 	case <-ctx.Done():
 		s.logger.Info("Shutting down HTTP server")
@@ -131,18 +302,70 @@ func (s *Server) Run(ctx context.Context) error {
 		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.gracefulShutdownTimeout)
 		defer cancel()
 
+		var shutdownErr error
+
+		if socksSrv != nil {
+			if err := socksSrv.shutdown(shutdownCtx); err != nil {
+				s.logger.Error("Failed to shutdown SOCKS5 server", zap.Error(err))
+
+				shutdownErr = fmt.Errorf("failed to gracefully shutdown SOCKS5 server: %w", err)
+			}
+		}
+
 		if err := s.httpSrv.Shutdown(shutdownCtx); err != nil {
 			s.logger.Error("Failed to shutdown HTTP server", zap.Error(err))
 
 			return fmt.Errorf("failed to gracefully shutdown server: %w", err)
 		}
 
+		if shutdownErr != nil {
+			return shutdownErr
+		}
+
 		s.logger.Info("HTTP server shutdown completed")
 
 		return nil
 	}
 }
 
+// serveAux starts auxiliary HTTP server (metrics, admin API) in background, it must be closed by the caller,
+// bound address is returned
+// Ready returns channel which is closed when all listeners of the running server are bound,
+// e.g. to learn addresses of the listeners with port 0 (see [Server.Addrs])
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Addrs returns addresses of the bound listeners keyed by server name ("http", "socks5", "metrics", "admin"),
+// nil is returned until server is ready (see [Server.Ready])
+func (s *Server) Addrs() map[string]net.Addr {
+	select {
+	case <-s.ready:
+		return maps.Clone(s.addrs)
+	default:
+		return nil
+	}
+}
+
+func (s *Server) serveAux(name, addr string, handler http.Handler) (*http.Server, net.Addr, error) {
+	auxListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to bind %s server addr: %w", name, err)
+	}
+
+	s.logger.Info("Listening on "+name+" address", zap.String("addr", auxListener.Addr().String()))
+
+	auxSrv := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		if err := auxSrv.Serve(auxListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Server failed", zap.String("server", name), zap.Error(err))
+		}
+	}()
+
+	return auxSrv, auxListener.Addr(), nil
+}
+
 // checkAuthorization checks if the provided credentials are valid
 func (s *Server) checkAuthorization(r *http.Request) bool {
 	auth := r.Header.Get("Proxy-Authorization")
@@ -174,34 +397,54 @@ func (s *Server) checkAuthorization(r *http.Request) bool {
 	return true
 }
 
+// makeDialRequest makes dial request, request user is taken from the context
+func (s *Server) makeDialRequest(ctx context.Context, protocol DialProtocol, clientAddr, target string) *DialRequest {
+	req := &DialRequest{
+		ClientAddr: clientAddr,
+		Target:     target,
+		Protocol:   protocol,
+	}
+
+	if usr, ok := ProxyUserFromContext(ctx); ok {
+		req.User = usr
+	}
+
+	return req
+}
+
 // handleConnect handles the CONNECT (tunnelled HTTP) method
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
-	dialer := s.dFactory.GetDialer()
-	if dialer.LocalAddr != nil && s.logger.Level().Enabled(zap.DebugLevel) {
-		s.logger.Debug("Selected IP to perform request",
-			zap.String("remote", r.RemoteAddr),
-			zap.String("dialerIp", dialer.LocalAddr.String()),
-		)
+	tracker := getCtxAccessTracker(r.Context())
+	tracker.setUser(r.Context())
+
+	release, limiter, err := s.acquireUserConn(r.Context(), r.RemoteAddr)
+	if err != nil {
+		s.metrics.request(r.Method, outcomeTooManyConns)
+
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
 	}
+	defer release()
 
-	destConn, err := dialer.DialContext(r.Context(), "tcp", r.Host)
+	dialStart := time.Now()
+	destConn, err := s.dial(r.Context(), DialProtocolConnect, r.RemoteAddr, "tcp", r.Host)
+	tracker.dialed(time.Since(dialStart))
 	if err != nil {
-		s.logger.Warn("Failed to dial host",
-			zap.String("host", r.Host),
-			zap.String("remote", r.RemoteAddr),
-			zap.Error(err),
-		)
+		s.metrics.request(r.Method, dialOutcome(err))
 
-		http.Error(w, "Failed to connect to the destination", http.StatusServiceUnavailable)
+		writeDialError(w, err, "Failed to connect to the destination", http.StatusServiceUnavailable)
 		return
 	}
 	defer destConn.Close()
 
+	tracker.connected(destConn)
+
 	hijacker, ok := w.(http.Hijacker)
 	if !ok {
 		s.logger.Error("Hijacking connection is not supported",
 			zap.String("remote", r.RemoteAddr),
 		)
+		s.metrics.request(r.Method, outcomeError)
 
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
@@ -213,12 +456,20 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		s.logger.Error("Failed to hijack connection",
 			zap.String("remote", r.RemoteAddr),
 		)
+		s.metrics.request(r.Method, outcomeError)
 
 		http.Error(w, "Internal Error", http.StatusInternalServerError)
 		return
 	}
 	defer clientConn.Close()
 
+	active := s.connRegistry.add(r.Context(), DialProtocolConnect, r.RemoteAddr, r.Host, func() {
+		_ = clientConn.Close()
+		_ = destConn.Close()
+	})
+	defer s.connRegistry.remove(active)
+	active.connected(destConn)
+
 	// Don't block too long when trying to respond to the client
 	_ = clientConn.SetWriteDeadline(time.Now().Add(time.Second * 5))
 
@@ -228,9 +479,32 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 			zap.String("remote", r.RemoteAddr),
 			zap.Error(err),
 		)
+		s.metrics.request(r.Method, outcomeError)
+
 		return
 	}
 
+	s.metrics.request(r.Method, outcomeOk)
+	tracker.setStatus(http.StatusOK)
+
+	s.tunnel(limitConnRate(s.srvCtx, clientConn, limiter), limitConnRate(s.srvCtx, destConn, limiter), r.Host, tracker.counters(), active.counters())
+}
+
+// logSelectedIp logs source IP of the connection established to perform client request
+func (s *Server) logSelectedIp(remote string, destConn net.Conn) {
+	if s.logger.Level().Enabled(zap.DebugLevel) {
+		s.logger.Debug("Selected IP to perform request",
+			zap.String("remote", remote),
+			zap.String("dialerIp", destConn.LocalAddr().String()),
+		)
+	}
+}
+
+// tunnel transfers data between client and destination connections in both directions
+// until one of the sides closes connection or server is shutting down, transferred bytes are added to the counters
+func (s *Server) tunnel(clientConn, destConn net.Conn, host string, counters ...*byteCounters) {
+	remote := clientConn.RemoteAddr().String()
+
 	bufSize := 32 * 1024
 	clientBuf := make([]byte, bufSize)
 	dstBuf := make([]byte, bufSize)
@@ -247,15 +521,20 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	proxyCtx, proxyCancel := context.WithCancel(context.Background())
 	defer proxyCancel()
 
+	defer s.metrics.tunnelStarted()()
+
+	clientToDst := countBytes(s.metrics.countTunnelBytes(dstConnDeadlineRw, "in"), "in", counters...)
+	dstToClient := countBytes(s.metrics.countTunnelBytes(clientConnDeadlineRw, "out"), "out", counters...)
+
 	// Client -> Target
 	go func() {
 		defer proxyCancel()
 
-		_, err := CopyBufferWithTimeout(dstConnDeadlineRw, clientConnDeadlineRw, clientBuf)
+		_, err := CopyBufferWithTimeout(clientToDst, clientConnDeadlineRw, clientBuf)
 		if err != nil {
 			s.logger.Warn("Err while transferring data from client to destination",
-				zap.String("remote", r.RemoteAddr),
-				zap.String("dst", r.Host),
+				zap.String("remote", remote),
+				zap.String("dst", host),
 				zap.Error(err),
 			)
 		}
@@ -265,7 +544,7 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	go func() {
 		defer proxyCancel()
 
-		_, err := CopyBufferWithTimeout(clientConnDeadlineRw, dstConnDeadlineRw, dstBuf)
+		_, err := CopyBufferWithTimeout(dstToClient, dstConnDeadlineRw, dstBuf)
 		if err != nil {
 			var netOpErr *net.OpError
 			// Ignore error when client connection has been closed
@@ -274,8 +553,8 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 			}
 
 			s.logger.Warn("Err while transferring data from destination to client",
-				zap.String("remote", r.RemoteAddr),
-				zap.String("dst", r.Host),
+				zap.String("remote", remote),
+				zap.String("dst", host),
 				zap.Error(err),
 			)
 		}
@@ -285,27 +564,76 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	case <-s.srvCtx.Done():
 	case <-proxyCtx.Done():
 		s.logger.Debug("Client conn closed",
-			zap.String("remote", clientConn.RemoteAddr().String()),
-			zap.String("host", r.Host),
+			zap.String("remote", remote),
+			zap.String("host", host),
 		)
 	}
 }
 
 // handleHTTP handles regular (not tunneled) HTTP requests
 func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	tracker := getCtxAccessTracker(r.Context())
+	tracker.setUser(r.Context())
+
+	release, limiter, err := s.acquireUserConn(r.Context(), r.RemoteAddr)
+	if err != nil {
+		s.metrics.request(r.Method, outcomeTooManyConns)
+
+		http.Error(w, "Too many connections", http.StatusTooManyRequests)
+		return
+	}
+	defer release()
+
+	var active *activeConn
+	if s.connRegistry != nil {
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		// Killed request is aborted with its context
+		r = r.WithContext(ctx)
+		active = s.connRegistry.add(ctx, DialProtocolHttp, r.RemoteAddr, r.URL.String(), cancel)
+		defer s.connRegistry.remove(active)
+	}
+
+	r.Body = countBodyBytes(r.Body, tracker.counters(), active.counters())
+
+	if limiter != nil && r.Body != nil {
+		r.Body = &rateLimitedBody{
+			rateLimitedReader: rateLimitedReader{Reader: r.Body, ctx: r.Context(), limiter: limiter},
+			Closer:            r.Body,
+		}
+	}
+
+	var usrKey string
+	if usr, ok := ProxyUserFromContext(r.Context()); ok {
+		usrKey = usr.Name + "\x00" + usr.Session()
+	}
+
 	ctxDialer := getCtxDialer(r.Context())
-	if ctxDialer.dialer == nil {
-		ctxDialer.dialer = s.dFactory.GetDialer()
+	// Connection can be reused by requests of different users or with different sessions,
+	// pooled destination connections must not be shared between them
+	if ctxDialer.transport == nil || ctxDialer.user != usrKey {
+		// Pooled connections of the previous user would be kept open until idle timeout otherwise
+		if ctxDialer.transport != nil {
+			ctxDialer.transport.CloseIdleConnections()
+		}
+
+		ctxDialer.user = usrKey
+
+		remote := r.RemoteAddr
 
 		ctxDialer.transport = s.baseHttpTransport.Clone()
-		ctxDialer.transport.Dial = ctxDialer.dialer.Dial
-		ctxDialer.transport.DialContext = ctxDialer.dialer.DialContext
+		ctxDialer.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			// Context is the request context, so it carries proxy user
+			dialStart := time.Now()
+			conn, err := s.dial(ctx, DialProtocolHttp, remote, network, addr)
+			getCtxAccessTracker(ctx).dialed(time.Since(dialStart))
+			if err != nil {
+				return nil, err
+			}
 
-		if ctxDialer.dialer.LocalAddr != nil && s.logger.Level().Enabled(zap.DebugLevel) {
-			s.logger.Debug("Selected IP to perform request",
-				zap.String("remote", r.RemoteAddr),
-				zap.String("dialerIp", ctxDialer.dialer.LocalAddr.String()),
-			)
+			// Transport is not shared between users, so pooled connection keeps limiter of its user
+			return limitConnRate(s.srvCtx, conn, s.userLimiter(ctx)), nil
 		}
 	}
 
@@ -335,6 +663,16 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Header.Del("Connection")
 
+	if tracker != nil || active != nil {
+		// Pooled connection is not dialed, so its source IP is taken from the trace
+		r = r.WithContext(httptrace.WithClientTrace(r.Context(), &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) {
+				tracker.connected(info.Conn)
+				active.connected(info.Conn)
+			},
+		}))
+	}
+
 	resp, err := ctxDialer.transport.RoundTrip(r)
 	if err != nil {
 		s.logger.Warn("Failed to perform HTTP request",
@@ -344,12 +682,15 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 			zap.String("path", r.URL.Path),
 			zap.Error(err),
 		)
+		s.metrics.request(r.Method, dialOutcome(err))
 
-		http.Error(w, "Failed to perform HTTP request", http.StatusBadGateway)
+		writeDialError(w, err, "Failed to perform HTTP request", http.StatusBadGateway)
 		return
 	}
 	defer resp.Body.Close()
 
+	s.metrics.request(r.Method, outcomeOk)
+
 	// Do not send connection close header
 	if resp.Header.Get("Connection") != "upgrade" {
 		resp.Header.Del("Connection")
@@ -364,7 +705,7 @@ func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(resp.StatusCode)
 
-	if _, err := io.Copy(w, resp.Body); err != nil {
+	if _, err := io.Copy(countBytes(w, "out", tracker.counters(), active.counters()), resp.Body); err != nil {
 		s.logger.Error("Failed to copy HTTP response body",
 			zap.String("remote", r.RemoteAddr),
 			zap.Error(err),
@@ -2,7 +2,6 @@ package proxy
 
 import (
 	"context"
-	"net"
 	"net/http"
 )
 
@@ -11,8 +10,9 @@ type ctxDialerKeyType struct{}
 var ctxDialerKey ctxDialerKeyType
 
 type ctxDialer struct {
-	dialer    *net.Dialer
 	transport *http.Transport
+	// user identifies proxy user and session the transport was created for
+	user string
 }
 
 func setCtxDialer(ctx context.Context, d *ctxDialer) context.Context {
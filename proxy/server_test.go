@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestServer runs the server until the test ends and returns addresses of its listeners keyed by server name
+// ("http", "socks5", "metrics", "admin"), listen addresses of the server should use port 0
+func startTestServer(t *testing.T, srv *Server) map[string]string {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() {
+		done <- srv.Run(ctx)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	select {
+	case <-srv.Ready():
+		addrs := srv.Addrs()
+
+		strAddrs := make(map[string]string, len(addrs))
+		for name, addr := range addrs {
+			strAddrs[name] = addr.String()
+		}
+
+		return strAddrs
+	case err := <-done:
+		t.Fatalf("Failed to start server: %v", err)
+
+		return nil
+	}
+}
+
+func TestServerHttpUserChangeClosesIdleConns(t *testing.T) {
+	var closed atomic.Int32
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed.Add(1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil),
+		WithListenAddr("127.0.0.1:0"),
+		WithAuthFunc(func(usr, passwd string) bool {
+			return passwd == "pass"
+		}),
+	)
+
+	conn, err := net.Dial("tcp4", startTestServer(t, srv)["http"])
+	if err != nil {
+		t.Fatalf("Failed to connect to proxy: %v", err)
+	}
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+
+	// Requests of different users are sent over the same client connection
+	for _, user := range []string{"alice", "bob"} {
+		auth := base64.StdEncoding.EncodeToString([]byte(user + ":pass"))
+		_, _ = io.WriteString(conn, "GET "+backend.URL+"/ HTTP/1.1\r\nHost: "+backend.Listener.Addr().String()+"\r\n"+
+			"Proxy-Authorization: Basic "+auth+"\r\n\r\n")
+
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("Request of %s failed: %v, %v", user, resp, err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}
+
+	// Pooled destination connection of the previous user is closed
+	for i := 0; i < 50 && closed.Load() == 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if closed.Load() != 1 {
+		t.Errorf("Closed destination connections got = %d, want 1", closed.Load())
+	}
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Linux TCP socket option missing in syscall package
+const sysTCP_USER_TIMEOUT = 0x12
+
+// SocketOptions are options of the outgoing sockets, they are applied by dialer factories in the socket
+// control callback before socket is bound, zero values leave system defaults
+type SocketOptions struct {
+	// Mark is the firewall mark used by the policy routing (SO_MARK), requires CAP_NET_ADMIN
+	Mark uint32
+	// BindToDevice binds sockets to the network interface (SO_BINDTODEVICE), e.g. on multi-homed hosts
+	BindToDevice string
+	// KeepAlive is the TCP keep-alive idle time and probes interval (TCP_KEEPIDLE, TCP_KEEPINTVL),
+	// negative value disables keep-alive probes, 0 keeps Go default
+	KeepAlive time.Duration
+	// UserTimeout is the max time transmitted data may stay unacknowledged before connection is closed (TCP_USER_TIMEOUT)
+	UserTimeout time.Duration
+	// TOS is the IPv4 type of service or IPv6 traffic class (IP_TOS, IPV6_TCLASS)
+	TOS int
+}
+
+// SocketOptionsSetter is implemented by dialer factories which can apply [SocketOptions], see [WithSocketOptions]
+type SocketOptionsSetter interface {
+	SetSocketOptions(opts *SocketOptions)
+}
+
+// Control applies socket options to the socket, it can be used as [net.Dialer.Control]
+// by dialer factories which do not implement [SocketOptionsSetter]
+func (o *SocketOptions) Control(network, _ string, c syscall.RawConn) error {
+	var setErr error
+
+	err := c.Control(func(fd uintptr) {
+		setErr = o.apply(fd, network)
+	})
+	if err != nil {
+		return err
+	}
+
+	return setErr
+}
+
+// overridesKeepAlive reports whether dialer keep-alive must be disabled, so it does not overwrite socket options
+func (o *SocketOptions) overridesKeepAlive() bool {
+	return o != nil && o.KeepAlive != 0
+}
+
+func (o *SocketOptions) apply(fd uintptr, network string) error {
+	if o == nil {
+		return nil
+	}
+
+	s := int(fd)
+
+	if o.Mark != 0 {
+		if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_MARK, int(o.Mark)); err != nil {
+			return &SockOptError{Opt: "SO_MARK", Err: err}
+		}
+	}
+
+	if len(o.BindToDevice) > 0 {
+		if err := syscall.BindToDevice(s, o.BindToDevice); err != nil {
+			return &SockOptError{Opt: "SO_BINDTODEVICE", Err: err}
+		}
+	}
+
+	if o.TOS != 0 {
+		var err error
+		if isNetwork4(network) {
+			err = syscall.SetsockoptInt(s, syscall.SOL_IP, syscall.IP_TOS, o.TOS)
+		} else {
+			err = syscall.SetsockoptInt(s, syscall.SOL_IPV6, syscall.IPV6_TCLASS, o.TOS)
+		}
+		if err != nil {
+			return &SockOptError{Opt: "IP_TOS", Err: err}
+		}
+	}
+
+	if !strings.HasPrefix(network, "tcp") {
+		return nil
+	}
+
+	if o.KeepAlive < 0 {
+		if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 0); err != nil {
+			return &SockOptError{Opt: "SO_KEEPALIVE", Err: err}
+		}
+	} else if o.KeepAlive > 0 {
+		secs := max(int(o.KeepAlive/time.Second), 1)
+
+		if err := syscall.SetsockoptInt(s, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1); err != nil {
+			return &SockOptError{Opt: "SO_KEEPALIVE", Err: err}
+		}
+		if err := syscall.SetsockoptInt(s, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, secs); err != nil {
+			return &SockOptError{Opt: "TCP_KEEPIDLE", Err: err}
+		}
+		if err := syscall.SetsockoptInt(s, syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, secs); err != nil {
+			return &SockOptError{Opt: "TCP_KEEPINTVL", Err: err}
+		}
+	}
+
+	if o.UserTimeout > 0 {
+		if err := syscall.SetsockoptInt(s, syscall.IPPROTO_TCP, sysTCP_USER_TIMEOUT, int(o.UserTimeout.Milliseconds())); err != nil {
+			return &SockOptError{Opt: "TCP_USER_TIMEOUT", Err: err}
+		}
+	}
+
+	return nil
+}
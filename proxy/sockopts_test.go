@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStaticDialerFactorySocketOptions(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	opts := SocketOptions{
+		BindToDevice: "lo",
+		KeepAlive:    42 * time.Second,
+		UserTimeout:  3 * time.Second,
+		TOS:          0x10,
+	}
+
+	factory := MakeNoIpDialerFactory(nil)
+	MakeServer(factory, WithSocketOptions(opts))
+
+	dialer, err := factory.GetRequestDialer(context.Background(), &DialRequest{})
+	if err != nil {
+		t.Fatalf("GetRequestDialer() error = %v", err)
+	}
+
+	conn, err := dialer.Dial("tcp4", listener.Addr().String())
+	if err != nil {
+		t.Skipf("Failed to dial with socket options: %v", err)
+	}
+	defer conn.Close()
+
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Failed to get raw conn: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		level int
+		opt   int
+		want  int
+	}{
+		{"SO_KEEPALIVE", syscall.SOL_SOCKET, syscall.SO_KEEPALIVE, 1},
+		{"TCP_KEEPIDLE", syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE, 42},
+		{"TCP_KEEPINTVL", syscall.IPPROTO_TCP, syscall.TCP_KEEPINTVL, 42},
+		{"TCP_USER_TIMEOUT", syscall.IPPROTO_TCP, sysTCP_USER_TIMEOUT, 3000},
+		{"IP_TOS", syscall.SOL_IP, syscall.IP_TOS, 0x10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int
+			var getErr error
+			_ = rawConn.Control(func(fd uintptr) {
+				got, getErr = syscall.GetsockoptInt(int(fd), tt.level, tt.opt)
+			})
+			if getErr != nil {
+				t.Fatalf("Failed to get socket option: %v", getErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("Socket option got = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,492 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// SOCKS5 protocol constants, see RFC 1928 and RFC 1929
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone         = 0x00
+	socks5AuthUserPass     = 0x02
+	socks5AuthNoAcceptable = 0xFF
+
+	socks5UserPassVersion = 0x01
+	socks5UserPassOk      = 0x00
+	socks5UserPassFailure = 0x01
+
+	socks5CmdConnect      = 0x01
+	socks5CmdBind         = 0x02
+	socks5CmdUdpAssociate = 0x03
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded           = 0x00
+	socks5RepGeneralFailure      = 0x01
+	socks5RepNotAllowed          = 0x02
+	socks5RepNetworkUnreachable  = 0x03
+	socks5RepHostUnreachable     = 0x04
+	socks5RepConnectionRefused   = 0x05
+	socks5RepTTLExpired          = 0x06
+	socks5RepCmdNotSupported     = 0x07
+	socks5RepAddrTypeUnsupported = 0x08
+)
+
+// socks5HandshakeTimeout limits time given to the client to complete negotiation and send request
+const socks5HandshakeTimeout = 10 * time.Second
+
+var errSocks5BadVersion = errors.New("unsupported SOCKS version")
+var errSocks5NoAcceptableAuth = errors.New("no acceptable SOCKS5 auth methods")
+var errSocks5AuthFailed = errors.New("SOCKS5 authentication failed")
+
+// socks5Request represents parsed SOCKS5 client request
+type socks5Request struct {
+	cmd  byte
+	host string
+	port uint16
+}
+
+func (r *socks5Request) addr() string {
+	return net.JoinHostPort(r.host, strconv.Itoa(int(r.port)))
+}
+
+// socksServer tracks SOCKS5 listener state required for graceful shutdown
+type socksServer struct {
+	listener net.Listener
+
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+func (ss *socksServer) trackConn(conn net.Conn, add bool) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if add {
+		ss.conns[conn] = struct{}{}
+	} else {
+		delete(ss.conns, conn)
+	}
+}
+
+func (ss *socksServer) closeConns() {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	for conn := range ss.conns {
+		_ = conn.Close()
+	}
+}
+
+// shutdown stops accepting new connections and waits for active ones to finish,
+// connections which are still active when ctx is done are closed forcibly
+func (ss *socksServer) shutdown(ctx context.Context) error {
+	_ = ss.listener.Close()
+
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+
+		ss.wg.Wait()
+	}()
+
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		ss.closeConns()
+
+		return ctx.Err()
+	}
+}
+
+// serveSocks accepts SOCKS5 connections until listener is closed
+func (s *Server) serveSocks(ss *socksServer) error {
+	var tempDelay time.Duration
+
+	for {
+		conn, err := ss.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			// Back off on temporary errors the same way net/http does
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() || errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if maxDelay := time.Second; tempDelay > maxDelay {
+					tempDelay = maxDelay
+				}
+
+				s.logger.Warn("SOCKS5 accept error, retrying", zap.Duration("delay", tempDelay), zap.Error(err))
+				time.Sleep(tempDelay)
+
+				continue
+			}
+
+			return err
+		}
+
+		tempDelay = 0
+
+		ss.wg.Add(1)
+		ss.trackConn(conn, true)
+
+		go func() {
+			defer ss.wg.Done()
+			defer ss.trackConn(conn, false)
+			defer conn.Close()
+
+			s.handleSocksConn(conn)
+		}()
+	}
+}
+
+// handleSocksConn handles single SOCKS5 client connection
+func (s *Server) handleSocksConn(conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+
+	s.logger.Debug("Incoming SOCKS5 connection", zap.String("remote", remote))
+	defer s.logger.Debug("Closed SOCKS5 connection", zap.String("remote", remote))
+
+	allowed, implicitUsr := s.checkClient(remote)
+	if !allowed {
+		return
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	usr, err := s.socksNegotiateAuth(conn, implicitUsr)
+	if err != nil {
+		if errors.Is(err, errSocks5AuthFailed) {
+			s.logger.Warn("Bad SOCKS5 auth attempt", zap.String("remote", remote))
+		} else {
+			s.logger.Debug("SOCKS5 negotiation failed", zap.String("remote", remote), zap.Error(err))
+		}
+
+		return
+	}
+
+	req, rep, err := readSocks5Request(conn)
+	if err != nil {
+		s.logger.Debug("Failed to read SOCKS5 request", zap.String("remote", remote), zap.Error(err))
+
+		if rep != socks5RepSucceeded {
+			_ = writeSocks5Reply(conn, rep, nil)
+		}
+
+		return
+	}
+
+	ctx := s.srvCtx
+	if usr != nil {
+		ctx = setCtxProxyUser(ctx, usr)
+	}
+
+	switch req.cmd {
+	case socks5CmdConnect:
+		s.handleSocksConnect(ctx, conn, req)
+	case socks5CmdUdpAssociate:
+		s.handleSocksUdpAssociate(ctx, conn, req)
+	default:
+		s.logger.Debug("Unsupported SOCKS5 command",
+			zap.String("remote", remote),
+			zap.Uint8("cmd", req.cmd),
+		)
+
+		_ = writeSocks5Reply(conn, socks5RepCmdNotSupported, nil)
+	}
+}
+
+// socksNegotiateAuth performs auth method selection and (optionally) username/password auth.
+// When auth is not required but client offers username/password auth, credentials are accepted without check,
+// so parameters passed in the username (e.g. session) can be used.
+// Client with implicit user (see [ClientACL.Identities]) may skip auth
+func (s *Server) socksNegotiateAuth(conn net.Conn, implicitUsr *ProxyUser) (*ProxyUser, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != socks5Version {
+		return nil, errSocks5BadVersion
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	method := byte(socks5AuthNoAcceptable)
+	for _, m := range methods {
+		authOptional := s.authFunc == nil || implicitUsr != nil
+		if m == socks5AuthUserPass || (m == socks5AuthNone && authOptional && method != socks5AuthUserPass) {
+			method = m
+		}
+	}
+
+	if method == socks5AuthNoAcceptable {
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNoAcceptable})
+
+		return nil, errSocks5NoAcceptableAuth
+	}
+
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+
+	if method == socks5AuthNone {
+		return implicitUsr, nil
+	}
+
+	username, passwd, err := readSocks5UserPass(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	usr, ok := checkCredentials(username, passwd, s.countAuthFailures(s.authFunc, "socks"))
+	if !ok {
+		_, _ = conn.Write([]byte{socks5UserPassVersion, socks5UserPassFailure})
+
+		return nil, errSocks5AuthFailed
+	}
+
+	if s.authFunc == nil {
+		usr = unverifiedUser(usr, implicitUsr)
+	}
+
+	if _, err := conn.Write([]byte{socks5UserPassVersion, socks5UserPassOk}); err != nil {
+		return nil, err
+	}
+
+	return usr, nil
+}
+
+// readSocks5UserPass reads RFC 1929 username/password request
+func readSocks5UserPass(r io.Reader) (usr, passwd string, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	if header[0] != socks5UserPassVersion {
+		err = fmt.Errorf("unsupported SOCKS5 username/password auth version %d", header[0])
+		return
+	}
+
+	usrBuf := make([]byte, header[1])
+	if _, err = io.ReadFull(r, usrBuf); err != nil {
+		return
+	}
+
+	var passwdLen [1]byte
+	if _, err = io.ReadFull(r, passwdLen[:]); err != nil {
+		return
+	}
+
+	passwdBuf := make([]byte, passwdLen[0])
+	if _, err = io.ReadFull(r, passwdBuf); err != nil {
+		return
+	}
+
+	return string(usrBuf), string(passwdBuf), nil
+}
+
+// readSocks5Request reads SOCKS5 request, on error returns reply code which should be sent to the client
+func readSocks5Request(r io.Reader) (*socks5Request, byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, socks5RepSucceeded, err
+	}
+
+	if header[0] != socks5Version {
+		return nil, socks5RepGeneralFailure, errSocks5BadVersion
+	}
+
+	req := &socks5Request{cmd: header[1]}
+
+	host, err := readSocks5Addr(r, header[3])
+	if err != nil {
+		if errors.Is(err, errSocks5AddrTypeUnsupported) {
+			return nil, socks5RepAddrTypeUnsupported, err
+		}
+
+		return nil, socks5RepSucceeded, err
+	}
+
+	req.host = host
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, socks5RepSucceeded, err
+	}
+
+	req.port = binary.BigEndian.Uint16(port[:])
+
+	return req, socks5RepSucceeded, nil
+}
+
+var errSocks5AddrTypeUnsupported = errors.New("unsupported SOCKS5 address type")
+
+// readSocks5Addr reads SOCKS5 address of given type
+func readSocks5Addr(r io.Reader, atyp byte) (string, error) {
+	switch atyp {
+	case socks5AtypIPv4:
+		var addr [4]byte
+		if _, err := io.ReadFull(r, addr[:]); err != nil {
+			return "", err
+		}
+
+		return netip.AddrFrom4(addr).String(), nil
+	case socks5AtypIPv6:
+		var addr [16]byte
+		if _, err := io.ReadFull(r, addr[:]); err != nil {
+			return "", err
+		}
+
+		return netip.AddrFrom16(addr).String(), nil
+	case socks5AtypDomain:
+		var domainLen [1]byte
+		if _, err := io.ReadFull(r, domainLen[:]); err != nil {
+			return "", err
+		}
+
+		domain := make([]byte, domainLen[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return "", err
+		}
+
+		return string(domain), nil
+	default:
+		return "", errSocks5AddrTypeUnsupported
+	}
+}
+
+// appendSocks5Addr appends SOCKS5 encoded address (ATYP, ADDR, PORT) to the buffer
+func appendSocks5Addr(buf []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		buf = append(buf, socks5AtypIPv4)
+	} else {
+		buf = append(buf, socks5AtypIPv6)
+	}
+
+	buf = append(buf, ip.AsSlice()...)
+
+	return binary.BigEndian.AppendUint16(buf, addr.Port())
+}
+
+// writeSocks5Reply writes SOCKS5 reply, when bindAddr is nil zero IPv4 address is used
+func writeSocks5Reply(w io.Writer, rep byte, bindAddr net.Addr) error {
+	addrPort := netip.AddrPortFrom(netip.IPv4Unspecified(), 0)
+
+	if bindAddr != nil {
+		if ap, err := netip.ParseAddrPort(bindAddr.String()); err == nil {
+			addrPort = ap
+		}
+	}
+
+	buf := make([]byte, 0, 22)
+	buf = append(buf, socks5Version, rep, 0x00)
+	buf = appendSocks5Addr(buf, addrPort)
+
+	_, err := w.Write(buf)
+
+	return err
+}
+
+// socks5ReplyFromErr maps dial error to SOCKS5 reply code
+func socks5ReplyFromErr(err error) byte {
+	switch {
+	case errors.Is(err, ErrUdpNotSupported):
+		return socks5RepCmdNotSupported
+	case errors.Is(err, ErrDestinationDenied), errors.Is(err, ErrTooManyConns):
+		return socks5RepNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5RepConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5RepNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5RepHostUnreachable
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.Is(err, context.DeadlineExceeded):
+		return socks5RepTTLExpired
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return socks5RepHostUnreachable
+	}
+
+	return socks5RepGeneralFailure
+}
+
+// handleSocksConnect handles the SOCKS5 CONNECT command
+func (s *Server) handleSocksConnect(ctx context.Context, conn net.Conn, req *socks5Request) {
+	remote := conn.RemoteAddr().String()
+	host := req.addr()
+
+	release, limiter, err := s.acquireUserConn(ctx, remote)
+	if err != nil {
+		s.metrics.request(socksMethodConnect, outcomeTooManyConns)
+
+		_ = writeSocks5Reply(conn, socks5ReplyFromErr(err), nil)
+		return
+	}
+	defer release()
+
+	destConn, err := s.dial(ctx, DialProtocolSocks, remote, "tcp", host)
+	if err != nil {
+		s.metrics.request(socksMethodConnect, dialOutcome(err))
+
+		_ = writeSocks5Reply(conn, socks5ReplyFromErr(err), nil)
+		return
+	}
+	defer destConn.Close()
+
+	// Don't block too long when trying to respond to the client
+	_ = conn.SetDeadline(time.Time{})
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+
+	if err := writeSocks5Reply(conn, socks5RepSucceeded, destConn.LocalAddr()); err != nil {
+		s.logger.Warn("Failed to send SOCKS5 reply to client",
+			zap.String("remote", remote),
+			zap.Error(err),
+		)
+		s.metrics.request(socksMethodConnect, outcomeError)
+
+		return
+	}
+
+	s.metrics.request(socksMethodConnect, outcomeOk)
+
+	active := s.connRegistry.add(ctx, DialProtocolSocks, remote, host, func() {
+		_ = conn.Close()
+		_ = destConn.Close()
+	})
+	defer s.connRegistry.remove(active)
+	active.connected(destConn)
+
+	s.tunnel(limitConnRate(s.srvCtx, conn, limiter), limitConnRate(s.srvCtx, destConn, limiter), host, active.counters())
+}
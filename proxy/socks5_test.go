@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// readTestSocks5Reply reads SOCKS5 reply and returns reply code and bound address
+func readTestSocks5Reply(t *testing.T, r io.Reader) (byte, netip.AddrPort) {
+	t.Helper()
+
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+
+	if header[0] != socks5Version {
+		t.Fatalf("Reply version got = %d, want %d", header[0], socks5Version)
+	}
+
+	host, err := readSocks5Addr(r, header[3])
+	if err != nil {
+		t.Fatalf("Failed to read reply address: %v", err)
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		t.Fatalf("Failed to read reply port: %v", err)
+	}
+
+	return header[1], netip.AddrPortFrom(netip.MustParseAddr(host), binary.BigEndian.Uint16(port[:]))
+}
+
+func TestSocks5Server(t *testing.T) {
+	echo, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil),
+		WithListenAddr("127.0.0.1:0"),
+		WithSocksListenAddr("127.0.0.1:0"),
+		WithAuthFunc(func(usr, passwd string) bool {
+			return usr == "user" && passwd == "pass"
+		}),
+	)
+
+	socksAddr := startTestServer(t, srv)["socks5"]
+
+	dial := func(t *testing.T) net.Conn {
+		t.Helper()
+
+		conn, err := net.Dial("tcp4", socksAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to SOCKS5 server: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		return conn
+	}
+
+	expect := func(t *testing.T, conn net.Conn, want ...byte) {
+		t.Helper()
+
+		got := make([]byte, len(want))
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("Failed to read response: %v", err)
+		}
+
+		if string(got) != string(want) {
+			t.Fatalf("Response got = %v, want %v", got, want)
+		}
+	}
+
+	authenticate := func(t *testing.T, conn net.Conn, usr, passwd string) {
+		t.Helper()
+
+		_, _ = conn.Write([]byte{socks5Version, 1, socks5AuthUserPass})
+		expect(t, conn, socks5Version, socks5AuthUserPass)
+
+		msg := append([]byte{socks5UserPassVersion, byte(len(usr))}, usr...)
+		msg = append(append(msg, byte(len(passwd))), passwd...)
+		_, _ = conn.Write(msg)
+	}
+
+	t.Run("no acceptable method", func(t *testing.T) {
+		conn := dial(t)
+
+		_, _ = conn.Write([]byte{socks5Version, 1, socks5AuthNone})
+		expect(t, conn, socks5Version, socks5AuthNoAcceptable)
+	})
+
+	t.Run("auth failure", func(t *testing.T) {
+		conn := dial(t)
+
+		authenticate(t, conn, "user", "wrong")
+		expect(t, conn, socks5UserPassVersion, socks5UserPassFailure)
+
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("Connection is not closed after auth failure")
+		}
+	})
+
+	t.Run("connect", func(t *testing.T) {
+		conn := dial(t)
+
+		authenticate(t, conn, "user", "pass")
+		expect(t, conn, socks5UserPassVersion, socks5UserPassOk)
+
+		req := appendSocks5Addr([]byte{socks5Version, socks5CmdConnect, 0x00}, netip.MustParseAddrPort(echo.Addr().String()))
+		_, _ = conn.Write(req)
+
+		rep, bindAddr := readTestSocks5Reply(t, conn)
+		if rep != socks5RepSucceeded {
+			t.Fatalf("Reply code got = %d, want %d", rep, socks5RepSucceeded)
+		}
+
+		if bindAddr.Addr() != netip.MustParseAddr("127.0.0.1") || bindAddr.Port() == 0 {
+			t.Errorf("Bound address got = %v, want local address of the destination connection", bindAddr)
+		}
+
+		_, _ = io.WriteString(conn, "ping")
+		expect(t, conn, []byte("ping")...)
+	})
+
+	replyTests := []struct {
+		name    string
+		request []byte
+		wantRep byte
+	}{
+		{
+			name:    "unsupported command",
+			request: appendSocks5Addr([]byte{socks5Version, socks5CmdBind, 0x00}, netip.MustParseAddrPort(echo.Addr().String())),
+			wantRep: socks5RepCmdNotSupported,
+		},
+		{
+			name:    "unsupported address type",
+			request: []byte{socks5Version, socks5CmdConnect, 0x00, 0x05, 127, 0, 0, 1, 0, 80},
+			wantRep: socks5RepAddrTypeUnsupported,
+		},
+	}
+	for _, tt := range replyTests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t)
+
+			authenticate(t, conn, "user", "pass")
+			expect(t, conn, socks5UserPassVersion, socks5UserPassOk)
+
+			_, _ = conn.Write(tt.request)
+
+			if rep, _ := readTestSocks5Reply(t, conn); rep != tt.wantRep {
+				t.Errorf("Reply code got = %d, want %d", rep, tt.wantRep)
+			}
+		})
+	}
+}
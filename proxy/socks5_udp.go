@@ -0,0 +1,452 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// socks5UdpBufSize is max UDP datagram size including SOCKS5 UDP request header
+const socks5UdpBufSize = 64 * 1024
+
+// socks5UdpResolvedCacheSize limits number of resolved domain names cached per association
+const socks5UdpResolvedCacheSize = 256
+
+// socks5UdpResolvedTTL is how long resolved domain names are cached per association,
+// records TTL is unknown for the resolvers other than [DNSResolver], so it's short
+const socks5UdpResolvedTTL = 30 * time.Second
+
+type udpResolved struct {
+	ip        netip.Addr
+	expiresAt time.Time
+}
+
+// udpAssociation represents single SOCKS5 UDP ASSOCIATE session
+type udpAssociation struct {
+	ctrlConn net.Conn
+
+	// clientConn receives client datagrams, relayConn sends them to destinations
+	clientConn net.PacketConn
+	relayConn  net.PacketConn
+
+	// clientIp is address of the client which requested association,
+	// datagrams from other addresses are dropped
+	clientIp netip.Addr
+	// clientAddr is client datagrams source address, locked in on first received datagram
+	// unless client specified it in the UDP ASSOCIATE request
+	clientAddr atomic.Pointer[net.UDPAddr]
+
+	lastActivity atomic.Int64
+
+	// policy restricts datagram destinations of the association user, limiter limits its rate, both may be nil
+	policy  *UserPolicy
+	limiter *rateLimiter
+
+	// bytes counts relayed payload bytes, nil when connections are not registered
+	bytes *byteCounters
+
+	// resolved caches domain names resolution results, used only by client -> target loop
+	resolved map[string]udpResolved
+}
+
+func (a *udpAssociation) touch() {
+	a.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (a *udpAssociation) idleSince() time.Duration {
+	return time.Since(time.Unix(0, a.lastActivity.Load()))
+}
+
+func (a *udpAssociation) close() {
+	_ = a.clientConn.Close()
+	_ = a.relayConn.Close()
+}
+
+// handleSocksUdpAssociate handles the SOCKS5 UDP ASSOCIATE command
+func (s *Server) handleSocksUdpAssociate(ctx context.Context, conn net.Conn, req *socks5Request) {
+	remote := conn.RemoteAddr().String()
+
+	// Association counts as a single connection of the user
+	release, limiter, err := s.acquireUserConn(ctx, remote)
+	if err != nil {
+		s.metrics.request(socksMethodUdp, outcomeTooManyConns)
+
+		_ = writeSocks5Reply(conn, socks5ReplyFromErr(err), nil)
+		return
+	}
+	defer release()
+
+	plFactory, ok := s.dFactory.(PacketListenerFactoryIface)
+	if !ok {
+		s.logger.Debug("Dialer factory does not support UDP", zap.String("remote", remote))
+		s.metrics.request(socksMethodUdp, outcomeError)
+
+		_ = writeSocks5Reply(conn, socks5RepCmdNotSupported, nil)
+		return
+	}
+
+	clientAddrPort, err := netip.ParseAddrPort(remote)
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5RepGeneralFailure, nil)
+		return
+	}
+
+	localAddrPort, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		_ = writeSocks5Reply(conn, socks5RepGeneralFailure, nil)
+		return
+	}
+
+	// Client facing socket is bound to the same IP client connected to
+	clientConn, err := net.ListenPacket("udp", netip.AddrPortFrom(localAddrPort.Addr(), 0).String())
+	if err != nil {
+		s.logger.Warn("Failed to listen SOCKS5 UDP relay client socket",
+			zap.String("remote", remote),
+			zap.Error(err),
+		)
+
+		_ = writeSocks5Reply(conn, socks5RepGeneralFailure, nil)
+		return
+	}
+
+	_, policy := s.userPolicy(ctx)
+
+	// Relay socket may send datagrams to any destination, so request has no target
+	listenReq := s.makeDialRequest(ctx, DialProtocolSocksUdp, remote, "")
+	if policy != nil {
+		listenReq.Prefixes = policy.Prefixes
+	}
+
+	relayConn, err := plFactory.ListenPacket(s.srvCtx, listenReq)
+	if err != nil {
+		_ = clientConn.Close()
+
+		s.logger.Warn("Failed to listen SOCKS5 UDP relay socket",
+			zap.String("remote", remote),
+			zap.Error(err),
+		)
+		s.metrics.request(socksMethodUdp, outcomeError)
+
+		_ = writeSocks5Reply(conn, socks5ReplyFromErr(err), nil)
+		return
+	}
+
+	assoc := &udpAssociation{
+		ctrlConn:   conn,
+		clientConn: clientConn,
+		relayConn:  relayConn,
+		clientIp:   clientAddrPort.Addr().Unmap(),
+		resolved:   make(map[string]udpResolved),
+		policy:     policy,
+		limiter:    limiter,
+	}
+	assoc.touch()
+	defer assoc.close()
+
+	// Client may provide the address it will send datagrams from
+	if ip, err := netip.ParseAddr(req.host); err == nil && !ip.IsUnspecified() && req.port != 0 {
+		assoc.clientAddr.Store(net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, req.port)))
+	}
+
+	if s.logger.Level().Enabled(zap.DebugLevel) {
+		s.logger.Debug("Selected IP to perform request",
+			zap.String("remote", remote),
+			zap.String("dialerIp", relayConn.LocalAddr().String()),
+		)
+	}
+
+	// Association is registered before the client gets reply
+	active := s.connRegistry.add(ctx, DialProtocolSocksUdp, remote, "", func() {
+		_ = conn.Close()
+		assoc.close()
+	})
+	defer s.connRegistry.remove(active)
+	active.connected(relayConn)
+	assoc.bytes = active.counters()
+
+	_ = conn.SetDeadline(time.Time{})
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second * 5))
+
+	if err := writeSocks5Reply(conn, socks5RepSucceeded, clientConn.LocalAddr()); err != nil {
+		s.logger.Warn("Failed to send SOCKS5 reply to client",
+			zap.String("remote", remote),
+			zap.Error(err),
+		)
+		return
+	}
+
+	_ = conn.SetWriteDeadline(time.Time{})
+
+	s.metrics.request(socksMethodUdp, outcomeOk)
+
+	assocCtx, assocCancel := context.WithCancel(context.Background())
+	defer assocCancel()
+
+	// Association terminates when control connection is closed
+	go func() {
+		defer assocCancel()
+
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	// Client -> Target
+	go func() {
+		defer assocCancel()
+
+		s.relayUdpFromClient(assocCtx, assoc)
+	}()
+
+	// Target -> Client
+	go func() {
+		defer assocCancel()
+
+		s.relayUdpToClient(assocCtx, assoc)
+	}()
+
+	idleTicker := time.NewTicker(s.socksUdpIdleTimeout / 2)
+	defer idleTicker.Stop()
+
+	for {
+		select {
+		case <-s.srvCtx.Done():
+			return
+		case <-assocCtx.Done():
+			s.logger.Debug("SOCKS5 UDP association closed", zap.String("remote", remote))
+			return
+		case <-idleTicker.C:
+			if assoc.idleSince() > s.socksUdpIdleTimeout {
+				s.logger.Debug("SOCKS5 UDP association expired", zap.String("remote", remote))
+				return
+			}
+		}
+	}
+}
+
+// relayUdpFromClient reads SOCKS5 encapsulated datagrams from client and sends them to destinations
+func (s *Server) relayUdpFromClient(ctx context.Context, assoc *udpAssociation) {
+	buf := make([]byte, socks5UdpBufSize)
+
+	for {
+		n, addr, err := assoc.clientConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		srcAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		srcAddrPort := srcAddr.AddrPort()
+		if srcAddrPort.Addr().Unmap() != assoc.clientIp {
+			continue
+		}
+
+		if clientAddr := assoc.clientAddr.Load(); clientAddr == nil {
+			assoc.clientAddr.Store(srcAddr)
+		} else if clientAddr.AddrPort() != srcAddrPort {
+			continue
+		}
+
+		dstAddr, payload, err := s.parseSocks5UdpDatagram(assoc, buf[:n])
+		if err != nil {
+			s.logger.Debug("Dropping SOCKS5 UDP datagram",
+				zap.String("remote", srcAddr.String()),
+				zap.Error(err),
+			)
+			continue
+		}
+
+		assoc.touch()
+
+		if assoc.limiter != nil {
+			if err := assoc.limiter.wait(ctx, len(payload)); err != nil {
+				return
+			}
+		}
+
+		if _, err := assoc.relayConn.WriteTo(payload, net.UDPAddrFromAddrPort(dstAddr)); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			s.logger.Debug("Failed to relay SOCKS5 UDP datagram",
+				zap.String("remote", srcAddr.String()),
+				zap.String("dst", dstAddr.String()),
+				zap.Error(err),
+			)
+
+			continue
+		}
+
+		if assoc.bytes != nil {
+			assoc.bytes.in.Add(int64(len(payload)))
+		}
+	}
+}
+
+// relayUdpToClient reads datagrams from destinations and sends them SOCKS5 encapsulated to client
+func (s *Server) relayUdpToClient(ctx context.Context, assoc *udpAssociation) {
+	buf := make([]byte, socks5UdpBufSize)
+
+	for {
+		// Reserve space for the biggest possible header (IPv6)
+		const headerSpace = 3 + 1 + 16 + 2
+
+		n, addr, err := assoc.relayConn.ReadFrom(buf[headerSpace:])
+		if err != nil {
+			return
+		}
+
+		srcAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		clientAddr := assoc.clientAddr.Load()
+		if clientAddr == nil {
+			continue
+		}
+
+		assoc.touch()
+
+		if assoc.limiter != nil {
+			if err := assoc.limiter.wait(ctx, n); err != nil {
+				return
+			}
+		}
+
+		header := make([]byte, 0, headerSpace)
+		header = append(header, 0x00, 0x00, 0x00)
+		header = appendSocks5Addr(header, srcAddr.AddrPort())
+
+		start := headerSpace - len(header)
+		copy(buf[start:], header)
+
+		if _, err := assoc.clientConn.WriteTo(buf[start:headerSpace+n], clientAddr); err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			s.logger.Debug("Failed to send SOCKS5 UDP datagram to client",
+				zap.String("remote", clientAddr.String()),
+				zap.Error(err),
+			)
+
+			continue
+		}
+
+		if assoc.bytes != nil {
+			assoc.bytes.out.Add(int64(n))
+		}
+	}
+}
+
+var errSocks5UdpFragmented = errors.New("fragmented datagrams are not supported")
+var errSocks5UdpShort = errors.New("datagram is too short")
+
+// parseSocks5UdpDatagram parses SOCKS5 UDP request header and resolves destination address
+func (s *Server) parseSocks5UdpDatagram(assoc *udpAssociation, datagram []byte) (netip.AddrPort, []byte, error) {
+	// RSV(2) FRAG(1) ATYP(1)
+	if len(datagram) < 4 {
+		return netip.AddrPort{}, nil, errSocks5UdpShort
+	}
+
+	if datagram[2] != 0x00 {
+		return netip.AddrPort{}, nil, errSocks5UdpFragmented
+	}
+
+	r := bytes.NewReader(datagram[4:])
+
+	host, err := readSocks5Addr(r, datagram[3])
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return netip.AddrPort{}, nil, errSocks5UdpShort
+	}
+
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+
+	if s.destCheckFunc != nil {
+		if err := s.destCheckFunc(DialProtocolSocksUdp, target); err != nil {
+			return netip.AddrPort{}, nil, err
+		}
+	}
+
+	if assoc.policy != nil && !assoc.policy.AllowsDestination(target) {
+		return netip.AddrPort{}, nil, ErrDestinationDenied
+	}
+
+	ip, err := s.resolveUdpHost(assoc, host)
+	if err != nil {
+		return netip.AddrPort{}, nil, err
+	}
+
+	dstAddr := netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port[:]))
+
+	if s.destGuard != nil {
+		if reason, denied := s.destGuard.check(ip.Unmap()); denied {
+			return netip.AddrPort{}, nil, &DestinationDeniedError{Target: dstAddr.String(), Addr: ip.Unmap(), Reason: reason}
+		}
+	}
+
+	payload := datagram[len(datagram)-r.Len():]
+
+	return dstAddr, payload, nil
+}
+
+// resolveUdpHost resolves destination host preferring relay socket address family
+func (s *Server) resolveUdpHost(assoc *udpAssociation, host string) (netip.Addr, error) {
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return ip, nil
+	}
+
+	// DNSResolver caches records for their TTL itself
+	_, cached := s.resolver.(*DNSResolver)
+
+	if entry, ok := assoc.resolved[host]; ok && !cached && time.Now().Before(entry.expiresAt) {
+		return entry.ip, nil
+	}
+
+	ctx, cancel := context.WithTimeout(s.srvCtx, 5*time.Second)
+	defer cancel()
+
+	ips, err := s.lookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	ip := ips[0].Unmap()
+
+	// Relay socket bound to specific address can only reach destinations of the same family
+	if relayAddr, ok := assoc.relayConn.LocalAddr().(*net.UDPAddr); ok && !relayAddr.IP.IsUnspecified() {
+		relayIs4 := relayAddr.AddrPort().Addr().Unmap().Is4()
+
+		for _, candidate := range ips {
+			if candidate.Unmap().Is4() == relayIs4 {
+				ip = candidate.Unmap()
+				break
+			}
+		}
+	}
+
+	if !cached {
+		if len(assoc.resolved) >= socks5UdpResolvedCacheSize {
+			clear(assoc.resolved)
+		}
+		assoc.resolved[host] = udpResolved{ip: ip, expiresAt: time.Now().Add(socks5UdpResolvedTTL)}
+	}
+
+	return ip, nil
+}
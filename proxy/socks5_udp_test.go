@@ -0,0 +1,363 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestSocks5UdpAssociation starts SOCKS5 server and requests UDP association without auth,
+// control connection and client facing relay address are returned
+func startTestSocks5UdpAssociation(t *testing.T, options ...Option) (net.Conn, *net.UDPAddr) {
+	t.Helper()
+
+	options = append(options, WithListenAddr("127.0.0.1:0"), WithSocksListenAddr("127.0.0.1:0"))
+	srv := MakeServer(MakeNoIpDialerFactory(nil), options...)
+
+	ctrlConn, err := net.Dial("tcp4", startTestServer(t, srv)["socks5"])
+	if err != nil {
+		t.Fatalf("Failed to connect to SOCKS5 server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = ctrlConn.Close()
+	})
+
+	_ = ctrlConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, _ = ctrlConn.Write([]byte{socks5Version, 1, socks5AuthNone})
+
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(ctrlConn, method); err != nil || method[1] != socks5AuthNone {
+		t.Fatalf("Auth method selection failed: %v, %v", method, err)
+	}
+
+	_, _ = ctrlConn.Write(appendSocks5Addr([]byte{socks5Version, socks5CmdUdpAssociate, 0x00}, netip.AddrPortFrom(netip.IPv4Unspecified(), 0)))
+
+	rep, relayAddr := readTestSocks5Reply(t, ctrlConn)
+	if rep != socks5RepSucceeded {
+		t.Fatalf("UDP ASSOCIATE reply code got = %d, want %d", rep, socks5RepSucceeded)
+	}
+
+	_ = ctrlConn.SetDeadline(time.Time{})
+
+	return ctrlConn, net.UDPAddrFromAddrPort(relayAddr)
+}
+
+func TestSocks5UdpRelay(t *testing.T) {
+	// Echo server reports every received payload, so dropped datagrams can be detected
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+
+	received := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			received <- string(buf[:n])
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	_, relayAddr := startTestSocks5UdpAssociation(t)
+
+	listenClient := func(addr string) net.PacketConn {
+		conn, err := net.ListenPacket("udp4", addr)
+		if err != nil {
+			t.Fatalf("Failed to listen client socket: %v", err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		return conn
+	}
+
+	echoAddr := netip.MustParseAddrPort(echo.LocalAddr().String())
+	datagram := func(frag byte, payload string) []byte {
+		return append(appendSocks5Addr([]byte{0x00, 0x00, frag}, echoAddr), payload...)
+	}
+
+	nextReceived := func() string {
+		select {
+		case payload := <-received:
+			return payload
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Datagram is not relayed")
+			return ""
+		}
+	}
+
+	// Datagram from other IP than the control connection's one is dropped and doesn't lock in client address
+	otherIpClient := listenClient("127.0.0.2:0")
+	_, _ = otherIpClient.WriteTo(datagram(0x00, "other ip"), relayAddr)
+
+	client := listenClient("127.0.0.1:0")
+	_, _ = client.WriteTo(datagram(0x01, "fragment"), relayAddr)
+	_, _ = client.WriteTo(datagram(0x00, "ping"), relayAddr)
+
+	if payload := nextReceived(); payload != "ping" {
+		t.Fatalf("Relayed payload got = %q, want %q", payload, "ping")
+	}
+
+	// Reply is encapsulated with the destination address
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 1024)
+	n, _, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Failed to read reply datagram: %v", err)
+	}
+
+	if want := datagram(0x00, "ping"); !bytes.Equal(buf[:n], want) {
+		t.Errorf("Reply datagram got = %v, want %v", buf[:n], want)
+	}
+
+	// Client address is locked in, datagrams from other ports of the same IP are dropped
+	otherPortClient := listenClient("127.0.0.1:0")
+	_, _ = otherPortClient.WriteTo(datagram(0x00, "other port"), relayAddr)
+	_, _ = client.WriteTo(datagram(0x00, "pong"), relayAddr)
+
+	if payload := nextReceived(); payload != "pong" {
+		t.Fatalf("Relayed payload got = %q, want %q", payload, "pong")
+	}
+}
+
+func TestSocks5UdpIdleExpiry(t *testing.T) {
+	ctrlConn, _ := startTestSocks5UdpAssociation(t, WithSocksUdpIdleTimeout(50*time.Millisecond))
+
+	_ = ctrlConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Control connection is closed by the server once association expires
+	_, err := ctrlConn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Errorf("Idle association is not closed, read error = %v", err)
+	}
+}
+
+func TestSocks5UdpDatagramPolicy(t *testing.T) {
+	srv := MakeServer(MakeNoIpDialerFactory(nil))
+
+	policy, err := ParseUserPolicy(map[string]string{"deny": "192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("ParseUserPolicy() error = %v", err)
+	}
+
+	assoc := &udpAssociation{policy: policy, resolved: make(map[string]udpResolved)}
+
+	datagram := func(dst string) []byte {
+		return append(appendSocks5Addr([]byte{0x00, 0x00, 0x00}, netip.MustParseAddrPort(dst)), "payload"...)
+	}
+
+	if _, _, err := srv.parseSocks5UdpDatagram(assoc, datagram("192.0.2.1:53")); !errors.Is(err, ErrDestinationDenied) {
+		t.Errorf("Datagram to denied destination error = %v, want %v", err, ErrDestinationDenied)
+	}
+
+	dstAddr, payload, err := srv.parseSocks5UdpDatagram(assoc, datagram("198.51.100.1:53"))
+	if err != nil {
+		t.Fatalf("Datagram to allowed destination error = %v", err)
+	}
+
+	if dstAddr != netip.MustParseAddrPort("198.51.100.1:53") || string(payload) != "payload" {
+		t.Errorf("Parsed datagram got = %v %q", dstAddr, payload)
+	}
+}
+
+func TestSocks5UdpDatagramRules(t *testing.T) {
+	rules, err := ReadDestinationRules(strings.NewReader("deny 192.0.2.0/24\nconnect-ports 53\n"))
+	if err != nil {
+		t.Fatalf("ReadDestinationRules() error = %v", err)
+	}
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil), WithDestinationCheckFunc(rules.Check))
+
+	assoc := &udpAssociation{resolved: make(map[string]udpResolved)}
+
+	datagram := func(dst string) []byte {
+		return append(appendSocks5Addr([]byte{0x00, 0x00, 0x00}, netip.MustParseAddrPort(dst)), "payload"...)
+	}
+
+	for _, dst := range []string{"192.0.2.1:53", "198.51.100.1:123"} {
+		if _, _, err := srv.parseSocks5UdpDatagram(assoc, datagram(dst)); !errors.Is(err, ErrDestinationDenied) {
+			t.Errorf("Datagram to %s error = %v, want %v", dst, err, ErrDestinationDenied)
+		}
+	}
+
+	if _, _, err := srv.parseSocks5UdpDatagram(assoc, datagram("198.51.100.1:53")); err != nil {
+		t.Errorf("Datagram to allowed destination error = %v", err)
+	}
+}
+
+// countingTestResolver resolves every host to the next address of the sequence
+type countingTestResolver struct {
+	lookups int
+}
+
+func (r *countingTestResolver) LookupNetIP(_ context.Context, _, _ string) ([]netip.Addr, error) {
+	r.lookups++
+
+	return []netip.Addr{netip.AddrFrom4([4]byte{192, 0, 2, byte(r.lookups)})}, nil
+}
+
+func TestSocks5UdpResolvedExpiry(t *testing.T) {
+	resolver := &countingTestResolver{}
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil), WithResolver(resolver))
+	srv.srvCtx = context.Background()
+
+	relayConn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer relayConn.Close()
+
+	assoc := &udpAssociation{relayConn: relayConn, resolved: make(map[string]udpResolved)}
+
+	resolve := func() netip.Addr {
+		ip, err := srv.resolveUdpHost(assoc, "example.com")
+		if err != nil {
+			t.Fatalf("resolveUdpHost() error = %v", err)
+		}
+
+		return ip
+	}
+
+	first := resolve()
+	if got := resolve(); got != first || resolver.lookups != 1 {
+		t.Errorf("resolveUdpHost() of cached host got = %v after %d lookups, want %v after 1 lookup", got, resolver.lookups, first)
+	}
+
+	// Expired result is resolved again
+	entry := assoc.resolved["example.com"]
+	entry.expiresAt = time.Now().Add(-time.Second)
+	assoc.resolved["example.com"] = entry
+
+	if got := resolve(); got == first || resolver.lookups != 2 {
+		t.Errorf("resolveUdpHost() of expired host got = %v after %d lookups, want new address after 2 lookups", got, resolver.lookups)
+	}
+}
+
+func TestSocks5UdpAssociationRegistry(t *testing.T) {
+	registry := MakeConnRegistry()
+
+	ctrlConn, relayAddr := startTestSocks5UdpAssociation(t, WithConnRegistry(registry))
+
+	conns := registry.List()
+	if len(conns) != 1 || conns[0].Protocol != DialProtocolSocksUdp || conns[0].Client != ctrlConn.LocalAddr().String() {
+		t.Fatalf("Registered connections got = %+v, want UDP association", conns)
+	}
+
+	if !registry.Kill(conns[0].ID) {
+		t.Fatalf("Kill() of UDP association failed")
+	}
+
+	// Control connection and relay sockets are closed
+	_ = ctrlConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err := ctrlConn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); err == nil || ok && netErr.Timeout() {
+		t.Errorf("Killed association control connection is still open, read error = %v", err)
+	}
+
+	for i := 0; i < 50 && len(registry.List()) > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if conns := registry.List(); len(conns) != 0 {
+		t.Errorf("Killed association is still listed: %+v", conns)
+	}
+
+	// Client facing relay socket is closed, so its address can be bound again
+	relayConn, err := net.ListenPacket("udp4", relayAddr.String())
+	if err != nil {
+		t.Fatalf("Killed association relay socket is still open: %v", err)
+	}
+	_ = relayConn.Close()
+}
+
+func TestSocks5UdpRelayPolicyPrefixes(t *testing.T) {
+	echo, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+
+	allowed := netip.MustParsePrefix("127.0.5.0/24")
+	policy := &UserPolicy{Prefixes: []netip.Prefix{allowed}}
+
+	factory := MakeRandIpDialerFactory(rand.New(rand.NewPCG(1, 2)), netip.MustParsePrefix("127.0.0.0/16"))
+
+	srv := MakeServer(factory,
+		WithListenAddr("127.0.0.1:0"),
+		WithSocksListenAddr("127.0.0.1:0"),
+		WithAuthFunc(func(usr, passwd string) bool {
+			return passwd == "pass"
+		}),
+		WithPolicyFunc(func(usr *ProxyUser) *UserPolicy {
+			if usr.Name == "limited" {
+				return policy
+			}
+
+			return nil
+		}),
+	)
+
+	socksAddr := startTestServer(t, srv)["socks5"]
+
+	for i := 0; i < 5; i++ {
+		ctrlConn, err := net.Dial("tcp4", socksAddr)
+		if err != nil {
+			t.Fatalf("Failed to connect to SOCKS5 server: %v", err)
+		}
+		_ = ctrlConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		_, _ = ctrlConn.Write([]byte{socks5Version, 1, socks5AuthUserPass})
+		_, _ = ctrlConn.Write(append([]byte{socks5UserPassVersion, 7}, "limited\x04pass"...))
+
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(ctrlConn, reply); err != nil || reply[3] != socks5UserPassOk {
+			t.Fatalf("Authentication failed: %v, %v", reply, err)
+		}
+
+		_, _ = ctrlConn.Write(appendSocks5Addr([]byte{socks5Version, socks5CmdUdpAssociate, 0x00}, netip.AddrPortFrom(netip.IPv4Unspecified(), 0)))
+
+		rep, relayAddr := readTestSocks5Reply(t, ctrlConn)
+		if rep != socks5RepSucceeded {
+			t.Fatalf("UDP ASSOCIATE reply code got = %d, want %d", rep, socks5RepSucceeded)
+		}
+
+		client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen client socket: %v", err)
+		}
+
+		datagram := appendSocks5Addr([]byte{0x00, 0x00, 0x00}, netip.MustParseAddrPort(echo.LocalAddr().String()))
+		_, _ = client.WriteTo(append(datagram, "ping"...), net.UDPAddrFromAddrPort(relayAddr))
+
+		_ = echo.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+		_, src, err := echo.ReadFrom(make([]byte, 1024))
+		if err != nil {
+			t.Fatalf("Datagram is not relayed: %v", err)
+		}
+
+		if srcIp := src.(*net.UDPAddr).AddrPort().Addr().Unmap(); !allowed.Contains(srcIp) {
+			t.Errorf("Relay source IP got = %v, want IP of %s", srcIp, allowed)
+		}
+
+		_ = client.Close()
+		_ = ctrlConn.Close()
+	}
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/codercms/freebind-proxy/utils"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// DeniedDestination is the range of destination addresses proxy must not connect to
+type DeniedDestination struct {
+	Range utils.IPRange
+	// Reason is reported to the client, e.g. "loopback"
+	Reason string
+}
+
+// DestinationDeniedError is returned when destination resolves to the denied address
+type DestinationDeniedError struct {
+	Target string
+	Addr   netip.Addr
+	Reason string
+}
+
+func (e *DestinationDeniedError) Error() string {
+	return fmt.Sprintf("destination %s resolves to %s address %s", e.Target, e.Reason, e.Addr)
+}
+
+// Is makes denied destination match [ErrDestinationDenied]
+func (e *DestinationDeniedError) Is(target error) bool {
+	return target == ErrDestinationDenied
+}
+
+// DefaultDeniedDestinations returns non-public address ranges: loopback, private, link-local (incl. cloud metadata),
+// shared, multicast, reserved and IPv6 ranges embedding IPv4 addresses (NAT64, 6to4)
+func DefaultDeniedDestinations() []DeniedDestination {
+	ranges := []struct {
+		prefix string
+		reason string
+	}{
+		{"0.0.0.0/8", "unspecified"},
+		{"127.0.0.0/8", "loopback"},
+		{"10.0.0.0/8", "private"},
+		{"172.16.0.0/12", "private"},
+		{"192.168.0.0/16", "private"},
+		{"100.64.0.0/10", "shared"},
+		{"169.254.0.0/16", "link-local"},
+		{"192.0.0.0/24", "reserved"},
+		{"198.18.0.0/15", "reserved"},
+		{"224.0.0.0/4", "multicast"},
+		{"240.0.0.0/4", "reserved"},
+		{"::/128", "unspecified"},
+		{"::1/128", "loopback"},
+		{"64:ff9b::/96", "nat64"},
+		{"64:ff9b:1::/48", "private"},
+		{"2002::/16", "6to4"},
+		{"fc00::/7", "private"},
+		{"fe80::/10", "link-local"},
+		{"ff00::/8", "multicast"},
+	}
+
+	denied := make([]DeniedDestination, len(ranges))
+	for i, r := range ranges {
+		denied[i] = DeniedDestination{
+			Range:  utils.IPRangeFromPrefix(netip.MustParsePrefix(r.prefix)),
+			Reason: r.reason,
+		}
+	}
+
+	return denied
+}
+
+// DestinationGuard protects from SSRF: destination host is resolved once, every resolved address is checked
+// against denied ranges and then exactly the checked addresses are dialed, so DNS rebinding can't bypass the check
+type DestinationGuard struct {
+	Deny []DeniedDestination
+	// Allow are exceptions from the denied ranges
+	Allow utils.IPSet
+}
+
+// Check checks resolved addresses of the destination host:port, destination is denied (see [DestinationDeniedError])
+// when any of them is denied
+func (g *DestinationGuard) Check(target string, addrs []netip.Addr) error {
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+
+		if reason, denied := g.check(addr); denied {
+			return &DestinationDeniedError{Target: target, Addr: addr, Reason: reason}
+		}
+	}
+
+	return nil
+}
+
+func (g *DestinationGuard) check(addr netip.Addr) (string, bool) {
+	if g.Allow.Contains(addr) {
+		return "", false
+	}
+
+	for _, d := range g.Deny {
+		if d.Range.Contains(addr) {
+			return d.Reason, true
+		}
+	}
+
+	return "", false
+}
+
+// resolveTarget resolves destination host:port with the configured resolver and checks resolved addresses
+// with the destination guard, nil is returned when neither of them is configured, so dialer resolves host itself
+func (s *Server) resolveTarget(ctx context.Context, network, target string) ([]string, error) {
+	if s.resolver == nil && s.destGuard == nil {
+		return nil, nil
+	}
+
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
+
+	ipNetwork := "ip"
+	if strings.HasSuffix(network, "4") || strings.HasSuffix(network, "6") {
+		ipNetwork += network[len(network)-1:]
+	}
+
+	addrs, err := s.lookupNetIP(ctx, ipNetwork, host)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.destGuard != nil {
+		if err := s.destGuard.Check(target, addrs); err != nil {
+			return nil, err
+		}
+	}
+
+	resolved := make([]string, len(addrs))
+	for i, addr := range addrs {
+		resolved[i] = net.JoinHostPort(addr.Unmap().String(), port)
+	}
+
+	if len(resolved) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return resolved, nil
+}
+
+// dialAddrs dials resolved addresses, addresses of each family are dialed one by one until connection succeeds.
+// Dual stack destinations are dialed with Happy Eyeballs like [net.Dialer] does: family of the first address
+// is dialed first and the other family is raced after the dialer fallback delay or once the first family fails,
+// dialer binds socket of each family to its own source IP
+func dialAddrs(ctx context.Context, dialer *net.Dialer, network string, addrs []string) (net.Conn, error) {
+	primaries, fallbacks := splitAddrsByFamily(addrs)
+	if len(fallbacks) == 0 || dialer.FallbackDelay < 0 {
+		return dialSerial(ctx, dialer, network, addrs)
+	}
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	startRacer := func(addrs []string, primary bool) {
+		conn, err := dialSerial(ctx, dialer, network, addrs)
+
+		select {
+		case results <- dialResult{conn: conn, err: err, primary: primary}:
+		case <-ctx.Done():
+			if conn != nil {
+				_ = conn.Close()
+			}
+		}
+	}
+
+	go startRacer(primaries, true)
+
+	fallbackDelay := dialer.FallbackDelay
+	if fallbackDelay == 0 {
+		fallbackDelay = defaultFallbackDelay
+	}
+
+	fallbackTimer := time.NewTimer(fallbackDelay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr, fallbackErr error
+	fallbackStarted := false
+
+	for {
+		select {
+		case <-fallbackTimer.C:
+			fallbackStarted = true
+			go startRacer(fallbacks, false)
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+
+			if primaryErr != nil && fallbackErr != nil {
+				return nil, errors.Join(primaryErr, fallbackErr)
+			}
+
+			if res.primary && !fallbackStarted && fallbackTimer.Stop() {
+				fallbackStarted = true
+				go startRacer(fallbacks, false)
+			}
+		}
+	}
+}
+
+// defaultFallbackDelay is the delay of the fallback family dial, same as [net.Dialer] default
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// splitAddrsByFamily splits host:port addresses into addresses of the first address family and the others
+func splitAddrsByFamily(addrs []string) (primaries, fallbacks []string) {
+	var primaryIs4 bool
+
+	for i, addr := range addrs {
+		addrPort, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			primaries = append(primaries, addr)
+
+			continue
+		}
+
+		is4 := addrPort.Addr().Unmap().Is4()
+		if i == 0 {
+			primaryIs4 = is4
+		}
+
+		if is4 == primaryIs4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+
+	return primaries, fallbacks
+}
+
+// dialSerial dials addresses one by one until connection succeeds
+func dialSerial(ctx context.Context, dialer *net.Dialer, network string, addrs []string) (net.Conn, error) {
+	var errs []error
+
+	for _, addr := range addrs {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			return conn, nil
+		}
+
+		errs = append(errs, err)
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	if len(errs) == 1 {
+		return nil, errs[0]
+	}
+
+	return nil, errors.Join(errs...)
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDestinationGuardCheck(t *testing.T) {
+	guard := &DestinationGuard{Deny: DefaultDeniedDestinations()}
+	guard.Allow.Add(netip.MustParseAddr("10.1.2.3"))
+
+	tests := []struct {
+		target     string
+		wantReason string
+	}{
+		{"127.0.0.1:80", "loopback"},
+		{"[::1]:80", "loopback"},
+		{"[::ffff:127.0.0.1]:80", "loopback"},
+		{"169.254.169.254:80", "link-local"},
+		{"192.168.1.1:443", "private"},
+		{"[fd00::1]:443", "private"},
+		{"0.0.0.0:80", "unspecified"},
+		{"[64:ff9b::a9fe:a9fe]:80", "nat64"},
+		{"[2002:7f00:1::1]:80", "6to4"},
+		{"10.1.2.3:80", ""},
+		{"1.1.1.1:443", ""},
+		{"[2606:4700::1111]:443", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			addrPort := netip.MustParseAddrPort(tt.target)
+
+			err := guard.Check(tt.target, []netip.Addr{netip.MustParseAddr("1.0.0.1"), addrPort.Addr()})
+			if tt.wantReason == "" {
+				if err != nil {
+					t.Fatalf("Check() error = %v", err)
+				}
+
+				return
+			}
+
+			var deniedErr *DestinationDeniedError
+			if !errors.As(err, &deniedErr) {
+				t.Fatalf("Check() error = %v, want %T", err, deniedErr)
+			}
+
+			if deniedErr.Reason != tt.wantReason {
+				t.Errorf("Check() reason got = %q, want %q", deniedErr.Reason, tt.wantReason)
+			}
+
+			if !errors.Is(err, ErrDestinationDenied) {
+				t.Errorf("Check() error doesn't match %v", ErrDestinationDenied)
+			}
+		})
+	}
+}
+
+func TestServerDestinationGuard(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	guard := &DestinationGuard{Deny: DefaultDeniedDestinations()}
+	srv := MakeServer(MakeNoIpDialerFactory(nil), WithDestinationGuard(guard))
+
+	_, err = srv.dial(context.Background(), DialProtocolConnect, "127.0.0.1:1234", "tcp", listener.Addr().String())
+	if status := dialErrorStatus(err, http.StatusServiceUnavailable); status != http.StatusForbidden {
+		t.Errorf("dialErrorStatus() got = %d, want %d (err = %v)", status, http.StatusForbidden, err)
+	}
+
+	if msg := dialErrorMessage(err, ""); !strings.Contains(msg, "loopback") {
+		t.Errorf("dialErrorMessage() got = %q, want reason", msg)
+	}
+
+	guard.Allow.AddPrefix(netip.MustParsePrefix("127.0.0.0/8"))
+
+	conn, err := srv.dial(context.Background(), DialProtocolConnect, "127.0.0.1:1234", "tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial() to allowed exception error = %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestDialAddrsHappyEyeballs(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+
+	// IPv6 attempt hangs until it's canceled, so IPv4 must win after the fallback delay
+	dialer := &net.Dialer{
+		FallbackDelay: 10 * time.Millisecond,
+		ControlContext: func(ctx context.Context, network, _ string, _ syscall.RawConn) error {
+			if network == "tcp6" {
+				<-ctx.Done()
+
+				return ctx.Err()
+			}
+
+			return nil
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs := []string{"[2001:db8::1]:80", listener.Addr().String()}
+
+	conn, err := dialAddrs(ctx, dialer, "tcp", addrs)
+	if err != nil {
+		t.Fatalf("dialAddrs() error = %v", err)
+	}
+	_ = conn.Close()
+
+	if ctx.Err() != nil {
+		t.Errorf("dialAddrs() waited for the primary family")
+	}
+
+	// Without fallback addresses are dialed one by one
+	dialer.FallbackDelay = -1
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer shortCancel()
+
+	if _, err := dialAddrs(shortCtx, dialer, "tcp", addrs); err == nil {
+		t.Errorf("dialAddrs() with disabled fallback succeeded")
+	}
+}
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var ErrUdpNotSupported = errors.New("dialer factory does not support UDP")
+
+type stickySession struct {
+	key       string
+	dialer    *net.Dialer
+	expiresAt time.Time
+
+	// udpAddr is the source IP of the session UDP relay sockets, it's picked by the first association
+	udpAddr netip.Addr
+}
+
+// DefaultMaxStickySessions is the default limit of the pinned sessions
+const DefaultMaxStickySessions = 100_000
+
+// StickyDialerFactory pins dialers provided by the underlying factory to sessions for the configured TTL,
+// session is passed by the proxy user (see [ProxyUser.Session]),
+// requests without session get fresh dialer from the underlying factory
+type StickyDialerFactory struct {
+	factory RequestDialerFactoryIface
+
+	ttl         time.Duration
+	maxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]*list.Element
+	// order keeps sessions ordered by pin time, so the oldest and the expired ones are at the front
+	order *list.List
+}
+
+func MakeStickyDialerFactory(factory RequestDialerFactoryIface, ttl time.Duration) *StickyDialerFactory {
+	return &StickyDialerFactory{
+		factory:     factory,
+		ttl:         ttl,
+		maxSessions: DefaultMaxStickySessions,
+
+		sessions: make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// SetMaxSessions limits number of the pinned sessions, the oldest session is evicted when limit is reached,
+// default is [DefaultMaxStickySessions]
+func (f *StickyDialerFactory) SetMaxSessions(maxSessions int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.maxSessions = max(maxSessions, 1)
+}
+
+// SetSocketOptions passes socket options to the underlying factory, when it supports them
+func (f *StickyDialerFactory) SetSocketOptions(opts *SocketOptions) {
+	if setter, ok := f.factory.(SocketOptionsSetter); ok {
+		setter.SetSocketOptions(opts)
+	}
+}
+
+// GetDialer implements [DialerFactoryIface], it provides dialer of the request without session, nil on error
+func (f *StickyDialerFactory) GetDialer() *net.Dialer {
+	dialer, _ := f.factory.GetRequestDialer(context.Background(), &DialRequest{})
+
+	return dialer
+}
+
+func (f *StickyDialerFactory) GetRequestDialer(ctx context.Context, req *DialRequest) (*net.Dialer, error) {
+	if req.User == nil || len(req.User.Session()) == 0 {
+		return f.factory.GetRequestDialer(ctx, req)
+	}
+
+	return f.getSessionDialer(ctx, req)
+}
+
+// getSessionDialer returns dialer pinned to the session, new dialer is requested from the underlying factory
+// when session is unknown, expired or dial is retried
+func (f *StickyDialerFactory) getSessionDialer(ctx context.Context, req *DialRequest) (*net.Dialer, error) {
+	key := stickySessionKey(req.User)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Time is taken under the lock, so sessions are pushed in expiration order
+	now := time.Now()
+
+	// Drop expired sessions, so abandoned sessions do not pile up
+	for elem := f.order.Front(); elem != nil && !now.Before(elem.Value.(*stickySession).expiresAt); elem = f.order.Front() {
+		f.remove(elem)
+	}
+
+	elem, ok := f.sessions[key]
+
+	// Retried dial means the pinned source IP failed, so session is pinned to the new dialer
+	if ok && req.Attempt == 0 {
+		return elem.Value.(*stickySession).dialer, nil
+	}
+
+	dialer, err := f.factory.GetRequestDialer(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		f.remove(elem)
+	}
+
+	for f.order.Len() >= f.maxSessions {
+		f.remove(f.order.Front())
+	}
+
+	sess := &stickySession{
+		key:       key,
+		dialer:    dialer,
+		expiresAt: now.Add(f.ttl),
+	}
+	f.sessions[key] = f.order.PushBack(sess)
+
+	return sess.dialer, nil
+}
+
+// stickySessionKey returns key of the user session, sessions of different users must not share dialers
+func stickySessionKey(usr *ProxyUser) string {
+	return usr.Name + "\x00" + usr.Session()
+}
+
+func (f *StickyDialerFactory) remove(elem *list.Element) {
+	delete(f.sessions, elem.Value.(*stickySession).key)
+	f.order.Remove(elem)
+}
+
+// ListenPacket delegates to the underlying factory, relay sockets of the session are bound to the same source IP
+// while session is pinned, when underlying factory supports it
+func (f *StickyDialerFactory) ListenPacket(ctx context.Context, req *DialRequest) (net.PacketConn, error) {
+	plFactory, ok := f.factory.(PacketListenerFactoryIface)
+	if !ok {
+		return nil, ErrUdpNotSupported
+	}
+
+	addrListener, ok := f.factory.(addrPacketListener)
+	if !ok || req.User == nil || len(req.User.Session()) == 0 {
+		return plFactory.ListenPacket(ctx, req)
+	}
+
+	// Session is pinned (or refreshed) first, so UDP source IP expires together with the session dialer
+	if _, err := f.getSessionDialer(ctx, req); err != nil {
+		return nil, err
+	}
+
+	key := stickySessionKey(req.User)
+
+	f.mu.Lock()
+	var addr netip.Addr
+	if elem, ok := f.sessions[key]; ok {
+		addr = elem.Value.(*stickySession).udpAddr
+	}
+	f.mu.Unlock()
+
+	if addr.IsValid() {
+		return addrListener.listenPacketAddr(ctx, addr)
+	}
+
+	conn, err := plFactory.ListenPacket(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		f.mu.Lock()
+		if elem, ok := f.sessions[key]; ok {
+			elem.Value.(*stickySession).udpAddr = udpAddr.AddrPort().Addr().Unmap()
+		}
+		f.mu.Unlock()
+	}
+
+	return conn, nil
+}
+
+// supportsPrefixes delegates to the underlying factory, factories which don't pick source IP ignore prefixes
+func (f *StickyDialerFactory) supportsPrefixes() bool {
+	if supporter, ok := f.factory.(prefixesSupporter); ok {
+		return supporter.supportsPrefixes()
+	}
+
+	return true
+}
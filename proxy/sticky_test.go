@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestStickyDialerFactory(t *testing.T) {
+	var requests []*DialRequest
+
+	factory := MakeStickyDialerFactory(DialerFactoryFunc(func(ctx context.Context, req *DialRequest) (*net.Dialer, error) {
+		requests = append(requests, req)
+
+		return &net.Dialer{}, nil
+	}), time.Minute)
+
+	getDialer := func(username string) *net.Dialer {
+		usr := ParseProxyUser(username)
+
+		dialer, err := factory.GetRequestDialer(context.Background(), &DialRequest{
+			User:     &usr,
+			Target:   "example.com:443",
+			Protocol: DialProtocolConnect,
+		})
+		if err != nil {
+			t.Fatalf("GetRequestDialer() error = %v", err)
+		}
+
+		return dialer
+	}
+
+	if getDialer("user-session-a") != getDialer("user-session-a") {
+		t.Errorf("GetRequestDialer() got different dialers for the same session")
+	}
+
+	if getDialer("user-session-a") == getDialer("other-session-a") {
+		t.Errorf("GetRequestDialer() got the same dialer for sessions of different users")
+	}
+
+	if getDialer("user") == getDialer("user") {
+		t.Errorf("GetRequestDialer() got the same dialer for requests without session")
+	}
+
+	if len(requests) != 4 {
+		t.Fatalf("Underlying factory got %d requests, want 4", len(requests))
+	}
+
+	if req := requests[0]; req.User.Name != "user" || req.Target != "example.com:443" || req.Protocol != DialProtocolConnect {
+		t.Errorf("Underlying factory got request = %+v", req)
+	}
+}
+
+func TestStickyDialerFactoryMaxSessions(t *testing.T) {
+	factory := MakeStickyDialerFactory(DialerFactoryFunc(func(ctx context.Context, req *DialRequest) (*net.Dialer, error) {
+		return &net.Dialer{}, nil
+	}), time.Minute)
+	factory.SetMaxSessions(2)
+
+	getDialer := func(username string) *net.Dialer {
+		usr := ParseProxyUser(username)
+
+		dialer, err := factory.GetRequestDialer(context.Background(), &DialRequest{User: &usr, Target: "example.com:443"})
+		if err != nil {
+			t.Fatalf("GetRequestDialer() error = %v", err)
+		}
+
+		return dialer
+	}
+
+	a, b := getDialer("user-session-a"), getDialer("user-session-b")
+
+	// Oldest session is evicted
+	c := getDialer("user-session-c")
+
+	if len(factory.sessions) != 2 {
+		t.Errorf("Sessions count got = %d, want 2", len(factory.sessions))
+	}
+
+	if getDialer("user-session-c") != c || getDialer("user-session-b") != b {
+		t.Errorf("GetRequestDialer() got different dialers for the kept sessions")
+	}
+
+	if getDialer("user-session-a") == a {
+		t.Errorf("GetRequestDialer() got dialer of the evicted session")
+	}
+}
+
+func TestStickyDialerFactoryListenPacket(t *testing.T) {
+	allowed := netip.MustParsePrefix("127.0.5.0/24")
+
+	factory := MakeStickyDialerFactory(MakeRandIpDialerFactory(rand.New(rand.NewPCG(1, 2)), netip.MustParsePrefix("127.0.0.0/16")), time.Minute)
+
+	listen := func(username string) netip.Addr {
+		usr := ParseProxyUser(username)
+
+		conn, err := factory.ListenPacket(context.Background(), &DialRequest{
+			User:     &usr,
+			Protocol: DialProtocolSocksUdp,
+			Prefixes: []netip.Prefix{allowed},
+		})
+		if err != nil {
+			t.Fatalf("ListenPacket() error = %v", err)
+		}
+		defer conn.Close()
+
+		addr := conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap()
+		if !allowed.Contains(addr) {
+			t.Errorf("ListenPacket() local IP got = %v, want IP of %s", addr, allowed)
+		}
+
+		return addr
+	}
+
+	if a, b := listen("user-session-a"), listen("user-session-a"); a != b {
+		t.Errorf("ListenPacket() got different IPs %v and %v for the same session", a, b)
+	}
+
+	// Requests without session get random IPs
+	seen := make(map[netip.Addr]bool)
+	for i := 0; i < 10; i++ {
+		seen[listen("user")] = true
+	}
+
+	if len(seen) < 2 {
+		t.Errorf("ListenPacket() got the same IP for requests without session")
+	}
+}
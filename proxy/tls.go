@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval limits how often certificate files are checked for changes
+const certCheckInterval = 5 * time.Second
+
+// FileCertificate is a TLS certificate loaded from PEM files which is reloaded when files change,
+// so renewed certificates are picked up without restart, see [FileCertificate.GetCertificate]
+type FileCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// LoadFileCertificate loads certificate and key from the PEM files
+func LoadFileCertificate(certFile, keyFile string) (*FileCertificate, error) {
+	c := &FileCertificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload loads certificate files again, previous certificate is kept on error
+func (c *FileCertificate) Reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cert = &cert
+	c.modTime = modTime
+	c.checkedAt = time.Now()
+
+	return nil
+}
+
+// GetCertificate returns current certificate, it can be used as [tls.Config.GetCertificate].
+// Certificate is reloaded when certificate or key file modification time changes
+func (c *FileCertificate) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+
+	now := time.Now()
+	if now.Sub(c.checkedAt) < certCheckInterval {
+		defer c.mu.Unlock()
+
+		return c.cert, nil
+	}
+
+	c.checkedAt = now
+	cert, loadedModTime := c.cert, c.modTime
+
+	c.mu.Unlock()
+
+	modTime, err := c.filesModTime()
+	if err != nil || modTime.Equal(loadedModTime) {
+		// Files may be replaced right now, so current certificate is used until they are readable again
+		return cert, nil
+	}
+
+	if err := c.Reload(); err != nil {
+		return cert, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cert, nil
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (c *FileCertificate) filesModTime() (time.Time, error) {
+	var modTime time.Time
+
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat TLS certificate file: %w", err)
+		}
+
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+// GenerateSelfSignedCertificate generates ECDSA P-256 self-signed certificate for the hosts (DNS names or IPs)
+// valid for one year
+func GenerateSelfSignedCertificate(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to generate serial number: %w", err)
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "freebind-proxy"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to create certificate: %w", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// CertificateFingerprint returns SHA-256 fingerprint of the certificate leaf in hex,
+// it allows clients to pin self-signed certificate
+func CertificateFingerprint(cert *tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256(cert.Certificate[0])
+
+	return hex.EncodeToString(sum[:])
+}
+
+// proxyTLSConfig returns copy of the config suitable for the proxy listener,
+// HTTP/2 is not negotiated because CONNECT tunnels require hijacking of the HTTP/1.1 connection
+func proxyTLSConfig(cfg *tls.Config) *tls.Config {
+	cfg = cfg.Clone()
+
+	if len(cfg.NextProtos) == 0 {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+
+	return cfg
+}
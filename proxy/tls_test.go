@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCertificate(t *testing.T, certFile, keyFile string, cert tls.Certificate) {
+	t.Helper()
+
+	keyDer, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatalf("Failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+}
+
+func TestFileCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	first, err := GenerateSelfSignedCertificate("localhost")
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCertificate() error = %v", err)
+	}
+	writeTestCertificate(t, certFile, keyFile, first)
+
+	fileCert, err := LoadFileCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadFileCertificate() error = %v", err)
+	}
+
+	second, err := GenerateSelfSignedCertificate("localhost")
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCertificate() error = %v", err)
+	}
+	writeTestCertificate(t, certFile, keyFile, second)
+
+	// Make change visible regardless of the file system timestamp resolution and skip the check interval
+	future := time.Now().Add(time.Minute)
+	_ = os.Chtimes(certFile, future, future)
+	fileCert.checkedAt = time.Time{}
+
+	got, err := fileCert.GetCertificate(nil)
+	if err != nil {
+		t.Fatalf("GetCertificate() error = %v", err)
+	}
+
+	if CertificateFingerprint(got) != CertificateFingerprint(&second) {
+		t.Errorf("GetCertificate() returned stale certificate")
+	}
+}
+
+func TestServerTLS(t *testing.T) {
+	cert, err := GenerateSelfSignedCertificate("127.0.0.1")
+	if err != nil {
+		t.Fatalf("GenerateSelfSignedCertificate() error = %v", err)
+	}
+
+	srv := MakeServer(MakeNoIpDialerFactory(nil),
+		WithListenAddr("127.0.0.1:0"),
+		WithTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+	)
+
+	proxyAddr := startTestServer(t, srv)["http"]
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})
+
+	plainTarget := httptest.NewServer(handler)
+	defer plainTarget.Close()
+
+	tlsTarget := httptest.NewTLSServer(handler)
+	defer tlsTarget.Close()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{Scheme: "https", Host: proxyAddr}),
+			// Both proxy and target certificates are self-signed
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: 5 * time.Second,
+	}
+
+	// Absolute-form request and CONNECT tunnel
+	for _, target := range []string{plainTarget.URL, tlsTarget.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("Request to %s through TLS proxy failed: %v", target, err)
+		}
+
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+
+		if string(body) != "ok" {
+			t.Errorf("Response of %s got = %q, want %q", target, body, "ok")
+		}
+	}
+}
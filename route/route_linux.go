@@ -0,0 +1,249 @@
+//go:build linux
+
+// Package route manages AnyIP routes which allow binding sockets to any address of the prefix
+// (see https://blog.widodh.nl/2016/04/anyip-bind-a-whole-subnet-to-your-linux-machine/)
+package route
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// TableLocal is the kernel local routing table, it's used for local routes by default (same as "ip route add local")
+const TableLocal = syscall.RT_TABLE_LOCAL
+
+// LocalRoute is a route of type local which makes the whole prefix local to the host,
+// it's an equivalent of "ip route add local <prefix> dev <iface> table <table>"
+type LocalRoute struct {
+	Prefix netip.Prefix
+	// Iface is the name of the route device, e.g. "lo"
+	Iface string
+	// Table is the routing table, 0 means [TableLocal]
+	Table uint32
+}
+
+func (r *LocalRoute) String() string {
+	table := r.Table
+	if table == 0 {
+		table = TableLocal
+	}
+
+	return fmt.Sprintf("local %s dev %s table %d", r.Prefix.Masked(), r.Iface, table)
+}
+
+// AddLocalRoute adds local route, it's idempotent: existing route is not an error.
+// Returns true when route has been added and false when it already existed
+func AddLocalRoute(r *LocalRoute) (bool, error) {
+	err := localRouteRequest(r, syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL)
+	if errors.Is(err, syscall.EEXIST) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, fmt.Errorf("failed to add route %s: %w", r, err)
+	}
+
+	return true, nil
+}
+
+// DeleteLocalRoute deletes local route, missing route is not an error
+func DeleteLocalRoute(r *LocalRoute) error {
+	err := localRouteRequest(r, syscall.RTM_DELROUTE, 0)
+	if errors.Is(err, syscall.ESRCH) || errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to delete route %s: %w", r, err)
+	}
+
+	return nil
+}
+
+var nlSeq atomic.Uint32
+
+// localRouteRequest sends route request to the kernel over netlink and waits for acknowledgement
+func localRouteRequest(r *LocalRoute, msgType uint16, flags uint16) error {
+	iface, err := net.InterfaceByName(r.Iface)
+	if err != nil {
+		return err
+	}
+
+	seq := nlSeq.Add(1)
+	msg := buildLocalRouteMsg(r, iface.Index, msgType, syscall.NLM_F_ACK|flags, seq)
+
+	return netlinkRequest(msg, seq, func(m *syscall.NetlinkMessage) bool {
+		return false
+	})
+}
+
+// IsLocalAddr reports whether kernel routes packets destined to the address locally,
+// i.e. address is assigned to the host or is covered by local (AnyIP) route
+func IsLocalAddr(addr netip.Addr) (bool, error) {
+	addr = addr.Unmap()
+
+	family := syscall.AF_INET6
+	if addr.Is4() {
+		family = syscall.AF_INET
+	}
+
+	seq := nlSeq.Add(1)
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN, 64)
+	msg = append(msg, uint8(family), uint8(addr.BitLen()), 0, 0, 0, 0, 0, 0)
+	msg = binary.NativeEndian.AppendUint32(msg, 0)
+	msg = appendRtAttr(msg, syscall.RTA_DST, addr.AsSlice())
+	putNlMsgHeader(msg, syscall.RTM_GETROUTE, 0, seq)
+
+	var rtmType uint8
+	err := netlinkRequest(msg, seq, func(m *syscall.NetlinkMessage) bool {
+		if m.Header.Type != syscall.RTM_NEWROUTE || len(m.Data) < syscall.SizeofRtMsg {
+			return false
+		}
+
+		rtmType = m.Data[7]
+
+		return true
+	})
+	if errors.Is(err, syscall.ENETUNREACH) || errors.Is(err, syscall.EHOSTUNREACH) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return rtmType == syscall.RTN_LOCAL, nil
+}
+
+// netlinkRequest sends request to the kernel over netlink and reads response messages until handle returns true
+// or acknowledgement (error message) is received
+func netlinkRequest(msg []byte, seq uint32, handle func(m *syscall.NetlinkMessage) bool) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer syscall.Close(fd)
+
+	kernel := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+
+	if err := syscall.Sendto(fd, msg, 0, kernel); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+
+	buf := make([]byte, os.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return os.NewSyscallError("recvfrom", err)
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+
+		for i := range msgs {
+			m := &msgs[i]
+			if m.Header.Seq != seq {
+				continue
+			}
+
+			if m.Header.Type != syscall.NLMSG_ERROR {
+				if handle(m) {
+					return nil
+				}
+
+				continue
+			}
+
+			if len(m.Data) < 4 {
+				return errors.New("malformed netlink error message")
+			}
+
+			// Zero error code is the acknowledgement
+			if errno := int32(binary.NativeEndian.Uint32(m.Data[:4])); errno != 0 {
+				return os.NewSyscallError("netlink", syscall.Errno(-errno))
+			}
+
+			return nil
+		}
+	}
+}
+
+// buildLocalRouteMsg encodes netlink message: nlmsghdr, rtmsg and route attributes
+func buildLocalRouteMsg(r *LocalRoute, ifIndex int, msgType uint16, flags uint16, seq uint32) []byte {
+	prefix := r.Prefix.Masked()
+
+	family := syscall.AF_INET6
+	if prefix.Addr().Is4() {
+		family = syscall.AF_INET
+	}
+
+	table := r.Table
+	if table == 0 {
+		table = TableLocal
+	}
+
+	rtTable := uint8(syscall.RT_TABLE_UNSPEC)
+	if table < 256 {
+		rtTable = uint8(table)
+	}
+
+	msg := make([]byte, syscall.NLMSG_HDRLEN, 128)
+
+	// struct rtmsg
+	msg = append(msg,
+		uint8(family),
+		uint8(prefix.Bits()), // rtm_dst_len
+		0,                    // rtm_src_len
+		0,                    // rtm_tos
+		rtTable,
+		syscall.RTPROT_BOOT,
+		syscall.RT_SCOPE_HOST,
+		syscall.RTN_LOCAL,
+	)
+	msg = binary.NativeEndian.AppendUint32(msg, 0) // rtm_flags
+
+	msg = appendRtAttr(msg, syscall.RTA_DST, prefix.Addr().AsSlice())
+	msg = appendRtAttr(msg, syscall.RTA_OIF, binary.NativeEndian.AppendUint32(nil, uint32(ifIndex)))
+	// Tables above 255 can be set only with attribute
+	msg = appendRtAttr(msg, syscall.RTA_TABLE, binary.NativeEndian.AppendUint32(nil, table))
+
+	putNlMsgHeader(msg, msgType, flags, seq)
+
+	return msg
+}
+
+// putNlMsgHeader fills struct nlmsghdr at the beginning of the message
+func putNlMsgHeader(msg []byte, msgType uint16, flags uint16, seq uint32) {
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(len(msg)))
+	binary.NativeEndian.PutUint16(msg[4:6], msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], syscall.NLM_F_REQUEST|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], seq)
+	binary.NativeEndian.PutUint32(msg[12:16], 0)
+}
+
+// appendRtAttr appends route attribute aligned to 4 bytes
+func appendRtAttr(msg []byte, attrType uint16, data []byte) []byte {
+	attrLen := syscall.SizeofRtAttr + len(data)
+
+	msg = binary.NativeEndian.AppendUint16(msg, uint16(attrLen))
+	msg = binary.NativeEndian.AppendUint16(msg, attrType)
+	msg = append(msg, data...)
+
+	for len(msg)%syscall.RTA_ALIGNTO != 0 {
+		msg = append(msg, 0)
+	}
+
+	return msg
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+package route
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestLocalRoute(t *testing.T) {
+	// Test changes routes of the host, so it runs only on request, e.g. in disposable environment
+	if len(os.Getenv("FREEBIND_PROXY_ROUTE_TESTS")) == 0 {
+		t.Skip("Set FREEBIND_PROXY_ROUTE_TESTS=1 to run tests which add and delete routes of the host")
+	}
+
+	tests := []struct {
+		name  string
+		route LocalRoute
+	}{
+		{"ipv4", LocalRoute{Prefix: netip.MustParsePrefix("198.51.100.0/24"), Iface: "lo", Table: 4242}},
+		{"ipv6", LocalRoute{Prefix: netip.MustParsePrefix("2001:db8:4242::/64"), Iface: "lo", Table: 4242}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, err := AddLocalRoute(&tt.route)
+			if errors.Is(err, syscall.EPERM) || errors.Is(err, os.ErrPermission) {
+				t.Skipf("Not permitted to manage routes: %v", err)
+			}
+			if err != nil {
+				t.Fatalf("AddLocalRoute() error = %v", err)
+			}
+			if !added {
+				t.Fatalf("AddLocalRoute() got = false, route already existed")
+			}
+
+			added, err = AddLocalRoute(&tt.route)
+			if err != nil || added {
+				t.Errorf("AddLocalRoute() of existing route got = %v, error = %v, want false, nil", added, err)
+			}
+
+			if err := DeleteLocalRoute(&tt.route); err != nil {
+				t.Fatalf("DeleteLocalRoute() error = %v", err)
+			}
+
+			if err := DeleteLocalRoute(&tt.route); err != nil {
+				t.Errorf("DeleteLocalRoute() of missing route error = %v", err)
+			}
+		})
+	}
+}
+
+func TestIsLocalAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.0.0.42", true},
+		{"::1", true},
+		{"192.0.2.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := IsLocalAddr(netip.MustParseAddr(tt.addr))
+			if err != nil {
+				t.Fatalf("IsLocalAddr() error = %v", err)
+			}
+
+			if got != tt.want {
+				t.Errorf("IsLocalAddr() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/rand/v2"
+	"net/netip"
+)
+
+// AddrAllocator provides source addresses, implementations must be safe for concurrent use
+type AddrAllocator interface {
+	NextAddr() netip.Addr
+}
+
+// FamilyAddrAllocator additionally provides source addresses of the requested family,
+// so source address can match destination address family
+type FamilyAddrAllocator interface {
+	AddrAllocator
+
+	// NextAddrOf returns next IPv4 (is4 is true) or IPv6 address, false is returned when allocator
+	// has no addresses of the requested family
+	NextAddrOf(is4 bool) (netip.Addr, bool)
+}
+
+// RestrictableAllocator can provide allocator limited to the subset of its addresses, e.g. to apply user policy
+type RestrictableAllocator interface {
+	// Restrict returns allocator of the addresses covered by the allowed prefixes
+	Restrict(allowed []netip.Prefix) (AddrAllocator, error)
+}
+
+// subPrefixAllocator can provide allocator of the narrower prefix which keeps exclusions of the original allocator
+type subPrefixAllocator interface {
+	subPrefix(prefix netip.Prefix) (AddrAllocator, error)
+}
+
+// subPrefixAlloc returns allocator of the prefix which is a part of the alloc prefix,
+// allocators without exclusions support are replaced with the random allocator
+func subPrefixAlloc(randReader *rand.Rand, alloc AddrAllocator, prefix netip.Prefix) (AddrAllocator, error) {
+	if sub, ok := alloc.(subPrefixAllocator); ok {
+		return sub.subPrefix(prefix)
+	}
+
+	return NewRandomAllocator(randReader, prefix), nil
+}
+
+// RandomAllocator picks addresses uniformly at random from the prefix or the set,
+// randReader source must be safe for concurrent use
+type RandomAllocator struct {
+	randReader *rand.Rand
+	prefix     netip.Prefix
+
+	setIdx *ipSetIndex
+
+	is4 bool
+}
+
+func NewRandomAllocator(randReader *rand.Rand, prefix netip.Prefix) *RandomAllocator {
+	return &RandomAllocator{
+		randReader: randReader,
+		prefix:     prefix.Masked(),
+		is4:        prefix.Addr().Is4(),
+	}
+}
+
+var ErrIPSetMixedFamilies = errors.New("IP set contains both IPv4 and IPv6 addresses")
+
+// NewRandomSetAllocator makes allocator which picks addresses only from the set,
+// e.g. prefix with excluded addresses removed, set must contain addresses of a single family
+func NewRandomSetAllocator(randReader *rand.Rand, set *IPSet) (*RandomAllocator, error) {
+	setIdx, err := newIpSetIndex(set)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := setIdx.ranges[0], setIdx.ranges[len(setIdx.ranges)-1]
+	if first.from.Is4() != last.to.Is4() {
+		return nil, ErrIPSetMixedFamilies
+	}
+
+	return &RandomAllocator{
+		randReader: randReader,
+		setIdx:     setIdx,
+		is4:        first.from.Is4(),
+	}, nil
+}
+
+func (a *RandomAllocator) NextAddr() netip.Addr {
+	if a.setIdx != nil {
+		return a.setIdx.addrAt(randUint128(a.randReader, a.setIdx.last))
+	}
+
+	return GetRandomIpFromPrefix(a.randReader, a.prefix)
+}
+
+func (a *RandomAllocator) subPrefix(prefix netip.Prefix) (AddrAllocator, error) {
+	if a.setIdx == nil {
+		return NewRandomAllocator(a.randReader, prefix), nil
+	}
+
+	bounds := IPRangeFromPrefix(prefix)
+
+	set := &IPSet{}
+	for _, r := range a.setIdx.ranges {
+		from, to := r.from, r.to
+		if from.Less(bounds.from) {
+			from = bounds.from
+		}
+		if bounds.to.Less(to) {
+			to = bounds.to
+		}
+
+		if !to.Less(from) {
+			set.AddRange(IPRangeFrom(from, to))
+		}
+	}
+
+	return NewRandomSetAllocator(a.randReader, set)
+}
+
+func (a *RandomAllocator) NextAddrOf(is4 bool) (netip.Addr, bool) {
+	if is4 != a.is4 {
+		return netip.Addr{}, false
+	}
+
+	return a.NextAddr(), true
+}
+
+// randUint128 returns uniformly distributed random number in [0, max]
+func randUint128(randReader *rand.Rand, max uint128) uint128 {
+	mask := uint128{}.addOne().lsh(max.bitLen()).subOne()
+
+	for {
+		v := uint128{hi: randReader.Uint64(), lo: randReader.Uint64()}.and(mask)
+		if v.cmp(max) <= 0 {
+			return v
+		}
+	}
+}
+
+// uint128FromAddr converts address to uint128, IPv4 address is placed in the lowest 32 bits
+func uint128FromAddr(addr netip.Addr) uint128 {
+	if addr.Is4() {
+		b := addr.As4()
+
+		return uint128{lo: uint64(b[0])<<24 | uint64(b[1])<<16 | uint64(b[2])<<8 | uint64(b[3])}
+	}
+
+	b := addr.As16()
+
+	return uint128{
+		hi: binary.BigEndian.Uint64(b[:8]),
+		lo: binary.BigEndian.Uint64(b[8:]),
+	}
+}
+
+// addrFromUint128 converts uint128 to IPv4 (lowest 32 bits are used) or IPv6 address
+func addrFromUint128(u uint128, is4 bool) netip.Addr {
+	if is4 {
+		return netip.AddrFrom4([4]byte{
+			byte(u.lo >> 24),
+			byte(u.lo >> 16),
+			byte(u.lo >> 8),
+			byte(u.lo),
+		})
+	}
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], u.hi)
+	binary.BigEndian.PutUint64(b[8:], u.lo)
+
+	return netip.AddrFrom16(b)
+}
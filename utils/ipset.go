@@ -0,0 +1,342 @@
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// IPRange is an inclusive range of addresses of the same family
+type IPRange struct {
+	from netip.Addr
+	to   netip.Addr
+}
+
+func IPRangeFrom(from, to netip.Addr) IPRange {
+	return IPRange{from: from.Unmap(), to: to.Unmap()}
+}
+
+// IPRangeFromPrefix returns range covering all addresses of the prefix
+func IPRangeFromPrefix(prefix netip.Prefix) IPRange {
+	prefix = prefix.Masked()
+
+	first := prefix.Addr()
+	hostBits := uint(first.BitLen() - prefix.Bits())
+
+	last := uint128FromAddr(first)
+	if hostBits > 0 {
+		last = last.or(uint128{}.addOne().lsh(hostBits).subOne())
+	}
+
+	return IPRange{from: first.Unmap(), to: addrFromUint128(last, first.Is4()).Unmap()}
+}
+
+// ParseIPRange parses range in one of the forms: "10.0.0.1-10.0.0.9", "10.0.0.0/24" or "10.0.0.1"
+func ParseIPRange(s string) (IPRange, error) {
+	s = strings.TrimSpace(s)
+
+	if from, to, ok := strings.Cut(s, "-"); ok {
+		fromAddr, err := netip.ParseAddr(strings.TrimSpace(from))
+		if err != nil {
+			return IPRange{}, err
+		}
+
+		toAddr, err := netip.ParseAddr(strings.TrimSpace(to))
+		if err != nil {
+			return IPRange{}, err
+		}
+
+		r := IPRangeFrom(fromAddr, toAddr)
+		if !r.IsValid() {
+			return IPRange{}, fmt.Errorf("invalid IP range %q", s)
+		}
+
+		return r, nil
+	}
+
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return IPRange{}, err
+		}
+
+		return IPRangeFromPrefix(prefix), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return IPRange{}, err
+	}
+
+	return IPRangeFrom(addr, addr), nil
+}
+
+func (r IPRange) From() netip.Addr {
+	return r.from
+}
+
+func (r IPRange) To() netip.Addr {
+	return r.to
+}
+
+// IsValid reports whether range bounds are valid addresses of the same family and from <= to
+func (r IPRange) IsValid() bool {
+	return r.from.IsValid() && r.to.IsValid() && r.from.BitLen() == r.to.BitLen() && r.from.Compare(r.to) <= 0
+}
+
+func (r IPRange) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	return r.from.Compare(addr) <= 0 && addr.Compare(r.to) <= 0
+}
+
+// size returns number of addresses in range minus one, so the whole IPv6 space fits into uint128
+func (r IPRange) size() uint128 {
+	return uint128FromAddr(r.to).sub(uint128FromAddr(r.from))
+}
+
+func (r IPRange) String() string {
+	if r.from == r.to {
+		return r.from.String()
+	}
+
+	return r.from.String() + "-" + r.to.String()
+}
+
+// IPSet is a set of addresses stored as sorted non-overlapping ranges.
+// Zero value is an empty set, set is not safe for concurrent modification
+type IPSet struct {
+	ranges []IPRange
+}
+
+// AddRange adds all addresses of the range to the set
+func (s *IPSet) AddRange(r IPRange) {
+	if !r.IsValid() {
+		return
+	}
+
+	// Find ranges which overlap with or are adjacent to the new one and merge them
+	start := 0
+	for start < len(s.ranges) && s.ranges[start].to.Compare(r.from) < 0 && s.ranges[start].to.Next() != r.from {
+		start++
+	}
+
+	end := start
+	for end < len(s.ranges) && (s.ranges[end].from.Compare(r.to) <= 0 || r.to.Next() == s.ranges[end].from) {
+		if s.ranges[end].from.Compare(r.from) < 0 {
+			r.from = s.ranges[end].from
+		}
+		if s.ranges[end].to.Compare(r.to) > 0 {
+			r.to = s.ranges[end].to
+		}
+		end++
+	}
+
+	s.ranges = slices.Replace(s.ranges, start, end, r)
+}
+
+// AddPrefix adds all addresses of the prefix to the set
+func (s *IPSet) AddPrefix(prefix netip.Prefix) {
+	s.AddRange(IPRangeFromPrefix(prefix))
+}
+
+// Add adds single address to the set
+func (s *IPSet) Add(addr netip.Addr) {
+	s.AddRange(IPRangeFrom(addr, addr))
+}
+
+// RemoveRange removes all addresses of the range from the set
+func (s *IPSet) RemoveRange(r IPRange) {
+	if !r.IsValid() {
+		return
+	}
+
+	ranges := make([]IPRange, 0, len(s.ranges)+1)
+	for _, cur := range s.ranges {
+		if cur.to.Compare(r.from) < 0 || cur.from.Compare(r.to) > 0 {
+			ranges = append(ranges, cur)
+			continue
+		}
+
+		if cur.from.Compare(r.from) < 0 {
+			ranges = append(ranges, IPRange{from: cur.from, to: r.from.Prev()})
+		}
+		if cur.to.Compare(r.to) > 0 {
+			ranges = append(ranges, IPRange{from: r.to.Next(), to: cur.to})
+		}
+	}
+
+	s.ranges = ranges
+}
+
+// RemovePrefix removes all addresses of the prefix from the set
+func (s *IPSet) RemovePrefix(prefix netip.Prefix) {
+	s.RemoveRange(IPRangeFromPrefix(prefix))
+}
+
+// Remove removes single address from the set
+func (s *IPSet) Remove(addr netip.Addr) {
+	s.RemoveRange(IPRangeFrom(addr, addr))
+}
+
+// Union adds all addresses of the other set to the set
+func (s *IPSet) Union(other *IPSet) {
+	for _, r := range other.ranges {
+		s.AddRange(r)
+	}
+}
+
+// Difference removes all addresses of the other set from the set
+func (s *IPSet) Difference(other *IPSet) {
+	for _, r := range other.ranges {
+		s.RemoveRange(r)
+	}
+}
+
+func (s *IPSet) Contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+
+	i, found := slices.BinarySearchFunc(s.ranges, addr, func(r IPRange, addr netip.Addr) int {
+		return r.from.Compare(addr)
+	})
+	if found {
+		return true
+	}
+
+	return i > 0 && s.ranges[i-1].Contains(addr)
+}
+
+// ContainsPrefix reports whether all addresses of the prefix are in the set
+func (s *IPSet) ContainsPrefix(prefix netip.Prefix) bool {
+	r := IPRangeFromPrefix(prefix)
+
+	for _, cur := range s.ranges {
+		if cur.Contains(r.from) {
+			return cur.Contains(r.to)
+		}
+	}
+
+	return false
+}
+
+// Ranges returns copy of the set ranges in ascending order
+func (s *IPSet) Ranges() []IPRange {
+	return slices.Clone(s.ranges)
+}
+
+func (s *IPSet) IsEmpty() bool {
+	return len(s.ranges) == 0
+}
+
+func (s *IPSet) Clone() *IPSet {
+	return &IPSet{ranges: slices.Clone(s.ranges)}
+}
+
+func (s *IPSet) String() string {
+	parts := make([]string, len(s.ranges))
+	for i, r := range s.ranges {
+		parts[i] = r.String()
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// ReadIPSet reads set from the list of addresses, prefixes and ranges (see [ParseIPRange]),
+// one entry per line, empty lines and comments starting with "#" are ignored
+func ReadIPSet(r io.Reader) (*IPSet, error) {
+	set := &IPSet{}
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		ipRange, err := ParseIPRange(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+
+		set.AddRange(ipRange)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// ReservedAddrs returns addresses of the prefix which should not be used as source addresses:
+// IPv4 network and broadcast addresses and IPv6 Subnet-Router anycast address (all host bits are zero)
+func ReservedAddrs(prefix netip.Prefix) *IPSet {
+	prefix = prefix.Masked()
+
+	set := &IPSet{}
+
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if prefix.Addr().Is4() {
+		// Point-to-point /31 (RFC 3021) and /32 have no network and broadcast addresses
+		if hostBits > 1 {
+			r := IPRangeFromPrefix(prefix)
+
+			set.Add(r.from)
+			set.Add(r.to)
+		}
+	} else if hostBits > 1 {
+		// Subnet-Router anycast is not used on /127 point-to-point links (RFC 6164)
+		set.Add(prefix.Addr())
+	}
+
+	return set
+}
+
+var ErrIPSetEmpty = errors.New("IP set is empty")
+
+// ipSetIndex maps index in [0, size) to the set address, so addresses of the set can be sampled uniformly
+type ipSetIndex struct {
+	ranges []IPRange
+	// offsets are indexes of the first address of each range
+	offsets []uint128
+	// last is the index of the last address in the set
+	last uint128
+}
+
+func newIpSetIndex(set *IPSet) (*ipSetIndex, error) {
+	if set.IsEmpty() {
+		return nil, ErrIPSetEmpty
+	}
+
+	idx := &ipSetIndex{
+		ranges:  set.Ranges(),
+		offsets: make([]uint128, len(set.ranges)),
+	}
+
+	var next uint128
+	for i, r := range idx.ranges {
+		idx.offsets[i] = next
+		idx.last = next.add(r.size())
+		next = idx.last.addOne()
+	}
+
+	return idx, nil
+}
+
+// addrAt returns address with the given index, index must not be greater than last
+func (idx *ipSetIndex) addrAt(i uint128) netip.Addr {
+	n, found := slices.BinarySearchFunc(idx.offsets, i, uint128.cmp)
+	if !found {
+		n--
+	}
+
+	r := idx.ranges[n]
+
+	return addrFromUint128(uint128FromAddr(r.from).add(i.sub(idx.offsets[n])), r.from.Is4())
+}
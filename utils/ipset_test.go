@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestIPSetUnionDifference(t *testing.T) {
+	set := &IPSet{}
+	set.AddPrefix(netip.MustParsePrefix("10.0.0.0/24"))
+	set.AddPrefix(netip.MustParsePrefix("10.0.1.0/24"))
+	set.AddPrefix(netip.MustParsePrefix("2001:db8::/120"))
+
+	excluded := &IPSet{}
+	excluded.Add(netip.MustParseAddr("10.0.0.1"))
+	excluded.AddRange(IPRangeFrom(netip.MustParseAddr("10.0.0.250"), netip.MustParseAddr("10.0.1.10")))
+	excluded.AddPrefix(netip.MustParsePrefix("2001:db8::/121"))
+
+	set.Difference(excluded)
+
+	if want, got := "10.0.0.0,10.0.0.2-10.0.0.249,10.0.1.11-10.0.1.255,2001:db8::80-2001:db8::ff", set.String(); got != want {
+		t.Fatalf("IPSet got = %s, want %s", got, want)
+	}
+
+	for _, s := range []string{"10.0.0.1", "10.0.0.255", "10.0.1.10", "2001:db8::7f", "10.0.2.0"} {
+		if set.Contains(netip.MustParseAddr(s)) {
+			t.Errorf("Contains(%s) got = true, want false", s)
+		}
+	}
+
+	for _, s := range []string{"10.0.0.0", "10.0.0.2", "10.0.1.11", "10.0.1.255", "2001:db8::80"} {
+		if !set.Contains(netip.MustParseAddr(s)) {
+			t.Errorf("Contains(%s) got = false, want true", s)
+		}
+	}
+
+	set.Union(excluded)
+
+	if want, got := "10.0.0.0-10.0.1.255,2001:db8::-2001:db8::ff", set.String(); got != want {
+		t.Fatalf("IPSet got = %s, want %s", got, want)
+	}
+}
+
+func TestReadIPSet(t *testing.T) {
+	input := `
+# gateway
+10.0.0.1
+10.0.0.128/25 # service IPs
+10.0.0.10 - 10.0.0.20
+`
+
+	set, err := ReadIPSet(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ReadIPSet() error = %v", err)
+	}
+
+	if want, got := "10.0.0.1,10.0.0.10-10.0.0.20,10.0.0.128-10.0.0.255", set.String(); got != want {
+		t.Errorf("ReadIPSet() got = %s, want %s", got, want)
+	}
+
+	if _, err := ReadIPSet(strings.NewReader("10.0.0.20-10.0.0.10")); err == nil {
+		t.Errorf("ReadIPSet() of the reversed range succeeded")
+	}
+}
+
+func TestReservedAddrs(t *testing.T) {
+	tests := []struct {
+		prefix string
+		want   string
+	}{
+		{"10.0.0.0/24", "10.0.0.0,10.0.0.255"},
+		{"10.0.0.0/31", ""},
+		{"10.0.0.1/32", ""},
+		{"2001:db8::/64", "2001:db8::"},
+		{"2001:db8::/127", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			if got := ReservedAddrs(netip.MustParsePrefix(tt.prefix)).String(); got != tt.want {
+				t.Errorf("ReservedAddrs() got = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRandomSetAllocator(t *testing.T) {
+	prefix := netip.MustParsePrefix("192.168.1.0/24")
+
+	set := &IPSet{}
+	set.AddPrefix(prefix)
+	set.Difference(ReservedAddrs(prefix))
+	set.RemoveRange(IPRangeFrom(netip.MustParseAddr("192.168.1.2"), netip.MustParseAddr("192.168.1.200")))
+
+	alloc, err := NewRandomSetAllocator(rand.New(NewLockedSource(testSeed)), set)
+	if err != nil {
+		t.Fatalf("NewRandomSetAllocator() error = %v", err)
+	}
+
+	seen := make(map[netip.Addr]struct{})
+	for i := 0; i < 10000; i++ {
+		got := alloc.NextAddr()
+		if !set.Contains(got) {
+			t.Fatalf("NextAddr() got = %v which is out of the set %s", got, set)
+		}
+
+		seen[got] = struct{}{}
+	}
+
+	// 192.168.1.1 and 192.168.1.201-192.168.1.254
+	if len(seen) != 55 {
+		t.Errorf("NextAddr() got %d distinct addresses, want 55", len(seen))
+	}
+
+	if _, err := NewRandomSetAllocator(rand.New(NewLockedSource(testSeed)), &IPSet{}); err == nil {
+		t.Errorf("NewRandomSetAllocator() of the empty set succeeded")
+	}
+
+	set.AddPrefix(netip.MustParsePrefix("2001:db8::/64"))
+	if _, err := NewRandomSetAllocator(rand.New(NewLockedSource(testSeed)), set); err == nil {
+		t.Errorf("NewRandomSetAllocator() of the set with mixed families succeeded")
+	}
+}
@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"math/rand/v2"
+	"net/netip"
+	"strings"
+	"sync"
+)
+
+// feistelRounds is number of Feistel network rounds used to permute host bits
+const feistelRounds = 8
+
+// PermutationAllocator walks the whole prefix as a pseudo-random permutation,
+// so every address is used once before any repeats.
+//
+// Permutation is a format-preserving Feistel cipher over the host bits keyed by the seed,
+// when number of host bits is odd cipher works over one extra bit and cycle-walks back into the prefix.
+// Allocator position (cursor) can be saved with [PermutationAllocator.MarshalText] and restored
+// with [PermutationAllocator.UnmarshalText] to resume after restart.
+type PermutationAllocator struct {
+	prefix netip.Prefix
+	seed   [32]byte
+
+	hostBits uint
+	// halfBits is a width of the Feistel network halves
+	halfBits uint
+	halfMask uint64
+	keys     [feistelRounds]uint64
+
+	// excluded addresses are skipped, they still take their positions in the permutation
+	excluded *IPSet
+
+	mu     sync.Mutex
+	cursor uint128
+}
+
+func NewPermutationAllocator(seed [32]byte, prefix netip.Prefix) *PermutationAllocator {
+	prefix = prefix.Masked()
+
+	a := &PermutationAllocator{
+		prefix:   prefix,
+		seed:     seed,
+		hostBits: uint(prefix.Addr().BitLen() - prefix.Bits()),
+	}
+
+	a.halfBits = (a.hostBits + 1) / 2
+	a.halfMask = ^uint64(0) >> (64 - a.halfBits)
+
+	keySrc := rand.NewChaCha8(seed)
+	for i := range a.keys {
+		a.keys[i] = keySrc.Uint64()
+	}
+
+	return a
+}
+
+// NewPermutationAllocatorExcluding makes permutation allocator which never provides excluded addresses
+func NewPermutationAllocatorExcluding(seed [32]byte, prefix netip.Prefix, excluded *IPSet) (*PermutationAllocator, error) {
+	if excluded.ContainsPrefix(prefix) {
+		return nil, ErrIPSetEmpty
+	}
+
+	a := NewPermutationAllocator(seed, prefix)
+	a.excluded = excluded.Clone()
+
+	return a, nil
+}
+
+func (a *PermutationAllocator) NextAddr() netip.Addr {
+	if a.hostBits == 0 {
+		return a.prefix.Addr()
+	}
+
+	for {
+		a.mu.Lock()
+		idx := a.cursor
+		a.cursor = a.cursor.addOne()
+		// Start over when all addresses have been used
+		if a.hostBits < 128 && !a.cursor.rsh(a.hostBits).isZero() {
+			a.cursor = uint128{}
+		}
+		a.mu.Unlock()
+
+		host := a.permute(idx)
+
+		addr := addrFromUint128(uint128FromAddr(a.prefix.Addr()).or(host), a.prefix.Addr().Is4())
+		if a.excluded == nil || !a.excluded.Contains(addr) {
+			return addr
+		}
+	}
+}
+
+// subPrefix returns permutation allocator of the prefix with the same seed and exclusions,
+// it has its own cursor which is not saved with the allocator state
+func (a *PermutationAllocator) subPrefix(prefix netip.Prefix) (AddrAllocator, error) {
+	if a.excluded == nil {
+		return NewPermutationAllocator(a.seed, prefix), nil
+	}
+
+	return NewPermutationAllocatorExcluding(a.seed, prefix, a.excluded)
+}
+
+func (a *PermutationAllocator) NextAddrOf(is4 bool) (netip.Addr, bool) {
+	if is4 != a.prefix.Addr().Is4() {
+		return netip.Addr{}, false
+	}
+
+	return a.NextAddr(), true
+}
+
+// permute maps index to host bits, it's a bijection over [0, 2^hostBits)
+func (a *PermutationAllocator) permute(idx uint128) uint128 {
+	v := a.encrypt(idx)
+
+	// Cycle-walk values which are out of host bits range, it's possible only when host bits number is odd
+	for a.hostBits < 2*a.halfBits && !v.rsh(a.hostBits).isZero() {
+		v = a.encrypt(v)
+	}
+
+	return v
+}
+
+// encrypt is a balanced Feistel network over 2*halfBits bits
+func (a *PermutationAllocator) encrypt(v uint128) uint128 {
+	left := v.rsh(a.halfBits).lo & a.halfMask
+	right := v.lo & a.halfMask
+
+	for _, key := range a.keys {
+		left, right = right, left^(feistelRound(right, key)&a.halfMask)
+	}
+
+	return uint128{lo: left}.lsh(a.halfBits).or(uint128{lo: right})
+}
+
+// feistelRound is a keyed round function based on the SplitMix64 finalizer
+func feistelRound(v, key uint64) uint64 {
+	v ^= key
+	v = (v ^ (v >> 30)) * 0xbf58476d1ce4e5b9
+	v = (v ^ (v >> 27)) * 0x94d049bb133111eb
+
+	return v ^ (v >> 31) ^ bits.RotateLeft64(key, 17)
+}
+
+var ErrPermutationStateMismatch = errors.New("permutation state belongs to another prefix or seed")
+
+// MarshalText encodes allocator state (prefix, seed fingerprint and cursor)
+func (a *PermutationAllocator) MarshalText() ([]byte, error) {
+	a.mu.Lock()
+	cursor := a.cursor
+	a.mu.Unlock()
+
+	return []byte(fmt.Sprintf("%s %s %016x%016x", a.prefix, a.seedFingerprint(), cursor.hi, cursor.lo)), nil
+}
+
+// UnmarshalText restores allocator cursor from the state produced by [PermutationAllocator.MarshalText],
+// state must belong to the allocator with the same prefix and seed
+func (a *PermutationAllocator) UnmarshalText(text []byte) error {
+	fields := strings.Fields(string(text))
+	if len(fields) != 3 || len(fields[2]) != 32 {
+		return errors.New("malformed permutation state")
+	}
+
+	if fields[0] != a.prefix.String() || fields[1] != a.seedFingerprint() {
+		return ErrPermutationStateMismatch
+	}
+
+	cursorBytes, err := hex.DecodeString(fields[2])
+	if err != nil {
+		return fmt.Errorf("malformed permutation cursor: %w", err)
+	}
+
+	cursor := uint128{
+		hi: binary.BigEndian.Uint64(cursorBytes[:8]),
+		lo: binary.BigEndian.Uint64(cursorBytes[8:]),
+	}
+
+	if a.hostBits < 128 && !cursor.rsh(a.hostBits).isZero() {
+		return errors.New("permutation cursor is out of prefix range")
+	}
+
+	a.mu.Lock()
+	a.cursor = cursor
+	a.mu.Unlock()
+
+	return nil
+}
+
+// seedFingerprint identifies the seed without revealing it
+func (a *PermutationAllocator) seedFingerprint() string {
+	return fmt.Sprintf("%016x", a.keys[0]^a.keys[feistelRounds-1])
+}
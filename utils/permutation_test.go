@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestPermutationAllocatorCoversPrefix(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix netip.Prefix
+	}{
+		{"ipv4 /24", netip.MustParsePrefix("192.168.1.0/24")},
+		{"ipv4 /27 (odd host bits)", netip.MustParsePrefix("10.0.0.32/27")},
+		{"ipv4 /31", netip.MustParsePrefix("10.0.0.0/31")},
+		{"ipv4 /32", netip.MustParsePrefix("10.0.0.1/32")},
+		{"ipv6 /116", netip.MustParsePrefix("2001:db8::/116")},
+		{"ipv6 /117 (odd host bits)", netip.MustParsePrefix("2001:db8::/117")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc := NewPermutationAllocator(testSeed, tt.prefix)
+
+			size := 1 << (tt.prefix.Addr().BitLen() - tt.prefix.Bits())
+			seen := make(map[netip.Addr]struct{}, size)
+
+			for i := 0; i < size; i++ {
+				got := alloc.NextAddr()
+				if !tt.prefix.Contains(got) {
+					t.Fatalf("NextAddr() got = %v which is out of subnet space %s", got, tt.prefix)
+				}
+
+				if _, ok := seen[got]; ok {
+					t.Fatalf("NextAddr() got = %v twice in the first %d addresses", got, size)
+				}
+				seen[got] = struct{}{}
+			}
+
+			// The next cycle starts over
+			if got := alloc.NextAddr(); !tt.prefix.Contains(got) {
+				t.Fatalf("NextAddr() got = %v which is out of subnet space %s", got, tt.prefix)
+			}
+		})
+	}
+}
+
+func TestPermutationAllocatorLargePrefix(t *testing.T) {
+	prefix := netip.MustParsePrefix("2001:db8::/32")
+	alloc := NewPermutationAllocator(testSeed, prefix)
+
+	seen := make(map[netip.Addr]struct{})
+	for i := 0; i < 10000; i++ {
+		got := alloc.NextAddr()
+		if !prefix.Contains(got) {
+			t.Fatalf("NextAddr() got = %v which is out of subnet space %s", got, prefix)
+		}
+
+		if _, ok := seen[got]; ok {
+			t.Fatalf("NextAddr() got = %v twice", got)
+		}
+		seen[got] = struct{}{}
+	}
+}
+
+func TestPermutationAllocatorResume(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/20")
+
+	alloc := NewPermutationAllocator(testSeed, prefix)
+	for i := 0; i < 100; i++ {
+		alloc.NextAddr()
+	}
+
+	state, err := alloc.MarshalText()
+	if err != nil {
+		t.Fatalf("MarshalText() error = %v", err)
+	}
+
+	resumed := NewPermutationAllocator(testSeed, prefix)
+	if err := resumed.UnmarshalText(state); err != nil {
+		t.Fatalf("UnmarshalText() error = %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if want, got := alloc.NextAddr(), resumed.NextAddr(); want != got {
+			t.Fatalf("Resumed allocator diverged at %d: got = %v, want %v", i, got, want)
+		}
+	}
+
+	otherSeed := testSeed
+	otherSeed[0]++
+	if err := NewPermutationAllocator(otherSeed, prefix).UnmarshalText(state); err == nil {
+		t.Errorf("UnmarshalText() of the state with another seed succeeded")
+	}
+
+	if err := NewPermutationAllocator(testSeed, netip.MustParsePrefix("10.0.16.0/20")).UnmarshalText(state); err == nil {
+		t.Errorf("UnmarshalText() of the state with another prefix succeeded")
+	}
+}
+
+func TestPermutationAllocatorExcluding(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/27")
+
+	excluded := ReservedAddrs(prefix)
+	excluded.AddRange(IPRangeFrom(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.9")))
+
+	alloc, err := NewPermutationAllocatorExcluding(testSeed, prefix, excluded)
+	if err != nil {
+		t.Fatalf("NewPermutationAllocatorExcluding() error = %v", err)
+	}
+
+	size := 32 - 11
+	seen := make(map[netip.Addr]struct{}, size)
+
+	for i := 0; i < size; i++ {
+		got := alloc.NextAddr()
+		if excluded.Contains(got) {
+			t.Fatalf("NextAddr() got = %v which is excluded", got)
+		}
+
+		if _, ok := seen[got]; ok {
+			t.Fatalf("NextAddr() got = %v twice in the first %d addresses", got, size)
+		}
+		seen[got] = struct{}{}
+	}
+
+	excluded.AddPrefix(prefix)
+	if _, err := NewPermutationAllocatorExcluding(testSeed, prefix, excluded); err == nil {
+		t.Errorf("NewPermutationAllocatorExcluding() with the whole prefix excluded succeeded")
+	}
+}
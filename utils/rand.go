@@ -0,0 +1,83 @@
+package utils
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand/v2"
+	"sync"
+)
+
+// LockedSource is a [rand.ChaCha8] source guarded by mutex, it's safe for concurrent use
+// and produces the same sequence for the same seed, but does not scale under parallel load
+type LockedSource struct {
+	mu  sync.Mutex
+	src *rand.ChaCha8
+}
+
+func NewLockedSource(seed [32]byte) *LockedSource {
+	return &LockedSource{src: rand.NewChaCha8(seed)}
+}
+
+func (s *LockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.src.Uint64()
+}
+
+// ShardedSource is a set of [rand.ChaCha8] sources cached per P (see [sync.Pool]), it's safe for concurrent use
+// and scales with number of CPUs.
+//
+// Seeds of the shards are derived from the master seed, but which shard serves a call depends on scheduling
+// and pool may drop shards at any GC, so produced values are not reproducible even for the same seed,
+// use [LockedSource] when reproducible sequence is required
+type ShardedSource struct {
+	mu     sync.Mutex
+	master *rand.ChaCha8
+
+	pool sync.Pool
+}
+
+func NewShardedSource(seed [32]byte) *ShardedSource {
+	s := &ShardedSource{master: rand.NewChaCha8(seed)}
+	s.pool.New = s.newShard
+
+	return s
+}
+
+func (s *ShardedSource) newShard() any {
+	var seed [32]byte
+
+	s.mu.Lock()
+	for i := 0; i < len(seed); i += 8 {
+		binary.LittleEndian.PutUint64(seed[i:], s.master.Uint64())
+	}
+	s.mu.Unlock()
+
+	return rand.NewChaCha8(seed)
+}
+
+func (s *ShardedSource) Uint64() uint64 {
+	shard := s.pool.Get().(*rand.ChaCha8)
+	v := shard.Uint64()
+	s.pool.Put(shard)
+
+	return v
+}
+
+// CryptoSource is a source backed by [crand.Reader], it's safe for concurrent use,
+// it's slower than ChaCha8 based sources and can't be seeded
+type CryptoSource struct{}
+
+func NewCryptoSource() *CryptoSource {
+	return &CryptoSource{}
+}
+
+func (s *CryptoSource) Uint64() uint64 {
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		panic("crypto/rand read failed: " + err.Error())
+	}
+
+	return binary.LittleEndian.Uint64(buf[:])
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"sync"
+	"testing"
+)
+
+var testSeed = [32]byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+func TestLockedSourceReproducible(t *testing.T) {
+	a := NewLockedSource(testSeed)
+	b := NewLockedSource(testSeed)
+
+	for i := 0; i < 1000; i++ {
+		if va, vb := a.Uint64(), b.Uint64(); va != vb {
+			t.Fatalf("Sources with the same seed diverged at %d: %d != %d", i, va, vb)
+		}
+	}
+}
+
+func TestSourcesConcurrentUse(t *testing.T) {
+	sources := map[string]rand.Source{
+		"locked":  NewLockedSource(testSeed),
+		"sharded": NewShardedSource(testSeed),
+		"crypto":  NewCryptoSource(),
+	}
+
+	prefix := netip.MustParsePrefix("2001:db8::/48")
+
+	for name, src := range sources {
+		t.Run(name, func(t *testing.T) {
+			randReader := rand.New(src)
+
+			var wg sync.WaitGroup
+			for g := 0; g < 8; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					for i := 0; i < 1000; i++ {
+						if got := GetRandomIpFromPrefix(randReader, prefix); !prefix.Contains(got) {
+							t.Errorf("GetRandomIpFromPrefix() got = %v which is out of subnet space %s", got, prefix)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func benchmarkSourceParallel(b *testing.B, src rand.Source) {
+	randReader := rand.New(src)
+	prefix := netip.MustParsePrefix("2001:db8::/48")
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = GetRandomIpFromPrefix(randReader, prefix)
+		}
+	})
+}
+
+func BenchmarkLockedSourceParallel(b *testing.B) {
+	benchmarkSourceParallel(b, NewLockedSource(testSeed))
+}
+
+func BenchmarkShardedSourceParallel(b *testing.B) {
+	benchmarkSourceParallel(b, NewShardedSource(testSeed))
+}
+
+func BenchmarkCryptoSourceParallel(b *testing.B) {
+	benchmarkSourceParallel(b, NewCryptoSource())
+}
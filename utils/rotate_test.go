@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+
+	f, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("OpenRotatingFile() error = %v", err)
+	}
+	defer f.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	// Every line exceeds the limit together with the previous one, the oldest line is removed
+	for name, want := range map[string]string{
+		path:        "fourth\n",
+		path + ".1": "third\n",
+		path + ".2": "second\n",
+	} {
+		got, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", name, err)
+		}
+
+		if string(got) != want {
+			t.Errorf("Content of %s got = %q, want %q", name, got, want)
+		}
+	}
+
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("File beyond max backups exists, stat error = %v", err)
+	}
+
+	// Moved file is recreated on reopen
+	if err := os.Rename(path, path+".moved"); err != nil {
+		t.Fatalf("Failed to move file: %v", err)
+	}
+
+	if err := f.Reopen(); err != nil {
+		t.Fatalf("Reopen() error = %v", err)
+	}
+
+	if _, err := f.Write([]byte("fifth\n")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	if got, _ := os.ReadFile(path); string(got) != "fifth\n" {
+		t.Errorf("Content after reopen got = %q, want %q", got, "fifth\n")
+	}
+}
@@ -1,5 +1,7 @@
 package utils
 
+import "math/bits"
+
 // cmp compares u and v and returns:
 //
 //	-1 if u <  v
@@ -38,3 +40,23 @@ func (u uint128) rsh(n uint) (s uint128) {
 	}
 	return
 }
+
+// add returns u + v.
+func (u uint128) add(v uint128) uint128 {
+	lo, carry := bits.Add64(u.lo, v.lo, 0)
+	return uint128{u.hi + v.hi + carry, lo}
+}
+
+// sub returns u - v.
+func (u uint128) sub(v uint128) uint128 {
+	lo, borrow := bits.Sub64(u.lo, v.lo, 0)
+	return uint128{u.hi - v.hi - borrow, lo}
+}
+
+// bitLen returns the minimum number of bits required to represent u.
+func (u uint128) bitLen() uint {
+	if u.hi != 0 {
+		return 64 + uint(bits.Len64(u.hi))
+	}
+	return uint(bits.Len64(u.lo))
+}
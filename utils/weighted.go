@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"bytes"
+	"encoding"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// WeightedPrefix is a prefix with the relative weight it is chosen with
+type WeightedPrefix struct {
+	Prefix netip.Prefix
+	Weight uint
+}
+
+// ParseWeightedPrefix parses prefix in format "<prefix>[=<weight>]", default weight is 1
+func ParseWeightedPrefix(s string) (WeightedPrefix, error) {
+	prefixStr, weightStr, hasWeight := strings.Cut(strings.TrimSpace(s), "=")
+
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(prefixStr))
+	if err != nil {
+		return WeightedPrefix{}, err
+	}
+
+	wp := WeightedPrefix{Prefix: prefix.Masked(), Weight: 1}
+
+	if hasWeight {
+		weight, err := strconv.ParseUint(strings.TrimSpace(weightStr), 10, 32)
+		if err != nil {
+			return WeightedPrefix{}, fmt.Errorf("bad weight of prefix %s: %w", prefix, err)
+		}
+
+		if weight == 0 {
+			return WeightedPrefix{}, fmt.Errorf("weight of prefix %s must be positive", prefix)
+		}
+
+		wp.Weight = uint(weight)
+	}
+
+	return wp, nil
+}
+
+func (p WeightedPrefix) String() string {
+	return p.Prefix.String() + "=" + strconv.FormatUint(uint64(p.Weight), 10)
+}
+
+// PrefixUsage is number of addresses allocated from the prefix
+type PrefixUsage struct {
+	Prefix    netip.Prefix
+	Allocated uint64
+}
+
+// ErrNoAllowedPrefixes is returned when none of the allocator prefixes is allowed
+var ErrNoAllowedPrefixes = errors.New("none of the allocator prefixes is allowed")
+
+// WeightedAllocator chooses one of the underlying allocators proportionally to their prefix weights,
+// randReader source must be safe for concurrent use
+type WeightedAllocator struct {
+	randReader *rand.Rand
+
+	prefixes []WeightedPrefix
+	allocs   []AddrAllocator
+
+	all weightedChoice
+	// families are choices among IPv6 (0) and IPv4 (1) prefixes
+	families [2]weightedChoice
+
+	allocated []*atomic.Uint64
+}
+
+// weightedChoice chooses one of the prefixes proportionally to the weights
+type weightedChoice struct {
+	// indexes are indexes of the prefixes to choose from
+	indexes []int
+	// cumWeights are cumulative weights of the prefixes
+	cumWeights []uint64
+}
+
+func (c *weightedChoice) add(i int, weight uint) {
+	var total uint64
+	if len(c.cumWeights) > 0 {
+		total = c.cumWeights[len(c.cumWeights)-1]
+	}
+
+	c.indexes = append(c.indexes, i)
+	c.cumWeights = append(c.cumWeights, total+uint64(weight))
+}
+
+func (c *weightedChoice) choose(randReader *rand.Rand) int {
+	if len(c.indexes) == 1 {
+		return c.indexes[0]
+	}
+
+	n := randReader.Uint64N(c.cumWeights[len(c.cumWeights)-1])
+	i, _ := slices.BinarySearch(c.cumWeights, n+1)
+
+	return c.indexes[i]
+}
+
+// NewWeightedAllocator makes allocator over prefixes, allocs[i] must provide addresses of prefixes[i]
+func NewWeightedAllocator(randReader *rand.Rand, prefixes []WeightedPrefix, allocs []AddrAllocator) (*WeightedAllocator, error) {
+	if len(prefixes) == 0 {
+		return nil, errors.New("no prefixes provided")
+	}
+
+	if len(prefixes) != len(allocs) {
+		return nil, errors.New("number of prefixes and allocators mismatch")
+	}
+
+	a := &WeightedAllocator{
+		randReader: randReader,
+		prefixes:   slices.Clone(prefixes),
+		allocs:     slices.Clone(allocs),
+		allocated:  make([]*atomic.Uint64, len(prefixes)),
+	}
+
+	for i, p := range prefixes {
+		a.allocated[i] = &atomic.Uint64{}
+
+		if p.Weight == 0 {
+			return nil, fmt.Errorf("weight of prefix %s must be positive", p.Prefix)
+		}
+
+		a.all.add(i, p.Weight)
+		a.families[familyIdx(p.Prefix.Addr().Is4())].add(i, p.Weight)
+	}
+
+	return a, nil
+}
+
+func familyIdx(is4 bool) int {
+	if is4 {
+		return 1
+	}
+
+	return 0
+}
+
+func (a *WeightedAllocator) NextAddr() netip.Addr {
+	i := a.all.choose(a.randReader)
+
+	a.allocated[i].Add(1)
+
+	return a.allocs[i].NextAddr()
+}
+
+// NextAddrOf chooses among prefixes of the requested family only
+func (a *WeightedAllocator) NextAddrOf(is4 bool) (netip.Addr, bool) {
+	family := &a.families[familyIdx(is4)]
+	if len(family.indexes) == 0 {
+		return netip.Addr{}, false
+	}
+
+	i := family.choose(a.randReader)
+
+	a.allocated[i].Add(1)
+
+	if familyAlloc, ok := a.allocs[i].(FamilyAddrAllocator); ok {
+		return familyAlloc.NextAddrOf(is4)
+	}
+
+	return a.allocs[i].NextAddr(), true
+}
+
+// Restrict returns allocator over the parts of the prefixes which are covered by the allowed prefixes,
+// prefix covered as a whole shares underlying allocator with the original allocator,
+// allowed prefix narrower than the allocator prefix gets its own allocator which keeps exclusions (if any).
+// Usage counters are shared with the original allocator
+func (a *WeightedAllocator) Restrict(allowed []netip.Prefix) (AddrAllocator, error) {
+	r := &WeightedAllocator{
+		randReader: a.randReader,
+	}
+
+	add := func(i int, prefix netip.Prefix, alloc AddrAllocator) {
+		j := len(r.prefixes)
+
+		r.prefixes = append(r.prefixes, WeightedPrefix{Prefix: prefix, Weight: a.prefixes[i].Weight})
+		r.allocs = append(r.allocs, alloc)
+		r.allocated = append(r.allocated, a.allocated[i])
+
+		r.all.add(j, a.prefixes[i].Weight)
+		r.families[familyIdx(prefix.Addr().Is4())].add(j, a.prefixes[i].Weight)
+	}
+
+	for i, p := range a.prefixes {
+		covered := slices.ContainsFunc(allowed, func(allowed netip.Prefix) bool {
+			return allowed.Bits() <= p.Prefix.Bits() && allowed.Contains(p.Prefix.Addr())
+		})
+		if covered {
+			add(i, p.Prefix, a.allocs[i])
+			continue
+		}
+
+		for _, sub := range allowed {
+			sub = sub.Masked()
+			if sub.Bits() <= p.Prefix.Bits() || !p.Prefix.Contains(sub.Addr()) {
+				continue
+			}
+
+			// Nested allowed prefixes would be chosen twice as often
+			nested := slices.ContainsFunc(allowed, func(other netip.Prefix) bool {
+				return other.Bits() < sub.Bits() && other.Contains(sub.Addr())
+			})
+			if nested {
+				continue
+			}
+
+			alloc, err := subPrefixAlloc(a.randReader, a.allocs[i], sub)
+			if errors.Is(err, ErrIPSetEmpty) {
+				// All addresses of the allowed prefix are excluded
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to make allocator of %s: %w", sub, err)
+			}
+
+			add(i, sub, alloc)
+		}
+	}
+
+	if len(r.prefixes) == 0 {
+		return nil, ErrNoAllowedPrefixes
+	}
+
+	return r, nil
+}
+
+// Usage returns number of addresses allocated from each prefix since start
+func (a *WeightedAllocator) Usage() []PrefixUsage {
+	usage := make([]PrefixUsage, len(a.prefixes))
+	for i, p := range a.prefixes {
+		usage[i] = PrefixUsage{
+			Prefix:    p.Prefix,
+			Allocated: a.allocated[i].Load(),
+		}
+	}
+
+	return usage
+}
+
+// MarshalText encodes state of the underlying allocators which support it, one allocator per line
+func (a *WeightedAllocator) MarshalText() ([]byte, error) {
+	var buf bytes.Buffer
+
+	for _, alloc := range a.allocs {
+		m, ok := alloc.(encoding.TextMarshaler)
+		if !ok {
+			continue
+		}
+
+		state, err := m.MarshalText()
+		if err != nil {
+			return nil, err
+		}
+
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.Write(state)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalText restores state of the underlying allocators, each line is applied to the allocator which accepts it,
+// lines which are not accepted by any allocator (e.g. prefix was removed from configuration) are reported as error
+// after all other lines are applied
+func (a *WeightedAllocator) UnmarshalText(text []byte) error {
+	var errs []error
+
+	for lineNo, line := range bytes.Split(text, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		accepted := false
+		for _, alloc := range a.allocs {
+			u, ok := alloc.(encoding.TextUnmarshaler)
+			if ok && u.UnmarshalText(line) == nil {
+				accepted = true
+				break
+			}
+		}
+
+		if !accepted {
+			errs = append(errs, fmt.Errorf("line %d: state is not accepted by any allocator", lineNo+1))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,258 @@
+package utils
+
+import (
+	"errors"
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+func TestParseWeightedPrefix(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    WeightedPrefix
+		wantErr bool
+	}{
+		{"10.0.0.1/24", WeightedPrefix{netip.MustParsePrefix("10.0.0.0/24"), 1}, false},
+		{"2001:db8::/48=3", WeightedPrefix{netip.MustParsePrefix("2001:db8::/48"), 3}, false},
+		{" 10.0.0.0/27 = 2 ", WeightedPrefix{netip.MustParsePrefix("10.0.0.0/27"), 2}, false},
+		{"10.0.0.0/27=0", WeightedPrefix{}, true},
+		{"10.0.0.0/27=-1", WeightedPrefix{}, true},
+		{"10.0.0.0", WeightedPrefix{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseWeightedPrefix(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseWeightedPrefix() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("ParseWeightedPrefix() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWeightedAllocatorProportions(t *testing.T) {
+	randReader := rand.New(NewLockedSource(testSeed))
+
+	prefixes := []WeightedPrefix{
+		{netip.MustParsePrefix("10.0.0.0/27"), 1},
+		{netip.MustParsePrefix("2001:db8::/48"), 3},
+	}
+
+	allocs := make([]AddrAllocator, len(prefixes))
+	for i, p := range prefixes {
+		allocs[i] = NewRandomAllocator(randReader, p.Prefix)
+	}
+
+	alloc, err := NewWeightedAllocator(randReader, prefixes, allocs)
+	if err != nil {
+		t.Fatalf("NewWeightedAllocator() error = %v", err)
+	}
+
+	const n = 40000
+
+	counts := make([]int, len(prefixes))
+	for i := 0; i < n; i++ {
+		got := alloc.NextAddr()
+
+		matched := false
+		for j, p := range prefixes {
+			if p.Prefix.Contains(got) {
+				counts[j]++
+				matched = true
+			}
+		}
+
+		if !matched {
+			t.Fatalf("NextAddr() got = %v which is out of configured prefixes", got)
+		}
+	}
+
+	// Expect 1/4 and 3/4 of allocations with some tolerance
+	if counts[0] < n/4-n/50 || counts[0] > n/4+n/50 {
+		t.Errorf("NextAddr() got %d of %d addresses from %s, want about %d", counts[0], n, prefixes[0].Prefix, n/4)
+	}
+
+	for i, u := range alloc.Usage() {
+		if u.Prefix != prefixes[i].Prefix || u.Allocated != uint64(counts[i]) {
+			t.Errorf("Usage() got = %+v, want %d allocations from %s", u, counts[i], prefixes[i].Prefix)
+		}
+	}
+}
+
+func TestWeightedAllocatorResume(t *testing.T) {
+	prefixes := []WeightedPrefix{
+		{netip.MustParsePrefix("10.0.0.0/24"), 1},
+		{netip.MustParsePrefix("2001:db8::/112"), 1},
+	}
+
+	makeAlloc := func() *WeightedAllocator {
+		allocs := make([]AddrAllocator, len(prefixes))
+		for i, p := range prefixes {
+			allocs[i] = NewPermutationAllocator(testSeed, p.Prefix)
+		}
+
+		alloc, err := NewWeightedAllocator(rand.New(NewLockedSource(testSeed)), prefixes, allocs)
+		if err != nil {
+			t.Fatalf("NewWeightedAllocator() error = %v", err)
+		}
+
+		return alloc
+	}
+
+	alloc := makeAlloc()
+	for i := 0; i < 100; i++ {
+		alloc.NextAddr()
+	}
+
+	state, err := alloc.MarshalText()
+	if err != nil {
+		t.Fatalf("MarshalText() error = %v", err)
+	}
+
+	resumed := makeAlloc()
+	// Skip the same number of random prefix choices
+	for i := 0; i < 100; i++ {
+		resumed.randReader.Uint64N(2)
+	}
+
+	if err := resumed.UnmarshalText(state); err != nil {
+		t.Fatalf("UnmarshalText() error = %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if want, got := alloc.NextAddr(), resumed.NextAddr(); want != got {
+			t.Fatalf("Resumed allocator diverged at %d: got = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestWeightedAllocatorRestrict(t *testing.T) {
+	randReader := rand.New(NewLockedSource(testSeed))
+
+	prefixes := []WeightedPrefix{
+		{netip.MustParsePrefix("10.0.0.0/27"), 1},
+		{netip.MustParsePrefix("10.0.1.0/27"), 1},
+		{netip.MustParsePrefix("2001:db8::/48"), 1},
+	}
+
+	allocs := make([]AddrAllocator, len(prefixes))
+	for i, p := range prefixes {
+		allocs[i] = NewRandomAllocator(randReader, p.Prefix)
+	}
+
+	alloc, err := NewWeightedAllocator(randReader, prefixes, allocs)
+	if err != nil {
+		t.Fatalf("NewWeightedAllocator() error = %v", err)
+	}
+
+	restricted, err := alloc.Restrict([]netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")})
+	if err != nil {
+		t.Fatalf("Restrict() error = %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if got := restricted.NextAddr(); !prefixes[1].Prefix.Contains(got) {
+			t.Fatalf("NextAddr() got = %v which is out of allowed prefix", got)
+		}
+	}
+
+	if _, ok := restricted.(FamilyAddrAllocator).NextAddrOf(false); ok {
+		t.Errorf("NextAddrOf() returned IPv6 address which is not allowed")
+	}
+
+	// Usage counters are shared with the original allocator
+	if got := alloc.Usage()[1].Allocated; got != 100 {
+		t.Errorf("Usage() got = %d allocations from %s, want 100", got, prefixes[1].Prefix)
+	}
+
+	// Allowed prefix narrower than the allocator prefix restricts addresses to its part
+	narrow := netip.MustParsePrefix("10.0.0.16/28")
+
+	restricted, err = alloc.Restrict([]netip.Prefix{narrow})
+	if err != nil {
+		t.Fatalf("Restrict() to the part of the prefix error = %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		if got := restricted.NextAddr(); !narrow.Contains(got) {
+			t.Fatalf("NextAddr() got = %v which is out of allowed prefix %s", got, narrow)
+		}
+	}
+
+	if got := alloc.Usage()[0].Allocated; got != 100 {
+		t.Errorf("Usage() got = %d allocations from %s, want 100", got, prefixes[0].Prefix)
+	}
+
+	if _, err := alloc.Restrict([]netip.Prefix{netip.MustParsePrefix("192.168.0.0/16")}); !errors.Is(err, ErrNoAllowedPrefixes) {
+		t.Errorf("Restrict() to the foreign prefix error = %v, want %v", err, ErrNoAllowedPrefixes)
+	}
+}
+
+func TestWeightedAllocatorRestrictExcluded(t *testing.T) {
+	randReader := rand.New(NewLockedSource(testSeed))
+
+	prefix := netip.MustParsePrefix("10.0.0.0/24")
+
+	set := &IPSet{}
+	set.AddPrefix(prefix)
+	set.RemovePrefix(netip.MustParsePrefix("10.0.0.0/26"))
+	set.Remove(netip.MustParseAddr("10.0.0.64"))
+
+	randomAlloc, err := NewRandomSetAllocator(randReader, set)
+	if err != nil {
+		t.Fatalf("NewRandomSetAllocator() error = %v", err)
+	}
+
+	permutationAlloc, err := NewPermutationAllocatorExcluding(testSeed, prefix, ReservedAddrs(prefix))
+	if err != nil {
+		t.Fatalf("NewPermutationAllocatorExcluding() error = %v", err)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		alloc   AddrAllocator
+		allowed netip.Prefix
+		// excluded is excluded address of the allowed prefix
+		excluded netip.Addr
+	}{
+		{"random", randomAlloc, netip.MustParsePrefix("10.0.0.64/30"), netip.MustParseAddr("10.0.0.64")},
+		{"permutation", permutationAlloc, netip.MustParsePrefix("10.0.0.252/30"), netip.MustParseAddr("10.0.0.255")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc, err := NewWeightedAllocator(randReader, []WeightedPrefix{{prefix, 1}}, []AddrAllocator{tt.alloc})
+			if err != nil {
+				t.Fatalf("NewWeightedAllocator() error = %v", err)
+			}
+
+			restricted, err := alloc.Restrict([]netip.Prefix{tt.allowed})
+			if err != nil {
+				t.Fatalf("Restrict() error = %v", err)
+			}
+
+			for i := 0; i < 100; i++ {
+				got := restricted.NextAddr()
+				if !tt.allowed.Contains(got) {
+					t.Fatalf("NextAddr() got = %v which is out of allowed prefix %s", got, tt.allowed)
+				}
+
+				if got == tt.excluded {
+					t.Fatalf("NextAddr() got excluded address %v", got)
+				}
+			}
+		})
+	}
+
+	// Allowed prefix without addresses left after exclusions is skipped
+	alloc, err := NewWeightedAllocator(randReader, []WeightedPrefix{{prefix, 1}}, []AddrAllocator{randomAlloc})
+	if err != nil {
+		t.Fatalf("NewWeightedAllocator() error = %v", err)
+	}
+
+	if _, err := alloc.Restrict([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/27")}); !errors.Is(err, ErrNoAllowedPrefixes) {
+		t.Errorf("Restrict() to the excluded prefix error = %v, want %v", err, ErrNoAllowedPrefixes)
+	}
+}